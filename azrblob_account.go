@@ -0,0 +1,278 @@
+package azrblob
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/spf13/afero"
+)
+
+// AccountFs is an FS object presenting every container of an Azure storage
+// account as a single file system. The first path segment selects the
+// container and the remainder is the blob name, so Open("/containerA/path/file")
+// opens the blob "path/file" in container "containerA".
+type AccountFs struct {
+	ctx        *context.Context
+	serviceURL *azblob.ServiceURL
+	options    FsOptions
+
+	mu         sync.Mutex
+	containers map[string]*Fs
+}
+
+// NewAccountFs creates a new AccountFs object for the storage account behind serviceURL.
+func NewAccountFs(ctx *context.Context, serviceURL *azblob.ServiceURL, options FsOptions) *AccountFs {
+	return &AccountFs{
+		ctx:        ctx,
+		serviceURL: serviceURL,
+		options:    options,
+		containers: make(map[string]*Fs),
+	}
+}
+
+// containerFs returns the Fs of the given container, a container is cached when
+// it was initialized with InitCachedContainers
+func (afs *AccountFs) containerFs(container string) *Fs {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+
+	fs, ok := afs.containers[container]
+	if !ok {
+		cached := false
+		for _, c := range CachedContainers {
+			if c.Container == container {
+				cached = true
+			}
+		}
+		fs = NewFsWithOptions(afs.ctx, afs.serviceURL, container, cached, afs.options)
+		afs.containers[container] = fs
+	}
+
+	return fs
+}
+
+// split separates the container from the blob name of a path, the blob name is
+// "/" when the path is the container itself and container is "" for the account root
+func (afs *AccountFs) split(name string) (fs *Fs, blob string) {
+	parts := strings.SplitN(strings.Trim(name, "/"), "/", 2)
+	if parts[0] == "" {
+		return nil, "/"
+	}
+
+	blob = "/"
+	if len(parts) == 2 && parts[1] != "" {
+		blob = parts[1]
+	}
+
+	return afs.containerFs(parts[0]), blob
+}
+
+// Name returns the type of FS object this is: AccountFs.
+func (*AccountFs) Name() string { return "azrblob-account" }
+
+// Create a file
+func (afs *AccountFs) Create(name string) (afero.File, error) {
+	fs, blob := afs.split(name)
+	if fs == nil || blob == "/" {
+		LogError(ErrNoContainer)
+		return nil, ErrNoContainer
+	}
+
+	return fs.Create(blob)
+}
+
+// Mkdir creates the container for a top level path, deeper paths are handled by the container's Fs.
+func (afs *AccountFs) Mkdir(name string, perm os.FileMode) error {
+	fs, blob := afs.split(name)
+	if fs == nil {
+		LogError(ErrNoContainer)
+		return ErrNoContainer
+	}
+
+	if blob == "/" {
+		if err := fs.checkWritable("mkdir", name); err != nil {
+			return err
+		}
+		return fs.createContainer(fs.container)
+	}
+
+	return fs.Mkdir(blob, perm)
+}
+
+// MkdirAll creates a directory and all parent directories if necessary.
+func (afs *AccountFs) MkdirAll(path string, perm os.FileMode) error {
+	fs, blob := afs.split(path)
+	if fs == nil {
+		LogError(ErrNoContainer)
+		return ErrNoContainer
+	}
+
+	if _, err := fs.getContainerFileInfo(); err != nil {
+		if err = fs.checkWritable("mkdir", path); err != nil {
+			return err
+		}
+		if err = fs.createContainer(fs.container); err != nil {
+			return err
+		}
+	}
+
+	if blob == "/" {
+		return nil
+	}
+
+	return fs.MkdirAll(blob, perm)
+}
+
+// Open a file for reading, opening the account root lists the containers.
+func (afs *AccountFs) Open(name string) (afero.File, error) {
+	return afs.OpenFile(name, os.O_RDONLY, 0777)
+}
+
+// OpenFile opens a file.
+func (afs *AccountFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	fs, blob := afs.split(name)
+	if fs == nil {
+		if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE) != 0 {
+			LogError(ErrNoContainer)
+			return nil, ErrNoContainer
+		}
+		return &accountRootFile{afs: afs}, nil
+	}
+
+	return fs.OpenFile(blob, flag, perm)
+}
+
+// Remove a file
+func (afs *AccountFs) Remove(name string) error {
+	fs, blob := afs.split(name)
+	if fs == nil || blob == "/" {
+		LogError(ErrNoContainer)
+		return ErrNoContainer
+	}
+
+	return fs.Remove(blob)
+}
+
+// RemoveAll removes all blobs under path, the containers themselves are kept
+func (afs *AccountFs) RemoveAll(path string) error {
+	fs, blob := afs.split(path)
+	if fs == nil {
+		LogError(ErrNoContainer)
+		return ErrNoContainer
+	}
+
+	return fs.RemoveAll(blob)
+}
+
+// Rename a file within a container, moving blobs between containers is not supported.
+func (afs *AccountFs) Rename(oldname, newname string) error {
+	oldFs, oldBlob := afs.split(oldname)
+	newFs, newBlob := afs.split(newname)
+	if oldFs == nil || newFs == nil || oldBlob == "/" || newBlob == "/" {
+		LogError(ErrNoContainer)
+		return ErrNoContainer
+	}
+
+	if oldFs != newFs {
+		err := notSupported("Rename across containers")
+		LogError(err)
+		return err
+	}
+
+	return oldFs.Rename(oldBlob, newBlob)
+}
+
+// Stat returns a FileInfo describing the named file.
+func (afs *AccountFs) Stat(name string) (os.FileInfo, error) {
+	fs, blob := afs.split(name)
+	if fs == nil {
+		return NewFileInfo("/", true, 0, time.Time{}), nil
+	}
+
+	return fs.Stat(blob)
+}
+
+// Chmod doesn't exists in Azure Blob Storage
+func (afs *AccountFs) Chmod(name string, mode os.FileMode) error {
+	err := notSupported("Chmod")
+	LogError(err)
+	return err
+}
+
+// Chtimes doesn't exists in Azure Blob Storage
+func (afs *AccountFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	err := notSupported("Chtimes")
+	LogError(err)
+	return err
+}
+
+// accountRootFile is the directory at the root of an AccountFs, its entries are the containers
+type accountRootFile struct {
+	afs   *AccountFs
+	names []string
+	read  bool
+}
+
+func (f *accountRootFile) Name() string { return "/" }
+
+func (f *accountRootFile) Readdir(n int) ([]os.FileInfo, error) {
+	names, err := f.Readdirnames(n)
+	fileInfos := make([]os.FileInfo, len(names))
+	for i, name := range names {
+		fileInfos[i] = NewFileInfo(name, true, 0, time.Time{})
+	}
+	return fileInfos, err
+}
+
+func (f *accountRootFile) Readdirnames(n int) ([]string, error) {
+	if !f.read {
+		// a throwaway Fs is enough to list the account's containers
+		names, err := NewFs(f.afs.ctx, f.afs.serviceURL, "", false).getContainers()
+		if err != nil {
+			return nil, err
+		}
+		f.names = names
+		f.read = true
+	}
+
+	if n <= 0 {
+		names := f.names
+		f.names = nil
+		return names, nil
+	}
+
+	if len(f.names) == 0 {
+		return nil, io.EOF
+	}
+
+	if n > len(f.names) {
+		n = len(f.names)
+	}
+	names := f.names[:n]
+	f.names = f.names[n:]
+
+	return names, nil
+}
+
+func (f *accountRootFile) Stat() (os.FileInfo, error) {
+	return NewFileInfo("/", true, 0, time.Time{}), nil
+}
+
+func (f *accountRootFile) Close() error { return nil }
+func (f *accountRootFile) Sync() error  { return nil }
+
+// errAccountRootIO is returned by the reads and writes of the account root, which is only listed
+var errAccountRootIO = notSupported("reading or writing the account root")
+
+func (f *accountRootFile) Read(p []byte) (int, error)                   { return 0, errAccountRootIO }
+func (f *accountRootFile) ReadAt(p []byte, off int64) (int, error)      { return 0, errAccountRootIO }
+func (f *accountRootFile) Seek(offset int64, whence int) (int64, error) { return 0, errAccountRootIO }
+func (f *accountRootFile) Write(p []byte) (int, error)                  { return 0, errAccountRootIO }
+func (f *accountRootFile) WriteAt(p []byte, off int64) (int, error)     { return 0, errAccountRootIO }
+func (f *accountRootFile) WriteString(s string) (int, error)            { return 0, errAccountRootIO }
+func (f *accountRootFile) Truncate(size int64) error                    { return errAccountRootIO }
@@ -6,11 +6,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net/url"
+	"math/rand"
+	"net/http"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
@@ -22,28 +26,94 @@ const (
 	secCycleCheckSleep    = 60
 	maxFileOpRetries      = 10
 	secFileOpRetrySleep   = 5
+	// cycleJitter - the caches refresh after up to this fraction of their cycle on top of it
+	cycleJitter = 0.1
 )
 
-// CreateCache - fields needed to initialize a cached container
+// CreateCache - fields needed to initialize a cached container, ServiceURL can be given
+// instead of AccountName and AccountKey to reuse an existing Fs's service URL and pipeline
 type CreateCache struct {
 	Name        string
 	Cycle       float64
 	Path        string
 	AccountName string
 	AccountKey  string
+	ServiceURL  *azblob.ServiceURL
+	// HTTPClient sends the requests when the pipeline is built from AccountName and AccountKey
+	HTTPClient *http.Client
+	// Telemetry is prepended to the User-Agent so the requests can be told apart in storage analytics logs
+	Telemetry string
+	// PageSize is the number of blobs asked per listing request when updating the cache (0 lets Azure pick)
+	PageSize int32
+	// InMemory skips the CSV files kept under Path as a copy of the blob list served
+	// from memory, so the cache never writes to disk (e.g. on read-only runtime images)
+	InMemory bool
+	// ShardPrefixes splits the listing of each update into one listing per prefix,
+	// run concurrently, for very large containers. Every blob must start with
+	// exactly one of them (e.g. "0" to "9" and "a" to "f" for blobs named after a
+	// hex hash), the blobs starting with none of them aren't cached.
+	ShardPrefixes []string
+	// ServerTimeout bounds each listing request of an update, see FsOptions.ServerTimeout
+	ServerTimeout time.Duration
+	// SecondaryHost is the read-only secondary endpoint of a read-access geo-redundant
+	// (RA-GRS) account, usually SecondaryHost(AccountName), used when the pipeline is
+	// built from AccountName and AccountKey. The reads failing on the primary endpoint
+	// are retried on it during an outage, the writes only go to the primary.
+	SecondaryHost string
+	// Clock times the cycles, the file names of the updates and the file operation
+	// retries (nil for the real clock)
+	Clock Clock
+}
+
+// pipelineOptions - the options used to build the pipeline from AccountName and AccountKey
+func (container CreateCache) pipelineOptions() azblob.PipelineOptions {
+	var po azblob.PipelineOptions
+	if container.HTTPClient != nil {
+		po.HTTPSender = NewHTTPClientSender(container.HTTPClient)
+	}
+	po.Telemetry.Value = container.Telemetry
+	po.Retry.RetryReadsFromSecondaryHost = container.SecondaryHost
+	return po
 }
 
 // ContainerCache - a struct that represents all the necessary info to manage the caching of a container's blob list
 type ContainerCache struct {
-	Container  string
-	Cycle      float64
-	Path       string
-	stop       bool
-	updating   bool
-	lastUpdate time.Time
-	ctx        *context.Context
-	serviceURL *azblob.ServiceURL
-	marker     azblob.Marker
+	// Accessed atomically as startCycling runs in its own goroutine, first to keep them 64-bit aligned
+	lastUpdate int64 // UnixNano of the last complete update, see lastUpdated
+	stop       int32 // set by stopCycling
+
+	Container     string
+	Cycle         float64
+	Path          string
+	updating      bool
+	ctx           *context.Context
+	serviceURL    *azblob.ServiceURL
+	pageSize      int32
+	shards        []string
+	serverTimeout time.Duration
+	inMemory      bool
+	view          *memoryCache
+	clock         Clock
+}
+
+// memoryCache - the last complete blob list of a cache, shared by the copies of its ContainerCache.
+// Each update swaps in a new list atomically, so readers get either the previous or the new one
+// and never wait for an update.
+type memoryCache struct {
+	records atomic.Value // [][]string
+}
+
+// get - the last complete blob list, ok is false until the first update completes
+func (mc *memoryCache) get() (records [][]string, ok bool) {
+	records, ok = mc.records.Load().([][]string)
+	return records, ok
+}
+
+func (mc *memoryCache) set(records [][]string) {
+	if records == nil {
+		records = [][]string{}
+	}
+	mc.records.Store(records)
 }
 
 // CachedContainers - collection of cached containers
@@ -76,23 +146,42 @@ func createContainerCache(container CreateCache) (ContainerCache, error) {
 		container.Path = os.TempDir()
 	}
 
-	if container.AccountName == "" {
-		err := fmt.Errorf("accountName not specified for cached container %s", container.Name)
-		return cache, err
+	if container.ServiceURL == nil {
+		if container.AccountName == "" {
+			err := fmt.Errorf("accountName not specified for cached container %s", container.Name)
+			return cache, err
+		}
+		if container.AccountKey == "" {
+			err := fmt.Errorf("accountKey not specified for cached container %s", container.Name)
+			return cache, err
+
+		}
 	}
-	if container.AccountKey == "" {
-		err := fmt.Errorf("accountKey not specified for cached container %s", container.Name)
-		return cache, err
 
+	shards, err := sortShardPrefixes(container.ShardPrefixes)
+	if err != nil {
+		return cache, fmt.Errorf("%s on cached container %s", err.Error(), container.Name)
 	}
 
 	cache.Cycle = container.Cycle
 	cache.Container = container.Name
 	cache.Path = container.Path
-
-	err := cache.initCredentials(container.AccountName, container.AccountKey)
-	if err != nil {
-		return cache, err
+	cache.pageSize = container.PageSize
+	cache.shards = shards
+	cache.serverTimeout = container.ServerTimeout
+	cache.inMemory = container.InMemory
+	cache.view = &memoryCache{}
+	cache.clock = container.Clock
+
+	if container.ServiceURL != nil {
+		c := context.Background()
+		cache.serviceURL = container.ServiceURL
+		cache.ctx = &c
+	} else {
+		err := cache.initCredentials(container.AccountName, container.AccountKey, container.pipelineOptions())
+		if err != nil {
+			return cache, err
+		}
 	}
 
 	err = cache.update()
@@ -151,7 +240,7 @@ func (cc *ContainerCache) getCacheOldFilePath() string {
 }
 
 // initCredentials - initialize the context and service for the provided credentials
-func (cc *ContainerCache) initCredentials(accountName, accountKey string) error {
+func (cc *ContainerCache) initCredentials(accountName, accountKey string, po azblob.PipelineOptions) error {
 	if accountName == "" || accountKey == "" {
 		err := fmt.Errorf("accountName and accountKey are  both requird for azure container %s", cc.Container)
 		return err
@@ -164,9 +253,8 @@ func (cc *ContainerCache) initCredentials(accountName, accountKey string) error
 	}
 
 	// build the context for the Azure Blob Storage
-	p := azblob.NewPipeline(credential, azblob.PipelineOptions{})
-	u, _ := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net", accountName))
-	su := azblob.NewServiceURL(*u, p)
+	p := azblob.NewPipeline(credential, po)
+	su := newServiceURL(accountName, p)
 	c := context.Background()
 	cc.serviceURL = &su
 	cc.ctx = &c
@@ -174,11 +262,22 @@ func (cc *ContainerCache) initCredentials(accountName, accountKey string) error
 	return nil
 }
 
-// startCycling - starts the periodic updating of the container cache based on the cycle
+// getClock - the clock of the cache, the real clock unless CreateCache.Clock was set
+func (cc *ContainerCache) getClock() Clock {
+	return clockOrReal(cc.clock)
+}
+
+// startCycling - starts the periodic updating of the container cache based on the cycle,
+// with a random initial delay and a random jitter on each cycle so that caches started
+// together don't refresh at the same time
 func (cc *ContainerCache) startCycling() {
-	for cc.stop == false {
+	clock := cc.getClock()
+	clock.Sleep(time.Duration(rand.Int63n(int64(time.Second * secCycleCheckSleep))))
+	cycle := cc.jitteredCycle()
+	for atomic.LoadInt32(&cc.stop) == 0 {
 		if !cc.updating {
-			if time.Since(cc.lastUpdate).Minutes() >= cc.Cycle {
+			if clock.Now().Sub(cc.lastUpdated()) >= cycle {
+				cycle = cc.jitteredCycle()
 				err := make(chan error)
 				go cc.cycleUpdate(err)
 				cerr := <-err
@@ -187,11 +286,35 @@ func (cc *ContainerCache) startCycling() {
 				}
 			}
 		}
-		time.Sleep(time.Second * secCycleCheckSleep)
+		// wake up on time for the next update rather than on the next check
+		sleep := time.Second * secCycleCheckSleep
+		if remaining := cycle - clock.Now().Sub(cc.lastUpdated()); remaining > 0 && remaining < sleep {
+			sleep = remaining
+		}
+		clock.Sleep(sleep)
 	}
 	return
 }
 
+// stopCycling - makes startCycling return once it wakes up
+func (cc *ContainerCache) stopCycling() {
+	atomic.StoreInt32(&cc.stop, 1)
+}
+
+// lastUpdated - the time of the last complete update, the zero time before the first one
+func (cc *ContainerCache) lastUpdated() time.Time {
+	nanos := atomic.LoadInt64(&cc.lastUpdate)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// jitteredCycle - the cycle plus a random jitter of up to cycleJitter of it
+func (cc *ContainerCache) jitteredCycle() time.Duration {
+	return time.Duration(cc.Cycle * (1 + cycleJitter*rand.Float64()) * float64(time.Minute))
+}
+
 // cycleUpdate - the thread that updates the cache data and manages the cache files
 func (cc *ContainerCache) cycleUpdate(err chan error) {
 	cerr := cc.update()
@@ -222,7 +345,7 @@ func (cc *ContainerCache) createRetry(filePath string, maxAttempts int) (*os.Fil
 	attempts = 0
 	for file, err = os.Create(filePath); err != nil && attempts < maxAttempts; attempts++ {
 		cc.logInfo(fmt.Sprintf("unable to create cache file %s on attempt %d due to %s", filePath, attempts+1, err.Error()))
-		time.Sleep(time.Second * secFileOpRetrySleep)
+		cc.getClock().Sleep(time.Second * secFileOpRetrySleep)
 		file, err = os.Create(filePath)
 	}
 	if err != nil {
@@ -231,34 +354,69 @@ func (cc *ContainerCache) createRetry(filePath string, maxAttempts int) (*os.Fil
 	return file, nil
 }
 
-// update - gets the latest blob listing from the container and writes [Name,Size,LastModified] for each blob to a CSV file
+// update - gets the latest blob listing from the container and writes [Name,Size,LastModified] for each blob to a CSV file,
+// the whole listing is read every cycle as the change feed can't be read with the azblob SDK in use,
+// concurrently by shard when ShardPrefixes are set
 func (cc *ContainerCache) update() error {
 	cc.updating = true
 	defer func() { cc.updating = false }()
 	cc.logInfo("updating")
 
-	updatedOn := time.Now()
-	filePath := cc.getCacheNewFilePath(updatedOn)
+	updatedOn := cc.getClock().Now()
 
-	file, err := cc.createRetry(filePath, maxFileOpRetries)
+	// the records are collected for the in memory view, and written to a new CSV file unless the cache is in memory only
+	var (
+		records [][]string
+		writer  *csv.Writer
+	)
+	if !cc.inMemory {
+		file, err := cc.createRetry(cc.getCacheNewFilePath(updatedOn), maxFileOpRetries)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		writer = csv.NewWriter(file)
+		defer writer.Flush()
+	}
+
+	write := func(record []string) error {
+		records = append(records, record)
+		if writer == nil {
+			return nil
+		}
+		return writer.Write(record)
+	}
+
+	var err error
+	if len(cc.shards) == 0 {
+		err = cc.listRecords("", write)
+	} else {
+		err = cc.listShards(write)
+	}
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	if cc.view != nil {
+		cc.view.set(records)
+	}
+	atomic.StoreInt64(&cc.lastUpdate, updatedOn.UnixNano())
+	cc.logInfo("updated")
+	return nil
+}
 
+// listRecords - lists the blobs under prefix and passes the [Name,Size,LastModified] record of each to fn
+func (cc *ContainerCache) listRecords(prefix string, fn func(record []string) error) error {
 	containerURL := cc.serviceURL.NewContainerURL(cc.Container)
-	for cc.marker = (azblob.Marker{}); cc.marker.NotDone(); {
-		listBlob, err := containerURL.ListBlobsFlatSegment(*cc.ctx, cc.marker, azblob.ListBlobsSegmentOptions{})
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		listBlob, err := listBlobsFlatSegment(*cc.ctx, cc.getClock(), cc.serverTimeout, containerURL, marker, azblob.ListBlobsSegmentOptions{Prefix: prefix, MaxResults: cc.pageSize})
 		if err != nil {
 			return err
 		}
 
 		// IMPORTANT: ListBlobs returns the start of the next segment; you MUST use this to get
 		// the next segment (after processing the current result segment).
-		cc.marker = listBlob.NextMarker
+		marker = listBlob.NextMarker
 
 		// Process the blobs returned in this result segment
 		for _, blobInfo := range listBlob.Segment.BlobItems {
@@ -267,17 +425,66 @@ func (cc *ContainerCache) update() error {
 				continue
 			}
 			record := []string{blobInfo.Name, fmt.Sprintf("%d", *blobInfo.Properties.ContentLength), blobInfo.Properties.LastModified.Format(cacheDateFormat)}
-			err = writer.Write(record)
-			if err != nil {
+			if err = fn(record); err != nil {
 				return err
 			}
 		}
 	}
-	cc.lastUpdate = updatedOn
-	cc.logInfo("updated")
 	return nil
 }
 
+// listShards - lists the shards concurrently and passes their records to fn shard after shard,
+// the prefixes being sorted and none starting another the records stay sorted by name
+func (cc *ContainerCache) listShards(fn func(record []string) error) error {
+	shardRecords := make([][][]string, len(cc.shards))
+	shardErrors := make([]error, len(cc.shards))
+	var wg sync.WaitGroup
+	for i, prefix := range cc.shards {
+		wg.Add(1)
+		go func(i int, prefix string) {
+			defer wg.Done()
+			shardErrors[i] = cc.listRecords(prefix, func(record []string) error {
+				shardRecords[i] = append(shardRecords[i], record)
+				return nil
+			})
+		}(i, prefix)
+	}
+	wg.Wait()
+
+	for i := range cc.shards {
+		if shardErrors[i] != nil {
+			return shardErrors[i]
+		}
+	}
+	for _, records := range shardRecords {
+		for _, record := range records {
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sortShardPrefixes - returns the sorted shard prefixes, failing when one of them starts another
+// as the blobs under both would be listed twice
+func sortShardPrefixes(prefixes []string) ([]string, error) {
+	if len(prefixes) == 0 {
+		return nil, nil
+	}
+	shards := append([]string(nil), prefixes...)
+	sort.Strings(shards)
+	for i, prefix := range shards {
+		if prefix == "" {
+			return nil, errors.New("empty shard prefix")
+		}
+		if i > 0 && strings.HasPrefix(prefix, shards[i-1]) {
+			return nil, fmt.Errorf("shard prefix %s starts with shard prefix %s", prefix, shards[i-1])
+		}
+	}
+	return shards, nil
+}
+
 // renameRetry - attempts to rename the old cache file and new cache file with a retry mechanism up to a maximum number of retries
 func (cc *ContainerCache) renameRetry(oldFilePath, newFilePath string, maxAttempts int) error {
 	var (
@@ -287,7 +494,7 @@ func (cc *ContainerCache) renameRetry(oldFilePath, newFilePath string, maxAttemp
 	attempts = 0
 	for err = os.Rename(oldFilePath, newFilePath); err != nil && attempts < maxAttempts; attempts++ {
 		cc.logInfo(fmt.Sprintf("unable to rename cache file %s on attempt %d due to %s", oldFilePath, attempts+1, err.Error()))
-		time.Sleep(time.Second * secFileOpRetrySleep)
+		cc.getClock().Sleep(time.Second * secFileOpRetrySleep)
 		err = os.Rename(oldFilePath, newFilePath)
 	}
 	if err != nil {
@@ -300,8 +507,12 @@ func (cc *ContainerCache) renameRetry(oldFilePath, newFilePath string, maxAttemp
 func (cc *ContainerCache) renameNew() error {
 	var err error
 
+	if cc.inMemory {
+		return nil
+	}
+
 	cacheFilePath := cc.getCacheFilePath()
-	cacheNewFilePath := cc.getCacheNewFilePath(cc.lastUpdate)
+	cacheNewFilePath := cc.getCacheNewFilePath(cc.lastUpdated())
 	cacheOldFilePath := cc.getCacheOldFilePath()
 
 	// check to make sure the new file exists
@@ -340,7 +551,7 @@ func (cc *ContainerCache) deleteRetry(filePath string, maxAttempts int) error {
 	attempts = 0
 	for err = os.Remove(filePath); err != nil && attempts < maxAttempts; attempts++ {
 		cc.logInfo(fmt.Sprintf("unable to remove cache file %s on attempt %d due to %s", filePath, attempts+1, err.Error()))
-		time.Sleep(time.Second * secFileOpRetrySleep)
+		cc.getClock().Sleep(time.Second * secFileOpRetrySleep)
 		err = os.Remove(filePath)
 	}
 	if err != nil {
@@ -353,6 +564,10 @@ func (cc *ContainerCache) deleteRetry(filePath string, maxAttempts int) error {
 func (cc *ContainerCache) deleteOld() error {
 	var err error
 
+	if cc.inMemory {
+		return nil
+	}
+
 	cacheOldFilePath := cc.getCacheOldFilePath()
 	if _, err = os.Stat(cacheOldFilePath); err == nil {
 		err = cc.deleteRetry(cacheOldFilePath, maxFileOpRetries)
@@ -390,7 +605,7 @@ func (cc *ContainerCache) openFileRetry(filePath string, maxAttempts int) (*os.F
 	attempts = 0
 	for file, err = os.Open(filePath); err != nil && attempts < maxAttempts; attempts++ {
 		cc.logInfo(fmt.Sprintf("unable to open cache file %s on attempt %d due to %s", filePath, attempts+1, err.Error()))
-		time.Sleep(time.Second * secFileOpRetrySleep)
+		cc.getClock().Sleep(time.Second * secFileOpRetrySleep)
 		file, err = os.Open(filePath)
 	}
 	if err != nil {
@@ -399,24 +614,47 @@ func (cc *ContainerCache) openFileRetry(filePath string, maxAttempts int) (*os.F
 	return file, nil
 }
 
-// ReadCache - reads in the cached container CSV file and returns an array of FileInfo
+// ReadCache - reads the last complete blob list of the cached container and returns an array of FileInfo,
+// an update in progress never blocks it. The CSV file is only read when the list isn't in memory yet.
 func (cc *ContainerCache) ReadCache(prefix, filter, cacheMarker string, n int) ([]os.FileInfo, error) {
-	var result []os.FileInfo
-
-	cacheFilePath := cc.getCacheFilePath()
+	var (
+		result  []os.FileInfo
+		err     error
+		next    func() ([]string, error)
+		records [][]string
+		ok      bool
+	)
 
-	// check to make sure the cache file exists
-	if _, err := os.Stat(cacheFilePath); err != nil {
-		cc.logError(err)
-		return result, err
+	if cc.view != nil {
+		records, ok = cc.view.get()
 	}
+	if ok {
+		next = func() ([]string, error) {
+			if len(records) == 0 {
+				return nil, io.EOF
+			}
+			record := records[0]
+			records = records[1:]
+			return record, nil
+		}
+	} else {
+		cacheFilePath := cc.getCacheFilePath()
 
-	file, err := cc.openFileRetry(cacheFilePath, maxFileOpRetries)
-	if err != nil {
-		cc.logError(err)
-		return result, err
+		// check to make sure the cache file exists
+		if _, err := os.Stat(cacheFilePath); err != nil {
+			cc.logError(err)
+			return result, err
+		}
+
+		file, err := cc.openFileRetry(cacheFilePath, maxFileOpRetries)
+		if err != nil {
+			cc.logError(err)
+			return result, err
+		}
+		defer file.Close()
+
+		next = csv.NewReader(file).Read
 	}
-	defer file.Close()
 
 	var rexp *regexp.Regexp
 	if filter != "" {
@@ -427,9 +665,8 @@ func (cc *ContainerCache) ReadCache(prefix, filter, cacheMarker string, n int) (
 	}
 
 	count := 0
-	reader := csv.NewReader(file)
 	for {
-		record, err := reader.Read()
+		record, err := next()
 		if err == io.EOF {
 			break
 		}
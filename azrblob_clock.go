@@ -0,0 +1,36 @@
+package azrblob
+
+import "time"
+
+// Clock tells the time and waits for the cache cycles, the file operation retries, the
+// backoff when Azure throttles, the polling of copies and the expiry of the negative
+// cache, see CreateCache.Clock and FsOptions.Clock. Tests can give a clock they advance
+// themselves to drive them without real sleeps.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock of the time package, used when none is given
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// clockOrReal returns clock, or the real clock when it is nil
+func clockOrReal(clock Clock) Clock {
+	if clock == nil {
+		return realClock{}
+	}
+	return clock
+}
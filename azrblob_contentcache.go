@@ -0,0 +1,72 @@
+package azrblob
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// cachedContent is the whole content of a blob as of etag
+type cachedContent struct {
+	name string
+	etag azblob.ETag
+	data []byte
+}
+
+// contentCache keeps the content of small blobs keyed by name, it is shared by
+// the Files of an Fs and evicts the least recently used blobs past maxBytes
+type contentCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	lru      *list.List // of *cachedContent, most recently used first
+	entries  map[string]*list.Element
+}
+
+func newContentCache(maxBytes int64) *contentCache {
+	return &contentCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached content of name, or nil if it isn't cached
+func (cc *contentCache) get(name string) *cachedContent {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	elem, ok := cc.entries[name]
+	if !ok {
+		return nil
+	}
+	cc.lru.MoveToFront(elem)
+	return elem.Value.(*cachedContent)
+}
+
+// put caches the content of name as of etag, replacing any previous content
+func (cc *contentCache) put(name string, etag azblob.ETag, data []byte) {
+	if int64(len(data)) > cc.maxBytes {
+		return
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if elem, ok := cc.entries[name]; ok {
+		cc.remove(elem)
+	}
+	cc.entries[name] = cc.lru.PushFront(&cachedContent{name: name, etag: etag, data: data})
+	cc.size += int64(len(data))
+
+	for cc.size > cc.maxBytes {
+		cc.remove(cc.lru.Back())
+	}
+}
+
+func (cc *contentCache) remove(elem *list.Element) {
+	content := cc.lru.Remove(elem).(*cachedContent)
+	delete(cc.entries, content.name)
+	cc.size -= int64(len(content.data))
+}
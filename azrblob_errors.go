@@ -0,0 +1,321 @@
+package azrblob
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// StorageError is returned when the Azure Blob Storage service rejects a request.
+// It exposes the details Microsoft support asks for without having to
+// type-assert the azblob internals.
+type StorageError struct {
+	err azblob.StorageError
+}
+
+// wrapStorageError wraps an azblob.StorageError into a *StorageError, any other
+// error (including nil) is returned unchanged
+func wrapStorageError(err error) error {
+	if serr, ok := err.(azblob.StorageError); ok {
+		return &StorageError{err: serr}
+	}
+	return err
+}
+
+// asStorageError returns the *StorageError err wraps, or nil if it doesn't wrap one
+func asStorageError(err error) *StorageError {
+	var serr *StorageError
+	if errors.As(err, &serr) {
+		return serr
+	}
+	if aerr, ok := err.(azblob.StorageError); ok {
+		return &StorageError{err: aerr}
+	}
+	return nil
+}
+
+// hasServiceCode reports whether err is a *StorageError with one of the given Azure error codes
+func hasServiceCode(err error, codes ...azblob.ServiceCodeType) bool {
+	var serr *StorageError
+	if !errors.As(err, &serr) {
+		return false
+	}
+	for _, code := range codes {
+		if serr.ServiceCode() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrThrottled is matched (with errors.Is) by the *StorageError returned when Azure
+// is throttling (ServerBusy or OperationTimedOut), callers should slow down.
+var ErrThrottled = errors.New("azure is throttling requests")
+
+// ErrPreconditionFailed is matched (with errors.Is) by the *StorageError returned when
+// the access conditions of a request aren't met, e.g. the ETag of the blob changed.
+var ErrPreconditionFailed = errors.New("access condition not met")
+
+// Is makes errors.Is(err, ErrThrottled) true for throttling errors, and
+// errors.Is(err, ErrPreconditionFailed) for unmet access conditions.
+func (e *StorageError) Is(target error) bool {
+	switch target {
+	case ErrThrottled:
+		return e.ServiceCode() == azblob.ServiceCodeServerBusy || e.ServiceCode() == azblob.ServiceCodeOperationTimedOut
+	case ErrPreconditionFailed:
+		return e.ServiceCode() == azblob.ServiceCodeConditionNotMet
+	}
+	return false
+}
+
+// Error returns the full error message from azblob.
+func (e *StorageError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying azblob.StorageError.
+func (e *StorageError) Unwrap() error {
+	return e.err
+}
+
+// Description returns the short, request independent, description of the error.
+func (e *StorageError) Description() string {
+	if resp := e.err.Response(); resp != nil {
+		return fmt.Sprintf("%s: %s", e.err.ServiceCode(), resp.Status)
+	}
+	return string(e.err.ServiceCode())
+}
+
+// RequestID returns the x-ms-request-id of the failed request.
+func (e *StorageError) RequestID() string {
+	if resp := e.err.Response(); resp != nil {
+		return resp.Header.Get("x-ms-request-id")
+	}
+	return ""
+}
+
+// ServiceCode returns the Azure error code, e.g. azblob.ServiceCodeBlobNotFound.
+func (e *StorageError) ServiceCode() azblob.ServiceCodeType {
+	return e.err.ServiceCode()
+}
+
+// StatusCode returns the HTTP status code of the failed request.
+func (e *StorageError) StatusCode() int {
+	if resp := e.err.Response(); resp != nil {
+		return resp.StatusCode
+	}
+	return 0
+}
+
+// ErrNoContainer is returned by AccountFs when a path doesn't select a container
+var ErrNoContainer = errors.New("path doesn't name a container")
+
+// ErrBlobArchived is matched (with errors.Is) by the error returned when reading
+// a blob in the Archive access tier
+var ErrBlobArchived = errors.New("blob is archived")
+
+// BlobArchivedError is returned when reading a blob in the Archive access tier,
+// the blob needs to be rehydrated with Fs.Rehydrate before it can be read.
+type BlobArchivedError struct {
+	Name string
+	err  error
+}
+
+// Error returns the name of the archived blob.
+func (e *BlobArchivedError) Error() string {
+	return fmt.Sprintf("blob %s is archived", e.Name)
+}
+
+// Is makes errors.Is(err, ErrBlobArchived) true.
+func (e *BlobArchivedError) Is(target error) bool {
+	return target == ErrBlobArchived
+}
+
+// Unwrap returns the underlying *StorageError.
+func (e *BlobArchivedError) Unwrap() error {
+	return e.err
+}
+
+// ErrWildcard is wrapped in the *os.PathError returned by Stat for a name with the
+// ? or * wildcards that isn't a blob, such a name can only be opened to list the matches
+var ErrWildcard = errors.New("name with wildcards doesn't name a blob")
+
+// ErrCopyVerificationFailed is wrapped in the *os.LinkError returned by Rename and
+// Copy when FsOptions.VerifyCopies is set and the copy doesn't match its source
+var ErrCopyVerificationFailed = errors.New("copy doesn't match its source")
+
+// ErrInvalidAccessMode is wrapped in the *os.PathError returned by OpenFile when the
+// flag sets more than one of O_RDONLY, O_WRONLY and O_RDWR. O_RDONLY being 0, it
+// can't be told apart from its absence, so O_RDONLY|O_WRONLY opens for writing.
+var ErrInvalidAccessMode = errors.New("exactly one of O_RDONLY, O_WRONLY and O_RDWR must be set")
+
+// ErrNoChecksum is returned by Checksum when the blob has no stored MD5
+var ErrNoChecksum = errors.New("blob has no stored checksum")
+
+// serviceCodeBlobImmutableDueToPolicy is the Azure error code of writes and deletes
+// refused by a legal hold or an immutability policy, azblob doesn't define it
+const serviceCodeBlobImmutableDueToPolicy azblob.ServiceCodeType = "BlobImmutableDueToPolicy"
+
+// ErrImmutable is matched (with errors.Is) by the error returned when deleting or
+// overwriting a blob protected by a legal hold or an immutability policy
+var ErrImmutable = errors.New("blob is immutable")
+
+// BlobImmutableError is returned when deleting or overwriting a blob protected by
+// a legal hold or an immutability policy.
+type BlobImmutableError struct {
+	Name string
+	err  error
+}
+
+// wrapImmutableError wraps err into a *BlobImmutableError when Azure refused the
+// operation because of a legal hold or an immutability policy
+func wrapImmutableError(blob string, err error) error {
+	if hasServiceCode(err, serviceCodeBlobImmutableDueToPolicy) {
+		return &BlobImmutableError{Name: blob, err: err}
+	}
+	return err
+}
+
+// Error returns the name of the immutable blob.
+func (e *BlobImmutableError) Error() string {
+	return fmt.Sprintf("blob %s is immutable", e.Name)
+}
+
+// Is makes errors.Is(err, ErrImmutable) true.
+func (e *BlobImmutableError) Is(target error) bool {
+	return target == ErrImmutable
+}
+
+// Unwrap returns the underlying *StorageError.
+func (e *BlobImmutableError) Unwrap() error {
+	return e.err
+}
+
+// ErrAppendPositionMismatch is matched (with errors.Is) by the error returned by
+// AppendBlock when its append position or max size condition isn't met
+var ErrAppendPositionMismatch = errors.New("append position condition not met")
+
+// AppendPositionError is returned by AppendBlock when the append blob isn't at the
+// expected position (e.g. the block was already appended before a retry) or
+// would grow past the expected max size.
+type AppendPositionError struct {
+	Name string
+	err  error
+}
+
+// wrapAppendPositionError wraps err into an *AppendPositionError when Azure
+// refused the append because of its append position conditions
+func wrapAppendPositionError(blob string, err error) error {
+	if hasServiceCode(err, azblob.ServiceCodeAppendPositionConditionNotMet, azblob.ServiceCodeMaxBlobSizeConditionNotMet) {
+		return &AppendPositionError{Name: blob, err: err}
+	}
+	return err
+}
+
+// Error returns the name of the append blob.
+func (e *AppendPositionError) Error() string {
+	return fmt.Sprintf("append to %s: append position condition not met", e.Name)
+}
+
+// Is makes errors.Is(err, ErrAppendPositionMismatch) true.
+func (e *AppendPositionError) Is(target error) bool {
+	return target == ErrAppendPositionMismatch
+}
+
+// Unwrap returns the underlying *StorageError.
+func (e *AppendPositionError) Unwrap() error {
+	return e.err
+}
+
+// ErrSequenceNumberMismatch is matched (with errors.Is) by the error returned by
+// WritePages and SetSequenceNumber when their sequence number condition isn't met
+var ErrSequenceNumberMismatch = errors.New("sequence number condition not met")
+
+// SequenceNumberError is returned when a page blob's sequence number doesn't meet
+// the condition of a write, e.g. another writer moved it on first.
+type SequenceNumberError struct {
+	Name string
+	err  error
+}
+
+// wrapSequenceNumberError wraps err into a *SequenceNumberError when Azure refused
+// the operation because of its sequence number conditions
+func wrapSequenceNumberError(blob string, err error) error {
+	if hasServiceCode(err, azblob.ServiceCodeSequenceNumberConditionNotMet) {
+		return &SequenceNumberError{Name: blob, err: err}
+	}
+	return err
+}
+
+// Error returns the name of the page blob.
+func (e *SequenceNumberError) Error() string {
+	return fmt.Sprintf("write to %s: sequence number condition not met", e.Name)
+}
+
+// Is makes errors.Is(err, ErrSequenceNumberMismatch) true.
+func (e *SequenceNumberError) Is(target error) bool {
+	return target == ErrSequenceNumberMismatch
+}
+
+// Unwrap returns the underlying *StorageError.
+func (e *SequenceNumberError) Unwrap() error {
+	return e.err
+}
+
+// ErrTooManyBlocks is matched (with errors.Is) by the error returned by File.Validate
+// and Close when more blocks were staged than a block blob can be committed from
+var ErrTooManyBlocks = errors.New("too many blocks for a block blob")
+
+// ErrBlobTooLarge is matched (with errors.Is) by the error returned by File.Validate
+// and Close when more was written than a block blob can hold
+var ErrBlobTooLarge = errors.New("too large for a block blob")
+
+// BlobLimitError is returned when what was written to a block blob is past one of
+// its limits, checked before committing it.
+type BlobLimitError struct {
+	Name string
+	// Actual is the number of blocks staged or bytes written, Allowed the limit
+	Actual  int64
+	Allowed int64
+	limit   error
+}
+
+// Error returns the name of the blob, the limit it is past and by how much.
+func (e *BlobLimitError) Error() string {
+	return fmt.Sprintf("blob %s: %v, %d > %d", e.Name, e.limit, e.Actual, e.Allowed)
+}
+
+// Unwrap returns ErrTooManyBlocks or ErrBlobTooLarge.
+func (e *BlobLimitError) Unwrap() error {
+	return e.limit
+}
+
+// BatchError is returned by the operations applied to many blobs when some of
+// them failed, the others were applied.
+type BatchError struct {
+	// Errors holds the error of each blob that failed, by the name it was given as
+	Errors map[string]error
+}
+
+// Error returns the number of blobs that failed and the first of them by name.
+func (e *BatchError) Error() string {
+	names := make([]string, 0, len(e.Errors))
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 1 {
+		return fmt.Sprintf("blob %s failed: %v", names[0], e.Errors[names[0]])
+	}
+	return fmt.Sprintf("%d blobs failed, %s: %v", len(names), names[0], e.Errors[names[0]])
+}
+
+// ErrOverlappingPrefixes is wrapped in the *os.LinkError returned by MoveDir when
+// one of the prefixes contains the other
+var ErrOverlappingPrefixes = errors.New("source and destination prefixes overlap")
+
+// ErrBlobTypeMismatch is wrapped in the *os.PathError returned by OpenFileWithOptions
+// when FileOptions.BlobType is set and the existing blob is of another type
+var ErrBlobTypeMismatch = errors.New("blob is of another type")
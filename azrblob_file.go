@@ -1,12 +1,17 @@
 package azrblob
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/base64"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/google/uuid"
@@ -38,35 +43,153 @@ func newBase64BlockID() string {
 }
 
 // File represents a file in Azure Blob storage.
+// A File is safe for concurrent use by multiple goroutines, its I/O methods
+// are serialized so that the read offset, listing markers and staged blocks
+// stay consistent.
 type File struct {
+	mu sync.Mutex // Guards the mutable state below
+
 	fs         *Fs         // Parent file system
-	name       string      // Name of the file
+	name       string      // Name of the blob, without a leading "/"
+	openName   string      // Name of the file as it was opened
 	cachedInfo os.FileInfo // File info cached for later used
+	options    FileOptions // Options given when opening the file
 
 	// State of the stream if we are reading the file
 	streamRead       bool
 	streamReadOffset int64
+	readCache        *rangeCache
+	content          []byte      // Whole content when served by the Fs content cache
+	ifMatch          azblob.ETag // Version the reads are pinned to, if any
+	snapshot         string      // Snapshot the reads are made from, if any
+
+	// State of the decompressed stream if we are reading a gzip encoded file
+	decompress bool
+	gzipBody   io.ReadCloser
+	gzipReader io.Reader
 
 	// State of the stream if we are writing the file
 	streamWrite    bool
+	create         bool // Commit even when no block was staged, or create a missing append blob
 	base64BlockIDs []string
+	blockSizes     []int64 // Size of each staged block
+	bytesStaged    int64
+
+	// State of the buffer if we are writing the file with FileOptions.BufferWrites,
+	// spill holds it instead of writeBuffer once it grew over FsOptions.SpillThreshold
+	writeBuffer []byte
+	writeOffset int64
+	spill       *os.File
+	spillSize   int64
 
+	// Size of the page blob if we are writing one with FileOptions.BlobType, the
+	// pages are written at writeOffset
+	pageSize int64
+
+	// Set once Close or Abort ran, the I/O methods then fail with afero.ErrFileClosed
+	closed bool
+
+	// State of a non-cached listing across Readdir calls, listingDone is set once the
+	// last segment was returned so that the next call reports io.EOF
 	azureMarker azblob.Marker
+	listingDone bool
 	cacheMarker string
+	// Last name returned by Readdirnames in the listing, for the next page not to repeat it
+	lastEntryName string
 }
 
 // NewFile initializes an File object.
 func NewFile(fs *Fs, name string) *File {
-	name = trimLeadingSlash(name)
 	return &File{
-		fs:   fs,
-		name: name,
+		fs:       fs,
+		name:     trimLeadingSlash(name),
+		openName: name,
+	}
+}
+
+// openRead sets up the read stream of a file described by info
+func (f *File) openRead(info os.FileInfo) {
+	f.streamRead = true
+	if f.fs.options.DecompressGzip {
+		if fi, ok := info.(*FileInfo); ok && fi.contentEncoding == "gzip" {
+			f.decompress = true
+		}
+	}
+	if f.fs.options.ReadCacheSize > 0 {
+		f.readCache = newRangeCache(f.fs.options.ReadCacheSize)
+	}
+}
+
+// inPlace reports whether the writes go straight to an append or page blob,
+// rather than being committed as a block blob
+func (f *File) inPlace() bool {
+	return f.options.BlobType == azblob.BlobAppendBlob || f.options.BlobType == azblob.BlobPageBlob
+}
+
+// openWrite creates or looks up the append or page blob a file is opened to write,
+// block blobs are only written when committed
+func (f *File) openWrite(flag int) error {
+	create := flag&(os.O_CREATE|os.O_TRUNC) != 0
+	replace := flag&os.O_TRUNC != 0
+	switch f.options.BlobType {
+	case azblob.BlobAppendBlob:
+		// writes create the blob again when it went missing only with O_CREATE
+		f.create = flag&os.O_CREATE != 0
+		if replace {
+			return f.fs.createAppendBlob(f.name, f.options.HTTPHeaders, f.options.Metadata, true)
+		}
+		fi, err := f.fs.getBlobFileInfo(f.name)
+		switch {
+		case err == nil:
+			return f.checkBlobType(fi)
+		case create && hasServiceCode(err, azblob.ServiceCodeBlobNotFound):
+			return f.fs.createAppendBlob(f.name, f.options.HTTPHeaders, f.options.Metadata, false)
+		case !hasServiceCode(err, azblob.ServiceCodeBlobNotFound):
+			return err
+		}
+	case azblob.BlobPageBlob:
+		f.create = false
+		fi, err := f.fs.getBlobFileInfo(f.name)
+		switch {
+		case err == nil && !replace:
+			if err := f.checkBlobType(fi); err != nil {
+				return err
+			}
+			f.pageSize = fi.Size()
+		case err == nil || (create && hasServiceCode(err, azblob.ServiceCodeBlobNotFound)):
+			return f.fs.createPageBlob(f.name, 0, 0, f.options.HTTPHeaders, f.options.Metadata)
+		default:
+			return err
+		}
 	}
+	return nil
 }
 
-// Name returns the filename, i.e. Azure blob path without the container name.
+// checkBlobType returns ErrBlobTypeMismatch when the existing blob described by fi
+// isn't of the type the file is opened to write
+func (f *File) checkBlobType(fi *FileInfo) error {
+	if fi.blobType == f.options.BlobType {
+		return nil
+	}
+	err := &os.PathError{Op: "open", Path: f.name, Err: ErrBlobTypeMismatch}
+	LogError(err)
+	return err
+}
+
+// checkClosed returns afero.ErrFileClosed once the file was closed
+func (f *File) checkClosed() error {
+	if f.closed {
+		LogError(afero.ErrFileClosed)
+		return afero.ErrFileClosed
+	}
+	return nil
+}
+
+// Name returns the name of the file as given to Open, Create or OpenFile, like
+// os.File.Name, with or without a leading "/". The entries listed by Readdir are
+// named relative to the file (FileInfo.Name) and by their path (FileInfo.FullName).
 func (f *File) Name() string {
-	return f.name
+	return f.openName
 }
 
 func (f *File) path() string {
@@ -81,12 +204,7 @@ func (f *File) path() string {
 
 func getFilterRegExp(filter string) (rexp *regexp.Regexp, err error) {
 	if filter != "" {
-		pattern := strings.ReplaceAll(filter, ".", "\\.")
-		pattern = strings.ReplaceAll(pattern, "?", ".")
-		pattern = strings.ReplaceAll(pattern, "*", ".*")
-		pattern = "^" + pattern + "$"
-
-		rexp, err = regexp.Compile(pattern)
+		rexp, err = regexp.Compile("^" + globToRegExp(filter) + "$")
 		if err != nil {
 			return nil, err
 		}
@@ -94,18 +212,68 @@ func getFilterRegExp(filter string) (rexp *regexp.Regexp, err error) {
 	return rexp, nil
 }
 
+// globToRegExp translates a wildcard filter into a regular expression: ? matches any
+// character, * any run of characters and [...] (or [!...]) a character class, the
+// rest is matched literally
+func globToRegExp(filter string) string {
+	var b strings.Builder
+	for i := 0; i < len(filter); i++ {
+		switch c := filter[i]; c {
+		case '?':
+			b.WriteString(".")
+		case '*':
+			b.WriteString(".*")
+		case '[':
+			end := strings.IndexByte(filter[i+1:], ']')
+			if end <= 0 {
+				b.WriteString(regexp.QuoteMeta(filter[i : i+1]))
+				break
+			}
+			class := filter[i+1 : i+1+end]
+			b.WriteString("[")
+			if class[0] == '!' {
+				b.WriteString("^")
+				class = class[1:]
+			}
+			b.WriteString(strings.NewReplacer(`\`, `\\`, "[", `\[`).Replace(class))
+			b.WriteString("]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(filter[i : i+1]))
+		}
+	}
+	return b.String()
+}
+
 func (f *File) setPrefixFilter() (prefix, filter string) {
 	if strings.ContainsAny(f.name, "?*") {
 		filter = f.name
+	} else if delimiter := f.fs.delimiter(); delimiter != "/" {
+		// the File is opened on the directory itself, e.g. "dir:" or "dir"
+		prefix = trimLeadingSlash(f.name)
+		if prefix == "/" {
+			prefix = ""
+		} else if !strings.HasSuffix(prefix, delimiter) {
+			prefix += delimiter
+		}
 	} else {
-		path := f.path()
-		prefix := trimLeadingSlash(path)
+		prefix = trimLeadingSlash(f.path())
 		if prefix == "/" {
 			prefix = ""
+		} else {
+			prefix += "/"
 		}
 	}
 	return
 }
+
+// sortFileInfos orders the entries by name, which is also the order Azure lists blobs in
+func sortFileInfos(fileInfos []os.FileInfo) {
+	sort.SliceStable(fileInfos, func(i, j int) bool {
+		return fullName(fileInfos[i]) < fullName(fileInfos[j])
+	})
+}
+
 func (f *File) readDirCache(n int) (fileInfos []os.FileInfo, err error) {
 	if !f.fs.cached {
 		return
@@ -119,15 +287,28 @@ func (f *File) readDirCache(n int) (fileInfos []os.FileInfo, err error) {
 		return nil, err
 	}
 
+	if rootPrefix := f.fs.options.RootPrefix; rootPrefix != "" {
+		prefix = rootPrefix + prefix
+		if filter != "" {
+			filter = rootPrefix + filter
+		}
+	}
+
 	fileInfos, err = cache.ReadCache(prefix, filter, "", n)
 	if err != nil {
 		LogError(err)
 		return nil, err
 	}
 
+	for i, fi := range fileInfos {
+		fileInfos[i] = f.fs.newFileInfo(f.fs.relativeName(fullName(fi)), fi.IsDir(), fi.Size(), fi.ModTime())
+	}
+
+	sortFileInfos(fileInfos)
+
 	if n > 0 {
 		if len(fileInfos) == n {
-			f.cacheMarker = fileInfos[len(fileInfos)-1].Name()
+			f.cacheMarker = fullName(fileInfos[len(fileInfos)-1])
 		} else {
 			f.cacheMarker = ""
 		}
@@ -143,6 +324,8 @@ func (f *File) readDirNoCache(n int) (fileInfos []os.FileInfo, err error) {
 		LogError(err)
 		return nil, err
 	}
+
+	sortFileInfos(fileInfos)
 	return
 }
 
@@ -160,9 +343,38 @@ func (f *File) readDirNoCache(n int) (fileInfos []os.FileInfo, err error) {
 // nil error. If it encounters an error before the end of the
 // directory, Readdir returns the FileInfo read until that point
 // and a non-nil error.
-func (f *File) Readdir(n int) (fileInfos []os.FileInfo, err error) {
+//
+// Entries are always returned sorted by name, and successive calls
+// continue in that same order. Calling it on a File opened on a blob fails
+// with syscall.ENOTDIR. Listing an empty directory of a non-cached container
+// returns an empty slice, with io.EOF when n > 0, the errors of the listing
+// are always returned.
+func (f *File) Readdir(n int) ([]os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkDir(); err != nil {
+		return nil, err
+	}
+
+	return f.readdir(n)
+}
+
+// checkDir returns a *os.PathError wrapping syscall.ENOTDIR when the File was
+// opened on a blob, for reading or writing, rather than a directory or wildcard
+func (f *File) checkDir() error {
+	if !f.streamRead && !f.streamWrite {
+		return nil
+	}
+
+	err := &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	LogError(err)
+	return err
+}
+
+func (f *File) readdir(n int) (fileInfos []os.FileInfo, err error) {
 	if n <= 0 {
-		return f.ReaddirAll()
+		return f.readdirAll()
 	}
 
 	if f.fs.cached {
@@ -176,30 +388,64 @@ func (f *File) Readdir(n int) (fileInfos []os.FileInfo, err error) {
 			return fileInfos, nil
 		}
 	} else {
-		fileInfos, err = f.readDirNoCache(n)
-		if err != nil {
-			f.azureMarker = azblob.Marker{}
-			return
+		// the last entries are returned without io.EOF, the call after them returns it
+		// with an empty slice and the next one starts a new listing
+		if f.listingDone {
+			f.listingDone = false
+			return []os.FileInfo{}, io.EOF
 		}
 
-		if f.azureMarker.NotDone() {
-			return fileInfos, nil
+		// segments emptied by the filter are skipped, an empty slice only comes with an error
+		for len(fileInfos) == 0 && !f.listingDone {
+			fileInfos, err = f.readDirNoCache(n)
+			if err != nil {
+				f.azureMarker = azblob.Marker{}
+				return nil, err
+			}
+
+			if !f.azureMarker.NotDone() {
+				f.azureMarker = azblob.Marker{}
+				f.listingDone = true
+			}
 		}
 
-		f.azureMarker = azblob.Marker{}
+		if len(fileInfos) > 0 {
+			return fileInfos, nil
+		}
+		// nothing matched at all
+		f.listingDone = false
+		return []os.FileInfo{}, io.EOF
 	}
 
 	err = io.EOF
 	return
 }
 
-// ReaddirAll provides list of file cachedInfo.
-func (f *File) ReaddirAll() (fileInfos []os.FileInfo, err error) {
+// ReaddirAll provides list of file cachedInfo sorted by name.
+func (f *File) ReaddirAll() ([]os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkDir(); err != nil {
+		return nil, err
+	}
+
+	return f.readdirAll()
+}
+
+func (f *File) readdirAll() (fileInfos []os.FileInfo, err error) {
 	if f.fs.cached {
 		fileInfos, err = f.readDirCache(-1)
 	} else {
+		pageSize := 5000
+		if f.fs.options.ListPageSize > 0 {
+			pageSize = int(f.fs.options.ListPageSize)
+		}
+		// always list from the start, whatever earlier Readdir calls left
+		f.azureMarker = azblob.Marker{}
+		f.listingDone = false
 		for {
-			infos, err := f.Readdir(5000)
+			infos, err := f.readdir(pageSize)
 			fileInfos = append(fileInfos, infos...)
 			if err != nil {
 				if err == io.EOF {
@@ -210,10 +456,116 @@ func (f *File) ReaddirAll() (fileInfos []os.FileInfo, err error) {
 				}
 			}
 		}
+		sortFileInfos(fileInfos)
+		if fileInfos == nil {
+			fileInfos = []os.FileInfo{}
+		}
 	}
 	return
 }
 
+// ReaddirStream lists the same entries as ReaddirAll but streams them over the
+// returned channel as each listing segment arrives. Each of the given partitions
+// is appended to the directory prefix and listed concurrently, so together they
+// must cover the key space being listed (e.g. "0".."9", "a".."z"); no partitions
+// lists everything sequentially. Entries are not sorted across partitions, and
+// partitions are ignored for cached containers.
+//
+// Both channels are closed once the listing finishes, and at most one error is
+// sent. Cancelling ctx stops the listing and reports the cancellation.
+func (f *File) ReaddirStream(ctx context.Context, partitions []string) (<-chan os.FileInfo, <-chan error) {
+	fileInfos := make(chan os.FileInfo)
+	errs := make(chan error, 1)
+
+	f.mu.Lock()
+	err := f.checkDir()
+	f.mu.Unlock()
+	if err != nil {
+		close(fileInfos)
+		errs <- err
+		close(errs)
+		return fileInfos, errs
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	send := func(fi os.FileInfo) error {
+		select {
+		case fileInfos <- fi:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	fail := func(err error) {
+		select {
+		case errs <- err:
+			LogError(err)
+		default:
+		}
+		cancel()
+	}
+
+	prefix, filter := f.setPrefixFilter()
+	rexp, err := getFilterRegExp(filter)
+	if err != nil {
+		fail(err)
+		close(fileInfos)
+		close(errs)
+		return fileInfos, errs
+	}
+
+	if len(partitions) == 0 {
+		partitions = []string{""}
+	}
+
+	var wg sync.WaitGroup
+	if f.fs.cached {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			infos, err := f.readDirCache(-1)
+			if err != nil {
+				fail(err)
+				return
+			}
+			for _, fi := range infos {
+				if err := send(fi); err != nil {
+					fail(err)
+					return
+				}
+			}
+		}()
+	} else {
+		for _, partition := range partitions {
+			wg.Add(1)
+			go func(partition string) {
+				defer wg.Done()
+				// each partition takes a concurrency slot for its listing requests, given
+				// back while an entry waits for the receiver, which may need one too
+				f.fs.limiter.acquire(1)
+				err := f.fs.listBlobs(ctx, prefix+partition, rexp, func(fi os.FileInfo) error {
+					f.fs.limiter.release(1)
+					defer f.fs.limiter.acquire(1)
+					return send(fi)
+				})
+				f.fs.limiter.release(1)
+				if err != nil {
+					fail(err)
+				}
+			}(partition)
+		}
+	}
+
+	go func() {
+		wg.Wait()
+		cancel()
+		close(fileInfos)
+		close(errs)
+	}()
+
+	return fileInfos, errs
+}
+
 // Readdirnames reads and returns a slice of names from the directory f.
 //
 // If n > 0, Readdirnames returns at most n names. In this case, if
@@ -226,25 +578,86 @@ func (f *File) ReaddirAll() (fileInfos []os.FileInfo, err error) {
 // nil error. If it encounters an error before the end of the
 // directory, Readdirnames returns the names read until that point and
 // a non-nil error.
+//
+// Names are relative to the listed directory, blobs nested deeper are returned once
+// as the name of the sub directory holding them, whether the container is cached or not.
+// Wildcard listings return the base name of each matching blob.
 func (f *File) Readdirnames(n int) ([]string, error) {
-	fi, err := f.Readdir(n)
-	if err != nil {
-		LogError(err)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkDir(); err != nil {
 		return nil, err
 	}
-	names := make([]string, len(fi))
-	for i, f := range fi {
-		_, names[i] = filepath.Split(f.Name())
+
+	prefix, filter := f.setPrefixFilter()
+	if n <= 0 {
+		f.lastEntryName = ""
+	}
+	for {
+		fi, err := f.readdir(n)
+		if err != nil && err != io.EOF {
+			LogError(err)
+			return nil, err
+		}
+
+		if filter != "" {
+			names := make([]string, len(fi))
+			for i, f := range fi {
+				names[i] = f.Name()
+			}
+			return names, err
+		}
+
+		// the sub directory ending a page can start the next one, the pages having
+		// the order of the names
+		names := entryNames(fi, prefix, f.fs.delimiter(), f.lastEntryName)
+		if len(names) > 0 {
+			f.lastEntryName = names[len(names)-1]
+		}
+		if err == io.EOF {
+			f.lastEntryName = ""
+		}
+		// a page holding only names already returned is skipped, an empty slice only
+		// comes with an error
+		if len(names) > 0 || err != nil || n <= 0 {
+			return names, err
+		}
 	}
-	return names, nil
+}
+
+// entryNames returns the names of the entries relative to prefix up to the delimiter, the
+// entries being sorted the sub directories are deduplicated by comparing with the previous
+// name, starting with previous
+func entryNames(fileInfos []os.FileInfo, prefix, delimiter, previous string) []string {
+	names := make([]string, 0, len(fileInfos))
+	for _, fi := range fileInfos {
+		name := strings.TrimPrefix(fullName(fi), prefix)
+		if i := strings.Index(name, delimiter); i >= 0 {
+			name = name[:i]
+		}
+		if name == previous && (len(names) > 0 || previous != "") {
+			continue
+		}
+		names = append(names, name)
+		previous = name
+	}
+	return names
 }
 
 // Stat returns the FileInfo structure describing file.
 // If there is an error, it will be of type *PathError.
 func (f *File) Stat() (os.FileInfo, error) {
-	info, err := f.fs.Stat(f.Name())
+	// a snapshot doesn't change
+	if f.snapshot != "" {
+		return f.cachedInfo, nil
+	}
+
+	info, err := f.fs.Stat(f.name)
 	if err == nil {
+		f.mu.Lock()
 		f.cachedInfo = info
+		f.mu.Unlock()
 	} else {
 		LogError(err)
 	}
@@ -252,19 +665,268 @@ func (f *File) Stat() (os.FileInfo, error) {
 	return info, err
 }
 
-// Sync is a noop.
+// Sync commits the blocks written so far so that they are durable in the blob,
+// while keeping the file open for more writes. Each Sync creates an intermediate
+// committed state of the blob which is visible to readers until the next Sync
+// or Close commits the full content. It is a noop for files open for reading.
 func (f *File) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkClosed(); err != nil {
+		return err
+	}
+
+	if !f.streamWrite || f.inPlace() || (!f.options.BufferWrites && len(f.base64BlockIDs) == 0) {
+		return nil
+	}
+
+	return f.commit()
+}
+
+// Validate checks what was written to a file open for writing a block blob against
+// the limits of block blobs, so that callers assembling very large files can fail
+// before Close, which checks them too, rather than with the error of the commit.
+// The error is a *BlobLimitError matching ErrTooManyBlocks when more than
+// azblob.BlockBlobMaxBlocks blocks were staged, or ErrBlobTooLarge when more was
+// written than that many blocks of azblob.BlockBlobMaxStageBlockBytes hold.
+func (f *File) Validate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkClosed(); err != nil {
+		return err
+	}
+	return f.validate()
+}
+
+func (f *File) validate() error {
+	if !f.streamWrite || f.inPlace() {
+		return nil
+	}
+
+	var err error
+	size := f.bytesStaged
+	if f.options.BufferWrites {
+		size = f.bufferSize()
+	} else if blocks := int64(len(f.base64BlockIDs)); blocks > azblob.BlockBlobMaxBlocks {
+		err = &BlobLimitError{Name: f.name, Actual: blocks, Allowed: azblob.BlockBlobMaxBlocks, limit: ErrTooManyBlocks}
+	}
+	if maxSize := int64(azblob.BlockBlobMaxBlocks) * azblob.BlockBlobMaxStageBlockBytes; err == nil && size > maxSize {
+		err = &BlobLimitError{Name: f.name, Actual: size, Allowed: maxSize, limit: ErrBlobTooLarge}
+	}
+	if err != nil {
+		LogError(err)
+	}
+	return err
+}
+
+// commit commits every block staged since the file was opened, or uploads the
+// whole buffer when writes are buffered
+func (f *File) commit() error {
+	if err := f.validate(); err != nil {
+		return &os.PathError{Op: "commit", Path: f.name, Err: err}
+	}
+
+	var err error
+	if f.spill != nil {
+		ctx, cancel := f.fs.commitContext()
+		defer cancel()
+		err = f.fs.blobUploadFromFile(ctx, f.name, f.spill, f.options.HTTPHeaders, f.options.Metadata)
+	} else if f.options.BufferWrites {
+		err = f.fs.blobUploadBuffer(f.name, f.writeBuffer, f.options.HTTPHeaders, f.options.Metadata)
+	} else {
+		_, err = f.fs.blobCommitBlockList(f.name, &f.base64BlockIDs, f.options.HTTPHeaders, f.options.Metadata)
+	}
+	if err != nil {
+		err = &os.PathError{Op: "commit", Path: f.name, Err: err}
+		LogError(err)
+		return err
+	}
+
+	if err := f.fs.setCommittedTier(f.name, f.options.AccessTier); err != nil {
+		return &os.PathError{Op: "tier", Path: f.name, Err: err}
+	}
 	return nil
 }
 
+// Abort closes a file open for writing without committing what was written, the
+// blob is left as it was. The blocks staged on Azure are only dropped with
+// FileOptions.ClearStagedOnAbort, when the blob already exists.
+// Like after Close, the I/O methods then return afero.ErrFileClosed.
+func (f *File) Abort() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkClosed(); err != nil {
+		return err
+	}
+
+	f.closeReadStream()
+	staged := f.streamWrite && len(f.base64BlockIDs) > 0
+	f.base64BlockIDs = nil
+	f.blockSizes = nil
+	f.bytesStaged = 0
+	f.writeBuffer = nil
+	f.removeSpill()
+	f.streamWrite = false
+	f.closed = true
+
+	if f.options.ClearStagedOnAbort && staged {
+		return f.fs.clearStagedBlocks(f.name)
+	}
+	return nil
+}
+
+// closeReadStream drops the reading stream of the file, if any
+func (f *File) closeReadStream() {
+	if !f.streamRead {
+		return
+	}
+	if f.gzipBody != nil {
+		f.gzipBody.Close()
+		f.gzipBody = nil
+		f.gzipReader = nil
+	}
+	f.streamRead = false
+}
+
 // Truncate changes the size of the file.
 // It does not change the I/O offset.
-// If there is an error, it will be of type *PathError.
-func (f *File) Truncate(int64) error {
+// If there is an error, it will be of type *PathError, matching os.ErrPermission
+// when the file isn't open for writing.
+//
+// What is written but not yet committed is truncated: the buffer of BufferWrites is
+// cut or grown with zeros, and the blocks staged by Write are dropped down to size,
+// which must fall between two Write calls, they can't be read back to be cut.
+// The blob itself is truncated when the file was opened without O_CREATE and nothing
+// was written yet, or is a page blob. Page blobs are resized in place, size must be
+// a multiple of 512, and stay sparse: growing one adds pages that read as zeros and
+// aren't billed until written. Block blobs can only be shrunk, by committing again
+// the blocks they keep with their content type and other HTTP headers, metadata and
+// tier: growing one would upload real zeros and isn't implemented. Neither are
+// append blobs.
+func (f *File) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkClosed(); err != nil {
+		return err
+	}
+	if !f.streamWrite {
+		err := &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrPermission}
+		LogError(err)
+		return err
+	}
+	if err := f.fs.checkWritable("truncate", f.name); err != nil {
+		return err
+	}
+
+	var err error
+	switch {
+	case f.options.BlobType == azblob.BlobAppendBlob:
+		err = ErrNotImplemented
+		LogError(err)
+	case f.options.BufferWrites:
+		err = f.truncateBuffer(size)
+	case f.create || len(f.base64BlockIDs) > 0:
+		err = f.truncateStaged(size)
+	default:
+		err = f.truncateBlob(size)
+	}
+	if err != nil {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: err}
+	}
+
+	f.setCachedSize(size)
+	return nil
+}
+
+// truncateBuffer cuts the buffer of buffered writes to size, or grows it with zeros
+func (f *File) truncateBuffer(size int64) error {
+	if threshold := f.fs.options.SpillThreshold; f.spill == nil && threshold > 0 && size > threshold {
+		if err := f.spillBuffer(); err != nil {
+			return err
+		}
+	}
+	if f.spill != nil {
+		if err := f.spill.Truncate(size); err != nil {
+			LogError(err)
+			return err
+		}
+		f.spillSize = size
+		return nil
+	}
+
+	if size > int64(len(f.writeBuffer)) {
+		f.writeBuffer = append(f.writeBuffer, make([]byte, size-int64(len(f.writeBuffer)))...)
+	}
+	f.writeBuffer = f.writeBuffer[:size]
+	return nil
+}
+
+// truncateStaged drops the blocks staged past size, which must be the end of one of them
+func (f *File) truncateStaged(size int64) error {
+	if size > f.bytesStaged {
+		LogError(ErrNotImplemented)
+		return ErrNotImplemented
+	}
+
+	var (
+		kept   int64
+		blocks int
+	)
+	for blocks < len(f.blockSizes) && kept < size {
+		kept += f.blockSizes[blocks]
+		blocks++
+	}
+	if kept != size {
+		err := notSupported("Truncate within a staged block")
+		LogError(err)
+		return err
+	}
+
+	f.base64BlockIDs = f.base64BlockIDs[:blocks]
+	f.blockSizes = f.blockSizes[:blocks]
+	f.bytesStaged = size
+	return nil
+}
+
+// truncateBlob truncates the committed blob, a block blob or a page blob
+func (f *File) truncateBlob(size int64) error {
+	fi, err := f.fs.getBlobFileInfo(f.name)
+	if err != nil {
+		return err
+	}
+	switch fi.blobType {
+	case azblob.BlobBlockBlob:
+		return f.fs.truncateBlockBlob(f.name, size)
+	case azblob.BlobPageBlob:
+		if err := f.fs.resizePageBlob(f.name, size); err != nil {
+			return err
+		}
+		if f.options.BlobType == azblob.BlobPageBlob {
+			f.pageSize = size
+		}
+		return nil
+	}
 	LogError(ErrNotImplemented)
 	return ErrNotImplemented
 }
 
+// setCachedSize sets size in the info cached by Stat, if any
+func (f *File) setCachedSize(size int64) {
+	switch fi := f.cachedInfo.(type) {
+	case FileInfo:
+		fi.sizeInBytes = size
+		f.cachedInfo = fi
+	case *FileInfo:
+		resized := *fi
+		resized.sizeInBytes = size
+		f.cachedInfo = &resized
+	}
+}
+
 // WriteString is like Write, but writes the contents of string s rather than
 // a slice of bytes.
 func (f *File) WriteString(s string) (int, error) {
@@ -273,27 +935,38 @@ func (f *File) WriteString(s string) (int, error) {
 
 // Close closes the File, rendering it unusable for I/O.
 // It returns an error, if any.
+//
+// When a written file's blocks can't be committed the error is an *os.PathError
+// with Op "commit", meaning the data was not persisted. The staged blocks are
+// kept and the file stays open so that calling Close again retries the commit.
+// When only the access tier couldn't be set afterwards the Op is "tier", the data
+// was persisted and calling Close again retries both. Closing it again once closed returns afero.ErrFileClosed.
 func (f *File) Close() error {
-	// Closing a reading stream
-	if f.streamRead {
-		defer func() {
-			f.streamRead = false
-		}()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkClosed(); err != nil {
+		return err
 	}
 
+	// Closing a reading stream
+	f.closeReadStream()
+
 	// Closing a writing stream
 	if f.streamWrite {
-		defer func() {
-			f.streamWrite = false
-		}()
-		if len(f.base64BlockIDs) > 0 {
-			_, err := f.fs.blobCommitBlockList(f.name, &f.base64BlockIDs)
-			if err != nil {
-				LogError(err)
+		if !f.inPlace() && (f.options.BufferWrites || f.create || len(f.base64BlockIDs) > 0) {
+			if err := f.commit(); err != nil {
+				return err
 			}
-			return err
+			f.base64BlockIDs = nil
+			f.blockSizes = nil
+			f.bytesStaged = 0
+			f.writeBuffer = nil
+			f.removeSpill()
 		}
+		f.streamWrite = false
 	}
+	f.closed = true
 
 	return nil
 }
@@ -302,17 +975,34 @@ func (f *File) Close() error {
 // It returns the number of bytes read and an error, if any.
 // EOF is signaled by the read offset equaling the file size with err set to io.EOF.
 func (f *File) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkClosed(); err != nil {
+		return 0, err
+	}
+	// a zero length read has no side effects, as io.Reader asks
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	return f.read(p)
+}
+
+func (f *File) read(p []byte) (int, error) {
+	if f.decompress {
+		return f.readDecompressed(p)
+	}
+
 	bufSize := int64(len(p))
-	data, err := f.fs.blobRead(f.name, f.streamReadOffset, bufSize)
+	data, err := f.readRange(f.streamReadOffset, bufSize)
 	if err != nil {
 		LogError(err)
+		return 0, err
 	}
 
 	bytesCopied := copy(p, *data)
-
-	if err == nil {
-		f.streamReadOffset += int64(bytesCopied)
-	}
+	f.streamReadOffset += int64(bytesCopied)
 
 	// EOF
 	if f.streamReadOffset == f.cachedInfo.Size() && err == nil {
@@ -322,17 +1012,138 @@ func (f *File) Read(p []byte) (int, error) {
 	return bytesCopied, err
 }
 
+// readDecompressed reads the next decompressed bytes of a gzip encoded file,
+// the whole blob is downloaded as a single stream on the first call
+func (f *File) readDecompressed(p []byte) (int, error) {
+	if f.gzipReader == nil {
+		resp, err := f.fs.blobDownload(*f.fs.ctx, f.name, f.snapshot, 0, azblob.CountToEnd, f.readAccessConditions())
+		if err != nil {
+			return 0, err
+		}
+
+		body := resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: transferMaxRetries})
+		f.gzipBody = body
+		f.gzipReader = body
+
+		// the HTTP transport may have already decompressed the body
+		if !resp.Response().Uncompressed {
+			gzipReader, err := gzip.NewReader(body)
+			if err != nil {
+				body.Close()
+				f.gzipBody = nil
+				f.gzipReader = nil
+				LogError(err)
+				return 0, err
+			}
+			f.gzipReader = gzipReader
+		}
+	}
+
+	n, err := f.gzipReader.Read(p)
+	f.streamReadOffset += int64(n)
+	if err != nil && err != io.EOF {
+		LogError(err)
+	}
+
+	return n, err
+}
+
+// readAccessConditions pins the reads to the ETag the file was opened with, if any
+func (f *File) readAccessConditions() azblob.BlobAccessConditions {
+	var ac azblob.BlobAccessConditions
+	ac.IfMatch = f.ifMatch
+	return ac
+}
+
+// readRange reads up to count bytes at offset, going through the read cache when enabled
+func (f *File) readRange(offset, count int64) (*[]byte, error) {
+	if f.useContentCache() {
+		if f.content == nil {
+			content, err := f.fs.blobContent(f.name)
+			if err != nil {
+				return nil, err
+			}
+			f.content = content
+		}
+
+		if offset >= int64(len(f.content)) {
+			return nil, io.EOF
+		}
+		data := f.content[offset:]
+		if int64(len(data)) > count {
+			data = data[:count]
+		}
+		return &data, nil
+	}
+
+	if f.readCache == nil {
+		return f.fs.blobRead(f.name, f.snapshot, offset, count, f.readAccessConditions())
+	}
+
+	data := f.readCache.get(offset)
+	if data == nil {
+		blockSize := f.fs.options.ReadCacheBlockSize
+		if blockSize <= 0 {
+			blockSize = readCacheBlockSize
+		}
+
+		// download whole blocks covering the requested range
+		start := offset - offset%blockSize
+		end := offset + count
+		if rem := end % blockSize; rem != 0 {
+			end += blockSize - rem
+		}
+
+		block, err := f.fs.blobRead(f.name, f.snapshot, start, end-start, f.readAccessConditions())
+		if err != nil {
+			return nil, err
+		}
+		f.readCache.put(start, *block)
+
+		data = f.readCache.get(offset)
+		if data == nil {
+			return nil, io.EOF
+		}
+	}
+
+	if int64(len(data)) > count {
+		data = data[:count]
+	}
+	return &data, nil
+}
+
+// useContentCache reports whether the blob is small enough to be read through
+// the Fs content cache, Files pinned to a version or reading a snapshot always download
+func (f *File) useContentCache() bool {
+	return f.fs.content != nil && f.ifMatch == "" && f.snapshot == "" && f.cachedInfo != nil &&
+		f.cachedInfo.Size() <= f.fs.options.ContentCacheSize
+}
+
 // ReadAt reads len(p) bytes from the file starting at byte offset off.
 // It returns the number of bytes read and the error, if any.
 // ReadAt always returns a non-nil error when n < len(b).
 // At end of file, that error is io.EOF.
 func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
-	_, err = f.Seek(off, io.SeekStart)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	// the offsets of a decompressed stream aren't the offsets of the blob
+	if f.decompress {
+		err := notSupported("ReadAt on a decompressed gzip stream")
+		LogError(err)
+		return 0, err
+	}
+
+	_, err = f.seek(off, io.SeekStart)
 	if err != nil {
 		LogError(err)
 		return
 	}
-	n, err = f.Read(p)
+	n, err = f.read(p)
 	return
 }
 
@@ -342,10 +1153,37 @@ func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
 // It returns the new offset and an error, if any.
 // The behavior of Seek on a file opened with O_APPEND is not specified.
 func (f *File) Seek(offset int64, whence int) (int64, error) {
-	// Write seek is not supported
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	return f.seek(offset, whence)
+}
+
+func (f *File) seek(offset int64, whence int) (int64, error) {
+	// Write seek is only supported within the buffer of buffered writes
 	if f.streamWrite {
-		LogError(ErrNotSupported)
-		return 0, ErrNotSupported
+		if f.options.BlobType == azblob.BlobAppendBlob {
+			err := notSupported("Seek on an append blob")
+			LogError(err)
+			return 0, err
+		}
+		if !f.options.BufferWrites && f.options.BlobType != azblob.BlobPageBlob {
+			err := notSupported("Seek on a file open for writing without BufferWrites")
+			LogError(err)
+			return 0, err
+		}
+		return f.seekBuffer(offset, whence)
+	}
+
+	// Decompressed streams can only be read sequentially
+	if f.decompress {
+		err := notSupported("Seek on a decompressed gzip stream")
+		LogError(err)
+		return 0, err
 	}
 
 	// Read seek
@@ -374,31 +1212,212 @@ func (f *File) Seek(offset int64, whence int) (int64, error) {
 	return 0, afero.ErrFileClosed
 }
 
+// seekBuffer moves the offset of buffered writes, seeking past the end is allowed
+// and the gap reads as zeros once written
+func (f *File) seekBuffer(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.writeOffset
+	case io.SeekEnd:
+		offset += f.bufferSize()
+	}
+
+	if offset < 0 {
+		LogError(ErrInvalidSeek)
+		return offset, ErrInvalidSeek
+	}
+
+	f.writeOffset = offset
+	return offset, nil
+}
+
 // Write writes len(b) bytes to the File.
 // It returns the number of bytes written and an error, if any.
 // Write returns a non-nil error when n != len(b).
 func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	return f.write(p)
+}
+
+func (f *File) write(p []byte) (int, error) {
+	switch f.options.BlobType {
+	case azblob.BlobAppendBlob:
+		return f.writeAppend(p)
+	case azblob.BlobPageBlob:
+		return f.writePages(p)
+	}
+
+	if f.options.BufferWrites {
+		end := f.writeOffset + int64(len(p))
+		if threshold := f.fs.options.SpillThreshold; f.spill == nil && threshold > 0 && end > threshold {
+			if err := f.spillBuffer(); err != nil {
+				return 0, err
+			}
+		}
+		if f.spill != nil {
+			n, err := f.spill.WriteAt(p, f.writeOffset)
+			if end = f.writeOffset + int64(n); end > f.spillSize {
+				f.spillSize = end
+			}
+			f.writeOffset = end
+			if err != nil {
+				LogError(err)
+			}
+			return n, err
+		}
+		if end > int64(len(f.writeBuffer)) {
+			f.writeBuffer = append(f.writeBuffer, make([]byte, end-int64(len(f.writeBuffer)))...)
+		}
+		copy(f.writeBuffer[f.writeOffset:], p)
+		f.writeOffset = end
+		return len(p), nil
+	}
+
 	base64BlockID := newBase64BlockID()
-	f.base64BlockIDs = append(f.base64BlockIDs, base64BlockID)
 
+	// nothing was written when the block couldn't be staged, and it must not be committed
 	_, err := f.fs.blobStageBlock(f.name, base64BlockID, &p)
 	if err != nil {
 		LogError(err)
+		return 0, err
 	}
-	n := len(p)
+	f.base64BlockIDs = append(f.base64BlockIDs, base64BlockID)
+	f.blockSizes = append(f.blockSizes, int64(len(p)))
+	f.bytesStaged += int64(len(p))
 
-	return n, err
+	return len(p), nil
+}
+
+// writeAppend appends p to the append blob, in blocks as big as Azure takes. The
+// blob isn't created when it doesn't exist unless the file was opened with O_CREATE,
+// it is then created with the HTTP headers and metadata of the file.
+func (f *File) writeAppend(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		end := n + azblob.AppendBlobMaxAppendBlockBytes
+		if end > len(p) {
+			end = len(p)
+		}
+		if _, err := f.fs.appendBlock(f.name, p[n:end], azblob.AppendPositionAccessConditions{}, f.create, f.options.HTTPHeaders, f.options.Metadata); err != nil {
+			if hasServiceCode(err, azblob.ServiceCodeBlobNotFound) {
+				err = &os.PathError{Op: "write", Path: f.name, Err: os.ErrNotExist}
+			}
+			return n, err
+		}
+		n = end
+	}
+	return n, nil
+}
+
+// writePages writes p at the offset of the file in the page blob, growing it first
+// when p goes past its end
+func (f *File) writePages(p []byte) (int, error) {
+	if end := f.writeOffset + int64(len(p)); end > f.pageSize {
+		if err := f.fs.resizePageBlob(f.name, end); err != nil {
+			return 0, err
+		}
+		f.pageSize = end
+	}
+
+	n := 0
+	for n < len(p) {
+		end := n + azblob.PageBlobMaxUploadPagesBytes
+		if end > len(p) {
+			end = len(p)
+		}
+		if _, err := f.fs.writePages(f.name, f.writeOffset, p[n:end], PageWriteOptions{}); err != nil {
+			return n, err
+		}
+		f.writeOffset += int64(end - n)
+		n = end
+	}
+	return n, nil
+}
+
+// bufferSize returns the size of the content written with FileOptions.BufferWrites
+func (f *File) bufferSize() int64 {
+	if f.options.BlobType == azblob.BlobPageBlob {
+		return f.pageSize
+	}
+	if f.spill != nil {
+		return f.spillSize
+	}
+	return int64(len(f.writeBuffer))
+}
+
+// spillBuffer moves the buffer of buffered writes to a temporary file in FsOptions.SpillDir
+func (f *File) spillBuffer() error {
+	spill, err := createTempFileRetry(clockOrReal(f.fs.options.Clock), f.fs.options.SpillDir, maxFileOpRetries)
+	if err != nil {
+		LogError(err)
+		return err
+	}
+	if _, err := spill.Write(f.writeBuffer); err != nil {
+		LogError(err)
+		spill.Close()
+		os.Remove(spill.Name())
+		return err
+	}
+
+	f.spill = spill
+	f.spillSize = int64(len(f.writeBuffer))
+	f.writeBuffer = nil
+	return nil
+}
+
+// removeSpill deletes the temporary file of spilled buffered writes, if any
+func (f *File) removeSpill() {
+	if f.spill == nil {
+		return
+	}
+	f.spill.Close()
+	if err := os.Remove(f.spill.Name()); err != nil {
+		LogError(err)
+	}
+	f.spill = nil
+	f.spillSize = 0
+}
+
+// BlocksStaged returns the number of blocks staged by the Write calls on a file
+// open for writing until Close commits them, each Write stages one. Files written
+// with FileOptions.BufferWrites stage nothing before Close.
+func (f *File) BlocksStaged() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.base64BlockIDs)
+}
+
+// BytesStaged returns the number of bytes in the blocks counted by BlocksStaged.
+func (f *File) BytesStaged() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.bytesStaged
 }
 
 // WriteAt writes len(p) bytes to the file starting at byte offset off.
 // It returns the number of bytes written and an error, if any.
 // WriteAt returns a non-nil error when n != len(p).
 func (f *File) WriteAt(p []byte, off int64) (n int, err error) {
-	_, err = f.Seek(off, 0)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	_, err = f.seek(off, 0)
 	if err != nil {
 		LogError(err)
 		return
 	}
-	n, err = f.Write(p)
+	n, err = f.write(p)
 	return
 }
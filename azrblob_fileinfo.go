@@ -2,15 +2,59 @@ package azrblob
 
 import (
 	"os"
+	"strings"
 	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
 )
 
-// FileInfo implements os.FileInfo for a file in Azure.
+// FileInfo implements os.FileInfo for a file in Azure. Name is the base name of
+// the file as for the os package, FullName its path in the container.
 type FileInfo struct {
 	name        string
+	delimiter   string // Separator of the levels of name, "" for "/"
 	directory   bool
 	sizeInBytes int64
 	modTime     time.Time
+
+	creationTime    time.Time
+	contentEncoding string
+	contentLanguage string
+	etag            azblob.ETag
+	blobType        azblob.BlobType
+
+	accessTier         azblob.AccessTierType
+	accessTierInferred bool
+	archiveStatus      azblob.ArchiveStatusType
+
+	leaseStatus   azblob.LeaseStatusType
+	leaseState    azblob.LeaseStateType
+	leaseDuration azblob.LeaseDurationType
+}
+
+// BlobSys is returned by FileInfo.Sys for blobs whose properties were read from Azure.
+type BlobSys struct {
+	// BlobType tells block, page and append blobs apart
+	BlobType azblob.BlobType
+	// ETag changes whenever the blob is written
+	ETag azblob.ETag
+	// CreationTime is when the blob was created, it isn't changed by overwriting it
+	CreationTime time.Time
+	// ContentEncoding and ContentLanguage are the HTTP headers the blob is served with
+	ContentEncoding string
+	ContentLanguage string
+	// AccessTier is the tier of the blob, a rehydrating blob stays in the Archive tier until it's done
+	AccessTier azblob.AccessTierType
+	// AccessTierInferred is set when the tier is the account default rather than set on the blob
+	AccessTierInferred bool
+	// ArchiveStatus is the tier an archived blob is being rehydrated to, "" when it isn't
+	ArchiveStatus azblob.ArchiveStatusType
+	// LeaseStatus is locked while the blob is leased, LeaseState tells whether the
+	// lease is available, leased, expired, breaking or broken, and LeaseDuration
+	// whether a lease held is infinite or fixed ("" when it isn't leased)
+	LeaseStatus   azblob.LeaseStatusType
+	LeaseState    azblob.LeaseStateType
+	LeaseDuration azblob.LeaseDurationType
 }
 
 // NewFileInfo creates file cachedInfo.
@@ -23,23 +67,48 @@ func NewFileInfo(name string, directory bool, sizeInBytes int64, modTime time.Ti
 	}
 }
 
-// Name provides the base name of the file.
+// Name provides the base name of the file, the part of its path after the last
+// delimiter of the Fs ("/" unless FsOptions.Delimiter is set).
 func (fi FileInfo) Name() string {
+	delimiter := fi.delimiter
+	if delimiter == "" {
+		delimiter = "/"
+	}
+	name := fi.name
+	if fi.directory {
+		name = strings.TrimSuffix(name, "/")
+	}
+	name = strings.TrimSuffix(name, delimiter)
+	return name[strings.LastIndex(name, delimiter)+len(delimiter):]
+}
+
+// FullName provides the path of the file in the container, without a leading "/".
+func (fi FileInfo) FullName() string {
 	return fi.name
 }
 
-// Size provides the length in bytes for a file.
+// fullName returns the FullName of the FileInfos of this package, and the Name of the others
+func fullName(fi os.FileInfo) string {
+	if named, ok := fi.(interface{ FullName() string }); ok {
+		return named.FullName()
+	}
+	return fi.Name()
+}
+
+// Size provides the length in bytes for a file. It is 0 for directories, the
+// container root included: Azure keeps no size for them and adding up the blobs
+// under one would take a listing, so their size isn't meaningful (check IsDir).
 func (fi FileInfo) Size() int64 {
 	return fi.sizeInBytes
 }
 
 // Mode provides the file mode bits. For a file in Azure this defaults to
-// 664 for files, 775 for directories.
+// 664 for files, 755 with os.ModeDir for directories.
 // In the future this may return differently depending on the permissions
 // available on the container.
 func (fi FileInfo) Mode() os.FileMode {
 	if fi.directory {
-		return 0755
+		return os.ModeDir | 0755
 	}
 	return 0664
 }
@@ -49,12 +118,94 @@ func (fi FileInfo) ModTime() time.Time {
 	return fi.modTime
 }
 
+// CreationTime provides the time the blob was created, the zero time when it isn't
+// known (e.g. entries of cached containers), ModTime stays the last modification time
+func (fi FileInfo) CreationTime() time.Time {
+	return fi.creationTime
+}
+
+// ETag provides the ETag of the blob, "" when it isn't known (e.g. entries of cached
+// containers). It changes whenever the blob is written, see Fs.RemoveIf.
+func (fi FileInfo) ETag() azblob.ETag {
+	return fi.etag
+}
+
+// ContentEncoding provides the Content-Encoding the blob is served with (e.g. "gzip")
+func (fi FileInfo) ContentEncoding() string {
+	return fi.contentEncoding
+}
+
+// ContentLanguage provides the Content-Language the blob is served with (e.g. "fr-CA")
+func (fi FileInfo) ContentLanguage() string {
+	return fi.contentLanguage
+}
+
+// AccessTier provides the tier of the blob, "" when it isn't known (e.g. entries of cached containers)
+func (fi FileInfo) AccessTier() azblob.AccessTierType {
+	return fi.accessTier
+}
+
+// AccessTierInferred reports whether the tier is the account default rather than set on the blob
+func (fi FileInfo) AccessTierInferred() bool {
+	return fi.accessTierInferred
+}
+
+// ArchiveStatus provides the rehydration status of an archived blob, "" when it isn't rehydrating
+func (fi FileInfo) ArchiveStatus() azblob.ArchiveStatusType {
+	return fi.archiveStatus
+}
+
+// Rehydrating reports whether the blob is being rehydrated out of the Archive tier
+func (fi FileInfo) Rehydrating() bool {
+	return fi.archiveStatus == azblob.ArchiveStatusRehydratePendingToHot ||
+		fi.archiveStatus == azblob.ArchiveStatusRehydratePendingToCool
+}
+
+// LeaseStatus provides whether the blob is locked by a lease, "" when it isn't known
+// (e.g. entries of cached containers)
+func (fi FileInfo) LeaseStatus() azblob.LeaseStatusType {
+	return fi.leaseStatus
+}
+
+// LeaseState provides the state of the lease of the blob, "" when it isn't known
+func (fi FileInfo) LeaseState() azblob.LeaseStateType {
+	return fi.leaseState
+}
+
+// LeaseDuration provides whether the lease held on the blob is infinite or fixed, ""
+// when it isn't leased
+func (fi FileInfo) LeaseDuration() azblob.LeaseDurationType {
+	return fi.leaseDuration
+}
+
+// Leased reports whether a lease is held on the blob, its writes and deletes then
+// fail without the lease ID
+func (fi FileInfo) Leased() bool {
+	return fi.leaseStatus == azblob.LeaseStatusLocked
+}
+
 // IsDir provides the abbreviation for Mode().IsDir()
 func (fi FileInfo) IsDir() bool {
 	return fi.directory
 }
 
-// Sys provides the underlying data source (can return nil)
+// Sys provides the underlying data source (can return nil), a *BlobSys for
+// blobs whose type is known
 func (fi FileInfo) Sys() interface{} {
-	return nil
+	if fi.blobType == "" {
+		return nil
+	}
+	return &BlobSys{
+		BlobType:           fi.blobType,
+		ETag:               fi.etag,
+		CreationTime:       fi.creationTime,
+		ContentEncoding:    fi.contentEncoding,
+		ContentLanguage:    fi.contentLanguage,
+		AccessTier:         fi.accessTier,
+		AccessTierInferred: fi.accessTierInferred,
+		ArchiveStatus:      fi.archiveStatus,
+		LeaseStatus:        fi.leaseStatus,
+		LeaseState:         fi.leaseState,
+		LeaseDuration:      fi.leaseDuration,
+	}
 }
@@ -4,11 +4,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/Azure/azure-pipeline-go/pipeline"
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	log "github.com/inconshreveable/log15"
 	"github.com/spf13/afero"
@@ -34,11 +42,111 @@ type Fs struct {
 	cached     bool
 	ctx        *context.Context
 	serviceURL *azblob.ServiceURL
+	options    FsOptions
+	content    *contentCache
+	negative   *negativeCache
+	limiter    *concurrencyLimiter
+	created    *containerCreation
 }
 
-// LogError logs any errors encountered
+// containerCreation - whether the container of an Fs is known to exist, shared by its copies
+type containerCreation struct {
+	mu   sync.Mutex
+	done bool
+}
+
+// FsOptions - optional settings for an Fs, the zero value gives the default behavior
+type FsOptions struct {
+	// BlockSize is the block size in bytes used by UploadFromFile, OpenWriter and Truncate
+	// (0 uses the azblob default, and 4MB for OpenWriter and Truncate)
+	BlockSize int64
+	// Parallelism is the number of blocks UploadFromFile, DownloadToFile and OpenWriter transfer at once
+	Parallelism uint16
+	// MaxConcurrency caps the requests in flight at once across the bulk and parallel
+	// operations of the Fs and its copies (transfers, staged writes, RemoveAll, MoveDir,
+	// SetTierBatch, ReaddirStream partitions), to stay under the account's limits (0 for no cap).
+	// A transfer runs with the part of its Parallelism it's granted.
+	MaxConcurrency int
+	// ReadCacheSize is the number of recently downloaded ranges each read File
+	// keeps so that repeated Seek+Read pairs within them don't download again (0 disables it)
+	ReadCacheSize int
+	// ReadCacheBlockSize is the size in bytes of the ranges downloaded when the
+	// read cache is enabled (0 uses 1MB)
+	ReadCacheBlockSize int64
+	// DecompressGzip makes Read return the decompressed bytes of blobs stored with
+	// "Content-Encoding: gzip". Such files are read sequentially and can't Seek or
+	// ReadAt, and their FileInfo still reports the stored (compressed) size.
+	DecompressGzip bool
+	// ReadOnly makes every operation writing to the container fail with syscall.EROFS
+	ReadOnly bool
+	// ContentCacheSize is the number of bytes of blob content kept in memory by the
+	// Fs, keyed by ETag. Reading a blob no bigger than it downloads it only when it
+	// changed, otherwise the cached content is served (0 disables it).
+	ContentCacheSize int64
+	// NegativeCacheTTL is how long a Stat of a missing blob keeps failing without asking
+	// Azure or logging again, e.g. for walks probing names that don't exist. Writing the
+	// blob through the Fs ends it at once, writes by others are seen after it (0 disables it).
+	NegativeCacheTTL time.Duration
+	// SpillThreshold is the number of bytes a file written with FileOptions.BufferWrites
+	// keeps in memory, a bigger buffer is moved to a temporary file in SpillDir until
+	// the file is committed and closed (0 keeps it in memory whatever its size)
+	SpillThreshold int64
+	// SpillDir is the directory of the temporary files of SpillThreshold ("" uses os.TempDir)
+	SpillDir string
+	// RootPrefix is prepended to every blob name and stripped from listings, so the
+	// Fs only sees and touches the blobs under it (e.g. "tenant-id/")
+	RootPrefix string
+	// ListPageSize is the number of blobs asked per listing request by RemoveAll,
+	// ReaddirAll, ReaddirStream and ListEach (0 lets Azure pick, up to 5000)
+	ListPageSize int32
+	// CommitTimeout bounds the commit made when a written File or OpenWriter is closed,
+	// a commit still running after it fails with context.DeadlineExceeded (0 waits forever).
+	// With BufferWrites or a spill file the commit uploads the whole content, so it must
+	// leave time for it. The azblob retry policy gives each try whole seconds, so it
+	// should be over 1s.
+	CommitTimeout time.Duration
+	// ServerTimeout is sent as the timeout parameter of each listing segment, whole
+	// download and block list commit (Put Block List) request, the service gives up on
+	// the request after as long and the client stops waiting for it (0 lets the service
+	// apply its own limits). Uploads and streamed reads aren't bounded, and the context
+	// of the Fs still bounds the whole operation. Azure counts whole seconds, so it
+	// should be over 1s.
+	ServerTimeout time.Duration
+	// Delimiter separates the levels of the blob names for ListDirs and Readdirnames,
+	// and a name ending with it is opened as a directory ("" uses "/")
+	Delimiter string
+	// CreateContainerIfNotExists creates the container, with ContainerPublicAccess,
+	// before the first write of the Fs when it doesn't exist yet
+	CreateContainerIfNotExists bool
+	// ContainerPublicAccess is the public access level of a container created for
+	// CreateContainerIfNotExists ("" keeps its blobs private)
+	ContainerPublicAccess azblob.PublicAccessType
+	// VerifyCopies makes Rename and Copy compare the length and MD5 of the copy with
+	// the source before going on, a mismatch deletes the copy and fails with
+	// ErrCopyVerificationFailed. Blobs without a stored MD5 are downloaded and hashed.
+	VerifyCopies bool
+	// Clock times the polling of pending copies, WaitForBlob, the expiry of the misses
+	// kept for NegativeCacheTTL, the retries creating spill files and the backoff when
+	// Azure throttles (nil for the real clock)
+	Clock Clock
+	// DefaultAccessTier is set on the block blobs written by the Fs once they are
+	// committed, files, OpenWriter, Upload and UploadFromFile, unless FileOptions.AccessTier
+	// overrides it ("" leaves them in the account default tier). The azblob SDK in
+	// use can't send the tier with the commit, so it takes a request of its own.
+	DefaultAccessTier azblob.AccessTierType
+}
+
+// LogError logs any errors encountered, Azure errors are logged with their short
+// description and the code, status and requestID fields instead of the full dump
 func LogError(err error) {
 	msg := ""
+	var fields []interface{}
+	if serr := asStorageError(err); serr != nil {
+		fields = []interface{}{"code", serr.ServiceCode(), "status", serr.StatusCode(), "requestID", serr.RequestID()}
+		if _, wrapped := err.(*StorageError); wrapped || serr.err == err {
+			err = errors.New(serr.Description())
+		}
+	}
 	tFmt := "01-02|15:04:05"
 	msgFmt := "AZRBLOB-ERROR[%s] from %s within %s at line %d [%s]"
 	pc, file, line, ok := runtime.Caller(1)
@@ -50,7 +158,7 @@ func LogError(err error) {
 		}
 		msg = fmt.Sprintf(msgFmt, time.Now().Format(tFmt), file, name, line, err.Error())
 	}
-	log.Error(msg)
+	log.Error(msg, fields...)
 	return
 }
 
@@ -74,32 +182,125 @@ func LogDebug(entry string) {
 
 // NewFs creates a new Fs object writing files to a given Azure container.
 func NewFs(ctx *context.Context, serviceURL *azblob.ServiceURL, container string, cached bool) *Fs {
-	return &Fs{
+	return NewFsWithOptions(ctx, serviceURL, container, cached, FsOptions{})
+}
+
+// NewFsWithPipeline creates a new Fs object for a container of accountName that sends its
+// requests through an existing pipeline, so that many Fs objects share its connections.
+func NewFsWithPipeline(ctx *context.Context, p pipeline.Pipeline, accountName, container string, cached bool, options FsOptions) *Fs {
+	serviceURL := newServiceURL(accountName, p)
+	return NewFsWithOptions(ctx, &serviceURL, container, cached, options)
+}
+
+// newServiceURL builds the service URL of an Azure storage account
+func newServiceURL(accountName string, p pipeline.Pipeline) azblob.ServiceURL {
+	u, _ := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net", accountName))
+	return azblob.NewServiceURL(*u, p)
+}
+
+// NewFsWithOptions creates a new Fs object like NewFs with the given optional settings.
+func NewFsWithOptions(ctx *context.Context, serviceURL *azblob.ServiceURL, container string, cached bool, options FsOptions) *Fs {
+	if options.RootPrefix = strings.Trim(options.RootPrefix, "/"); options.RootPrefix != "" {
+		options.RootPrefix += "/"
+	}
+
+	fs := &Fs{
 		container:  container,
 		ctx:        ctx,
 		serviceURL: serviceURL,
 		cached:     cached,
+		options:    options,
 	}
+	if options.ContentCacheSize > 0 {
+		fs.content = newContentCache(options.ContentCacheSize)
+	}
+	if options.CreateContainerIfNotExists {
+		fs.created = &containerCreation{}
+	}
+	if options.MaxConcurrency > 0 {
+		fs.limiter = newConcurrencyLimiter(options.MaxConcurrency)
+	}
+	if options.NegativeCacheTTL > 0 {
+		fs.negative = newNegativeCache(options.NegativeCacheTTL, options.Clock)
+	}
+
+	return fs
+}
+
+// WithContext returns a shallow copy of the Fs whose operations run under ctx, e.g. to
+// bound a group of calls with a deadline or cancel them. The copy shares the container,
+// pipeline, options and content cache of fs, which keeps using its own context.
+func (fs *Fs) WithContext(ctx context.Context) *Fs {
+	clone := *fs
+	clone.ctx = &ctx
+	return &clone
 }
 
+const (
+	waitForBlobMinDelay = 100 * time.Millisecond
+	waitForBlobMaxDelay = 5 * time.Second
+)
+
 // ErrNotImplemented is returned when this operation is not (yet) implemented
 var ErrNotImplemented = errors.New("not implemented")
 
 // ErrNotSupported is returned when this operations is not supported by Azure
 var ErrNotSupported = errors.New("azure blob doesn't support this operation")
 
+// notSupported returns an error naming what isn't supported, errors.Is(err, ErrNotSupported) holds for it
+func notSupported(what string) error {
+	return fmt.Errorf("azrblob: %s not supported: %w", what, ErrNotSupported)
+}
+
 // ErrAlreadyOpened is returned when the file is already opened
 var ErrAlreadyOpened = errors.New("already opened")
 
 // ErrInvalidSeek is returned when the seek operation is not doable
 var ErrInvalidSeek = errors.New("invalid seek offset")
 
+// checkWritable returns a *os.PathError wrapping syscall.EROFS when the Fs is read-only,
+// otherwise it creates the container first when FsOptions.CreateContainerIfNotExists asks
+func (fs *Fs) checkWritable(op, name string) error {
+	if !fs.options.ReadOnly {
+		return fs.ensureContainer()
+	}
+
+	err := &os.PathError{Op: op, Path: name, Err: syscall.EROFS}
+	LogError(err)
+	return err
+}
+
+// ensureContainer creates the container once for FsOptions.CreateContainerIfNotExists,
+// a container that already exists is fine. A failed creation is tried again by the next write.
+func (fs *Fs) ensureContainer() error {
+	if fs.created == nil {
+		return nil
+	}
+
+	fs.created.mu.Lock()
+	defer fs.created.mu.Unlock()
+	if fs.created.done {
+		return nil
+	}
+
+	containerURL := fs.serviceURL.NewContainerURL(fs.container)
+	_, err := containerURL.Create(*fs.ctx, azblob.Metadata{}, fs.options.ContainerPublicAccess)
+	if err != nil && !hasServiceCode(wrapStorageError(err), azblob.ServiceCodeContainerAlreadyExists) {
+		err = wrapStorageError(err)
+		LogError(err)
+		return err
+	}
+	fs.created.done = true
+
+	return nil
+}
+
 // Name returns the type of FS object this is: Fs.
 func (Fs) Name() string { return "azrblob" }
 
-// Create a file
+// Create a file, like os.Create the file exists once closed even if nothing was written
 func (fs Fs) Create(name string) (afero.File, error) {
-	file, err := fs.OpenFile(name, os.O_WRONLY, 0750)
+	file, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0750)
 	if err != nil {
 		LogError(err)
 		return file, err
@@ -110,6 +311,10 @@ func (fs Fs) Create(name string) (afero.File, error) {
 
 // Mkdir makes a container in Azure Blob Storage.
 func (fs *Fs) Mkdir(name string, perm os.FileMode) error {
+	if err := fs.checkWritable("mkdir", name); err != nil {
+		return err
+	}
+
 	// file, err := fs.OpenFile(fmt.Sprintf("%s/", filepath.Clean(name)), os.O_CREATE, perm)
 	file, err := fs.OpenFile(fmt.Sprintf("%s/", trimLeadingSlash(name)), os.O_CREATE, perm)
 	if err == nil {
@@ -141,8 +346,51 @@ func (fs *Fs) Open(name string) (afero.File, error) {
 	return file, err
 }
 
+// FileOptions - optional settings for a File opened with OpenFileWithOptions
+type FileOptions struct {
+	// HTTPHeaders are set on the blob when a written file is committed, e.g. its
+	// ContentLanguage, and are reported by the FileInfo of the blob
+	HTTPHeaders azblob.BlobHTTPHeaders
+	// Metadata is set on the blob by the same request that commits a written file,
+	// so a committed blob never lacks it (nil leaves the blob without metadata)
+	Metadata azblob.Metadata
+	// BufferWrites keeps everything written in memory until Sync or Close upload it
+	// as a whole, so that Seek and WriteAt can go back and overwrite written bytes
+	// (e.g. to patch a header). Memory use grows with the size of the file, up to
+	// FsOptions.SpillThreshold when it's set.
+	BufferWrites bool
+	// ClearStagedOnAbort makes Abort recommit the committed block list of an existing
+	// blob, which has Azure drop the blocks staged for it instead of keeping them
+	// for a week. The content, HTTP headers and metadata stay the same.
+	ClearStagedOnAbort bool
+	// BlobType chooses the kind of blob a file open for writing writes ("" for a block
+	// blob, whatever the flags). Writes to an append blob are appended to it as they
+	// are made, O_APPEND is only allowed with it. Writes to a page blob are written
+	// in place at the offset of the file, which Seek moves: offsets and lengths must
+	// be multiples of 512, and the blob grows to hold them. Both are created at open
+	// by O_CREATE when missing (O_TRUNC replaces them) with HTTPHeaders and Metadata,
+	// without it writes to a missing append blob fail with os.ErrNotExist. An existing
+	// blob of another type fails the open with ErrBlobTypeMismatch, unless O_TRUNC
+	// replaces it. Close and Sync have nothing left to commit, and Abort can't undo
+	// their writes.
+	BlobType azblob.BlobType
+	// AccessTier is set on the block blob once a written file is committed, overriding
+	// FsOptions.DefaultAccessTier ("" keeps the default)
+	AccessTier azblob.AccessTierType
+}
+
 // OpenFile opens a file.
 func (fs *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	file, err := fs.OpenFileWithOptions(name, flag, perm, FileOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// OpenFileWithOptions opens a file like OpenFile with the given optional settings.
+func (fs *Fs) OpenFileWithOptions(name string, flag int, perm os.FileMode, options FileOptions) (*File, error) {
 	// // Exactly one of O_RDONLY, O_WRONLY, or O_RDWR must be specified.
 	// O_RDONLY int = syscall.O_RDONLY // open the file read-only.
 	// O_WRONLY int = syscall.O_WRONLY // open the file write-only.
@@ -153,33 +401,74 @@ func (fs *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, err
 	// O_EXCL   int = syscall.O_EXCL   // used with O_CREATE, file must not exist.
 	// O_SYNC   int = syscall.O_SYNC   // open for synchronous I/O.
 	// O_TRUNC  int = syscall.O_TRUNC  // truncate regular writable file when opened.
+	if accessMode := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR); accessMode != os.O_RDONLY && accessMode != os.O_WRONLY && accessMode != os.O_RDWR {
+		err := &os.PathError{Op: "open", Path: name, Err: ErrInvalidAccessMode}
+		LogError(err)
+		return nil, err
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		if err := fs.checkWritable("open", name); err != nil {
+			return nil, err
+		}
+	}
+
 	file := NewFile(fs, name)
+	file.options = options
 
 	// Reading and writing doesn't make sense for Azure Block Blobs
 	if flag&os.O_RDWR != 0 {
-		LogError(ErrNotSupported)
-		return nil, ErrNotSupported
+		err := notSupported("O_RDWR")
+		LogError(err)
+		return nil, err
 	}
 
-	// Appending is not supported by Azure Block Blobs
+	// Appending is only supported by Azure Append Blobs
+	if flag&os.O_APPEND != 0 && options.BlobType != azblob.BlobAppendBlob {
+		err := notSupported("O_APPEND without FileOptions.BlobType azblob.BlobAppendBlob")
+		LogError(err)
+		return nil, err
+	}
 	if flag&os.O_APPEND != 0 {
-		LogError(ErrNotSupported)
-		return nil, ErrNotSupported
+		flag |= os.O_WRONLY
 	}
 
-	// Creating is basically a write
+	// Append and page blobs are written in place, there is nothing to buffer
+	if options.BufferWrites && options.BlobType != "" && options.BlobType != azblob.BlobBlockBlob {
+		err := notSupported("BufferWrites on an append or page blob")
+		LogError(err)
+		return nil, err
+	}
+
+	// Creating is basically a write, that commits an empty blob when nothing is written
 	if flag&os.O_CREATE != 0 {
 		flag |= os.O_WRONLY
+		file.create = true
 	}
 
 	// Write a file
 	if flag&os.O_WRONLY != 0 {
 		file.streamWrite = true
+		if err := file.openWrite(flag); err != nil {
+			return nil, err
+		}
+		return file, nil
+	}
+
+	// A trailing slash or delimiter names a directory to list, there is no blob to look up
+	if hasTrailingSlash(name) || strings.HasSuffix(name, fs.delimiter()) {
+		file.cachedInfo = fs.newFileInfo(file.name, true, 0, time.Time{})
 		return file, nil
 	}
 
 	info, err := file.Stat()
 
+	// A name with wildcards that isn't a blob lists the blobs matching it
+	if errors.Is(err, ErrWildcard) {
+		file.cachedInfo = fs.newFileInfo(file.name, true, 0, time.Time{})
+		return file, nil
+	}
+
 	if err != nil {
 		LogError(err)
 		return nil, err
@@ -189,23 +478,135 @@ func (fs *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, err
 		return file, nil
 	}
 
-	file.streamRead = true
+	file.openRead(info)
 	return file, nil
 }
 
-// Remove a file
-func (fs *Fs) Remove(name string) error {
-	_, err := fs.Stat(name)
+// OpenReaders opens n independent read Files over the same blob, e.g. to process
+// ranges of it in parallel.
+//
+// Every File opened for reading keeps its own offset and its own FileInfo taken
+// when it was opened, no state is shared between Files. The Files returned by
+// OpenReaders additionally share one FileInfo and are pinned to the ETag it was
+// read with, so they all see the same content: once the blob is modified their
+// reads fail with a ConditionNotMet *StorageError instead of mixing versions.
+func (fs *Fs) OpenReaders(name string, n int) ([]*File, error) {
+	info, err := fs.Stat(name)
 	if err != nil {
 		LogError(err)
+		return nil, err
+	}
+
+	fi, ok := info.(*FileInfo)
+	if !ok || fi.IsDir() {
+		err := notSupported("OpenReaders on a directory")
+		LogError(err)
+		return nil, err
+	}
+
+	files := make([]*File, n)
+	for i := range files {
+		file := NewFile(fs, name)
+		file.cachedInfo = fi
+		file.ifMatch = fi.etag
+		file.openRead(fi)
+		files[i] = file
+	}
+
+	return files, nil
+}
+
+// OpenSnapshotReader opens a read File over a snapshot of the blob name, given by
+// its identifier (the "snapshot" query parameter of its URL), so that earlier
+// content can be read back. Read, ReadAt, Seek and Stat use the snapshot.
+func (fs *Fs) OpenSnapshotReader(name, snapshot string) (*File, error) {
+	file := NewFile(fs, name)
+	fi, err := fs.getSnapshotFileInfo(file.name, snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	file.snapshot = snapshot
+	file.cachedInfo = fi
+	file.openRead(fi)
+	return file, nil
+}
+
+// Remove a file, or an empty directory like os.Remove. Removing a directory
+// holding blobs fails with syscall.ENOTEMPTY.
+func (fs *Fs) Remove(name string) error {
+	if err := fs.checkWritable("remove", name); err != nil {
 		return err
 	}
 
-	return fs.deleteBlob(trimLeadingSlash(name))
+	blob := trimLeadingSlash(name)
+	var statErr error
+	if !hasTrailingSlash(blob) {
+		_, statErr = fs.Stat(name)
+		if statErr == nil {
+			return fs.deleteBlob(blob)
+		}
+		if !hasServiceCode(statErr, azblob.ServiceCodeBlobNotFound) {
+			LogError(statErr)
+			return statErr
+		}
+	}
+
+	return fs.removeDir(name, strings.TrimSuffix(blob, "/")+"/", statErr)
+}
+
+// RemoveIf deletes the blob name only when it meets conditions, e.g. its ETag or
+// last modification time are still those a cleanup job saw when it decided to delete
+// it, so that a blob written in between is kept. The error then matches
+// ErrPreconditionFailed. Directories can't be removed with conditions.
+func (fs *Fs) RemoveIf(name string, conditions azblob.BlobAccessConditions) error {
+	if err := fs.checkWritable("remove", name); err != nil {
+		return err
+	}
+
+	return fs.deleteBlobIf(trimLeadingSlash(name), conditions)
+}
+
+// errDirNotEmpty stops the listing of removeDir at the first blob in the directory
+var errDirNotEmpty = errors.New("directory not empty")
+
+// removeDir deletes the marker blob of an empty directory, notFound is returned
+// when there is neither a marker nor blobs under dir
+func (fs *Fs) removeDir(name, dir string, notFound error) error {
+	marker := false
+	err := fs.listBlobs(*fs.ctx, dir, nil, func(fi os.FileInfo) error {
+		if fullName(fi) == dir {
+			marker = true
+			return nil
+		}
+		return errDirNotEmpty
+	})
+	if err == errDirNotEmpty {
+		err = &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		LogError(err)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if !marker {
+		if notFound == nil {
+			notFound = &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+		}
+		LogError(notFound)
+		return notFound
+	}
+
+	return fs.deleteBlob(dir)
 }
 
 // RemoveAll removes all blobs in the container
 func (fs *Fs) RemoveAll(path string) error {
+	if err := fs.checkWritable("remove", path); err != nil {
+		return err
+	}
+
 	blobs, err := fs.getBlobsInContainer()
 	if err != nil {
 		LogError(err)
@@ -215,8 +616,7 @@ func (fs *Fs) RemoveAll(path string) error {
 	pathPrefix := trimLeadingSlash(path)
 	for _, blob := range blobs {
 		if pathPrefix == "/" || strings.HasPrefix(blob, pathPrefix) {
-			err = fs.deleteBlob(blob)
-			if err != nil {
+			if err := fs.deleteBlobBackoff(blob); err != nil {
 				LogError(err)
 				return err
 			}
@@ -226,15 +626,90 @@ func (fs *Fs) RemoveAll(path string) error {
 	return nil
 }
 
+// RemoveAllResult removes the blob path and every blob in the directory path, going
+// on when some can't be removed (e.g. leased or immutable blobs). It returns the names
+// of the blobs removed and the errors of the others, err is only set when the blobs
+// couldn't be listed.
+func (fs *Fs) RemoveAllResult(path string) (deleted []string, failed map[string]error, err error) {
+	if err := fs.checkWritable("remove", path); err != nil {
+		return nil, nil, err
+	}
+
+	// only the blobs in the directory path names, and the blob path itself, not the
+	// siblings sharing its prefix (e.g. dir10 for dir1)
+	names, err := fs.getBlobsUnder(dirPrefix(path))
+	if err != nil {
+		LogError(err)
+		return nil, nil, err
+	}
+	if name := trimLeadingSlash(path); name != "" && name != "/" && !hasTrailingSlash(name) {
+		_, err := fs.getBlobFileInfo(name)
+		if err == nil {
+			names = append(names, name)
+		} else if !hasServiceCode(err, azblob.ServiceCodeBlobNotFound) {
+			LogError(err)
+			return nil, nil, err
+		}
+	}
+
+	// forEachConcurrently already holds a concurrency slot around each delete
+	failed = fs.forEachConcurrently(names, fs.deleteBlobThrottled)
+	deleted = []string{}
+	for _, name := range names {
+		if _, ok := failed[name]; !ok {
+			deleted = append(deleted, name)
+		}
+	}
+
+	return deleted, failed, nil
+}
+
+// deleteBlobBackoff deletes blob, backing off when Azure throttles the deletes
+// instead of failing half way. It takes a concurrency slot for each attempt.
+func (fs *Fs) deleteBlobBackoff(blob string) error {
+	return fs.retryThrottled(func() error {
+		fs.limiter.acquire(1)
+		defer fs.limiter.release(1)
+		return fs.deleteBlob(blob)
+	})
+}
+
+// deleteBlobThrottled is deleteBlobBackoff for the callers already holding a
+// concurrency slot, e.g. within forEachConcurrently
+func (fs *Fs) deleteBlobThrottled(blob string) error {
+	return fs.retryThrottled(func() error {
+		return fs.deleteBlob(blob)
+	})
+}
+
+// retryThrottled calls fn again while it fails with Azure throttling, backing off in between
+func (fs *Fs) retryThrottled(fn func() error) (err error) {
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || !backoffThrottled(*fs.ctx, clockOrReal(fs.options.Clock), err, attempt) {
+			return err
+		}
+	}
+}
+
 // Rename a file
 // There is no method to directly rename an Azure Blob, so Rename
 // will copy the file to a new blob with the new name and then delete
-// the original.
+// the original. Use MoveDir to rename a directory.
 func (fs Fs) Rename(oldname, newname string) error {
 	if oldname == newname {
 		return nil
 	}
 
+	if fs.options.ReadOnly {
+		err := &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EROFS}
+		LogError(err)
+		return err
+	}
+	if err := fs.ensureContainer(); err != nil {
+		return err
+	}
+
 	err := fs.renameBlob(trimLeadingSlash(oldname), trimLeadingSlash(newname))
 	if err != nil {
 		LogError(err)
@@ -243,6 +718,680 @@ func (fs Fs) Rename(oldname, newname string) error {
 	return err
 }
 
+// Copy has Azure copy the blob oldname into newname, replacing it, and waits for
+// the copy to complete. The copy is checked when FsOptions.VerifyCopies is set.
+func (fs *Fs) Copy(oldname, newname string) error {
+	if err := fs.checkWritable("copy", newname); err != nil {
+		return err
+	}
+
+	err := fs.copyBlob(trimLeadingSlash(oldname), trimLeadingSlash(newname))
+	if err != nil {
+		LogError(err)
+	}
+
+	return err
+}
+
+// CopyFromURL has Azure copy the blob or file at srcURL into dstName and waits
+// for the copy to complete, the bytes don't go through this process. srcURL
+// must be readable by Azure, e.g. a signed URL of another storage account or cloud.
+func (fs *Fs) CopyFromURL(srcURL, dstName string) error {
+	if err := fs.checkWritable("copy", dstName); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(srcURL)
+	if err != nil {
+		LogError(err)
+		return err
+	}
+
+	return fs.copyFromURL(*u, trimLeadingSlash(dstName))
+}
+
+// IncrementalCopy has Azure copy only what changed in the page blob snapshot at
+// srcSnapshotURL (a page blob URL with its "snapshot" query parameter) since the
+// previous incremental copy into the page blob dstName, and waits for the copy to
+// complete. It returns the snapshot of dstName created by the copy.
+func (fs *Fs) IncrementalCopy(srcSnapshotURL, dstName string) (destinationSnapshot string, err error) {
+	if err := fs.checkWritable("copy", dstName); err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(srcSnapshotURL)
+	if err != nil {
+		LogError(err)
+		return "", err
+	}
+
+	query := u.Query()
+	snapshot := query.Get("snapshot")
+	if snapshot == "" {
+		err = fmt.Errorf("%s is not a snapshot URL", srcSnapshotURL)
+		LogError(err)
+		return "", err
+	}
+	// the snapshot is passed apart and set back on the URL by azblob
+	query.Del("snapshot")
+	u.RawQuery = query.Encode()
+
+	return fs.copyIncremental(*u, snapshot, trimLeadingSlash(dstName))
+}
+
+// DownloadToFile downloads a blob straight to a local file using parallel
+// ranged downloads, bypassing the afero File read path.
+func (fs *Fs) DownloadToFile(name, localPath string) error {
+	file, err := os.Create(localPath)
+	if err != nil {
+		LogError(err)
+		return err
+	}
+
+	err = fs.blobDownloadToFile(trimLeadingSlash(name), file)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		LogError(err)
+		os.Remove(localPath)
+	}
+
+	return err
+}
+
+// UploadFromFile uploads a local file to a blob in parallel blocks, setting the
+// content type from the file extension of the blob name.
+func (fs *Fs) UploadFromFile(localPath, name string) error {
+	if err := fs.checkWritable("upload", name); err != nil {
+		return err
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		LogError(err)
+		return err
+	}
+	defer file.Close()
+
+	headers := azblob.BlobHTTPHeaders{ContentType: mime.TypeByExtension(filepath.Ext(name))}
+	err = fs.blobUploadFromFile(*fs.ctx, trimLeadingSlash(name), file, headers, nil)
+	if err != nil {
+		LogError(err)
+		return err
+	}
+
+	return fs.setCommittedTier(trimLeadingSlash(name), "")
+}
+
+// Upload creates or replaces the blob name with what is read from r until io.EOF,
+// e.g. a large HTTP response body. It is read straight into blocks of
+// FsOptions.BlockSize staged as they fill, like OpenWriter, and committed at the
+// end. The content type is set from the file extension of the name. When r
+// fails nothing is committed and the blob is left as it was.
+func (fs *Fs) Upload(name string, r io.Reader) error {
+	writer, err := fs.OpenWriter(name)
+	if err != nil {
+		return err
+	}
+
+	w := writer.(*blobWriter)
+	if _, err := w.ReadFrom(r); err != nil {
+		// wait for the blocks being staged, the error of r is the one returned
+		w.staging.Wait()
+		return err
+	}
+
+	return w.Close()
+}
+
+// ResponseHeaders override the HTTP headers a blob is served with, e.g. to have
+// browsers save it under another name. Empty fields keep the blob's own.
+type ResponseHeaders struct {
+	ContentType        string
+	ContentDisposition string
+	CacheControl       string
+	ContentEncoding    string
+	ContentLanguage    string
+}
+
+// SignedURL returns a URL reading the blob name until expiry, signed with credential
+// (e.g. an azblob.SharedKeyCredential of the account). Downloads through it are served
+// with the given response headers instead of the blob's, Azure only honors such
+// overrides for signed URLs, so the same blob can be served differently without copying it.
+func (fs *Fs) SignedURL(name string, credential azblob.StorageAccountCredential, expiry time.Time, headers ResponseHeaders) (string, error) {
+	parts := azblob.NewBlobURLParts(fs.getBlobURL(trimLeadingSlash(name)).URL())
+	sas, err := azblob.BlobSASSignatureValues{
+		Protocol:           azblob.SASProtocolHTTPS,
+		ExpiryTime:         expiry,
+		Permissions:        azblob.BlobSASPermissions{Read: true}.String(),
+		ContainerName:      parts.ContainerName,
+		BlobName:           parts.BlobName,
+		ContentType:        headers.ContentType,
+		ContentDisposition: headers.ContentDisposition,
+		CacheControl:       headers.CacheControl,
+		ContentEncoding:    headers.ContentEncoding,
+		ContentLanguage:    headers.ContentLanguage,
+	}.NewSASQueryParameters(credential)
+	if err != nil {
+		LogError(err)
+		return "", err
+	}
+
+	parts.SAS = sas
+	u := parts.URL()
+	return u.String(), nil
+}
+
+// OpenReader returns the body of a single download of the whole blob, so it can be
+// streamed with io.Copy without buffering it. Interrupted reads are resumed from where
+// they stopped, pinned to the ETag of the first response. The caller closes it.
+func (fs *Fs) OpenReader(name string) (io.ReadCloser, error) {
+	resp, err := fs.blobDownload(*fs.ctx, trimLeadingSlash(name), "", 0, azblob.CountToEnd, azblob.BlobAccessConditions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: transferMaxRetries}), nil
+}
+
+// RangeReader streams a range of a blob, see OpenRangeReader. The caller closes it.
+type RangeReader struct {
+	io.ReadCloser
+	// Offset is the first byte of the range in the blob, Length the number of bytes
+	// it holds, fewer than asked when it goes past the end, and Size the size of the
+	// blob, e.g. for the Content-Range of an HTTP response
+	Offset int64
+	Length int64
+	Size   int64
+}
+
+// OpenRangeReader returns the body of a single download of count bytes of a blob
+// from offset, or up to its end for azblob.CountToEnd, so that a slice of it can
+// be streamed without buffering it (e.g. to serve an HTTP Range request). Like
+// OpenReader, interrupted reads are resumed pinned to the ETag of the first response.
+// An offset at or past the end of the blob fails with an InvalidRange *StorageError.
+func (fs *Fs) OpenRangeReader(name string, offset, count int64) (*RangeReader, error) {
+	if offset < 0 || count < 0 {
+		err := &os.PathError{Op: "range", Path: name, Err: ErrInvalidSeek}
+		LogError(err)
+		return nil, err
+	}
+
+	resp, err := fs.blobDownload(*fs.ctx, trimLeadingSlash(name), "", offset, count, azblob.BlobAccessConditions{})
+	if err != nil {
+		return nil, err
+	}
+
+	length := resp.ContentLength()
+	size := length
+	if contentRange := resp.ContentRange(); contentRange != "" {
+		// bytes <first>-<last>/<size>
+		if i := strings.LastIndex(contentRange, "/"); i >= 0 {
+			size, _ = strconv.ParseInt(contentRange[i+1:], 10, 64)
+		}
+	}
+
+	return &RangeReader{
+		ReadCloser: resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: transferMaxRetries}),
+		Offset:     offset,
+		Length:     length,
+		Size:       size,
+	}, nil
+}
+
+// Head returns the first n bytes of a blob, or the whole blob when it is shorter,
+// using a single ranged download without a Stat first.
+func (fs *Fs) Head(name string, n int64) ([]byte, error) {
+	if n <= 0 {
+		return []byte{}, nil
+	}
+
+	data, err := fs.blobRead(trimLeadingSlash(name), "", 0, n, azblob.BlobAccessConditions{})
+	if err != nil {
+		LogError(err)
+		return nil, err
+	}
+
+	return *data, nil
+}
+
+// Checksum returns the MD5 stored in a blob's properties without downloading it.
+// ErrNoChecksum is returned when the blob has no stored MD5 (e.g. blobs committed
+// block by block), the caller can then decide to download it and compute one.
+// Azure doesn't keep a CRC64 of whole blobs, so crc64 is 0 for now.
+func (fs *Fs) Checksum(name string) (md5 []byte, crc64 uint64, err error) {
+	md5, err = fs.getBlobMD5(trimLeadingSlash(name))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(md5) == 0 {
+		return nil, 0, ErrNoChecksum
+	}
+
+	return md5, 0, nil
+}
+
+// Immutability reports whether the container has a legal hold and an immutability
+// policy. Deleting or overwriting a protected blob fails with an error matching ErrImmutable.
+// Holds and policies are managed on the container, per blob ones are not supported yet.
+func (fs *Fs) Immutability() (legalHold, immutabilityPolicy bool, err error) {
+	return fs.getContainerImmutability()
+}
+
+// ListEach calls fn with each blob under prefix as the listing segments arrive,
+// without buffering them like ReaddirAll does. Archived blobs are skipped like in Readdir.
+// It stops at the first error returned by fn (which is returned) or when the Fs context is done.
+func (fs *Fs) ListEach(prefix string, fn func(os.FileInfo) error) error {
+	return fs.listBlobs(*fs.ctx, trimLeadingSlash(prefix), nil, fn)
+}
+
+// ListModifiedSince returns the blobs under prefix last modified after since, e.g. for an
+// incremental sync. Azure can't filter the listing on the modification time, so each segment
+// is filtered as it arrives and only the matching blobs are kept.
+func (fs *Fs) ListModifiedSince(prefix string, since time.Time) ([]os.FileInfo, error) {
+	fileInfos := []os.FileInfo{}
+	err := fs.listBlobs(*fs.ctx, trimLeadingSlash(prefix), nil, func(fi os.FileInfo) error {
+		if fi.ModTime().After(since) {
+			fileInfos = append(fileInfos, fi)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return fileInfos, nil
+}
+
+// ListPrefixes lists the directories named by prefixes concurrently, like Readdir(n)
+// on a File opened on each of them, e.g. "logs/", "metrics/" and "traces/" for a
+// dashboard. The delimiter of the Fs is appended to the prefixes missing it, whatever
+// it is, and "" or "/" lists the root. The entries are returned by prefix, an empty
+// directory has none. The prefixes whose listing failed are left out and returned in a *BatchError.
+func (fs *Fs) ListPrefixes(prefixes []string, n int) (map[string][]os.FileInfo, error) {
+	var mu sync.Mutex
+	results := make(map[string][]os.FileInfo, len(prefixes))
+	errs := fs.forEachConcurrently(prefixes, func(prefix string) error {
+		dir := prefix
+		if delimiter := fs.delimiter(); dir == "" {
+			dir = "/"
+		} else if dir != "/" && !strings.HasSuffix(dir, delimiter) {
+			dir += delimiter
+		}
+		fileInfos, err := NewFile(fs, dir).Readdir(n)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		mu.Lock()
+		results[prefix] = fileInfos
+		mu.Unlock()
+		return nil
+	})
+	if len(errs) > 0 {
+		err := &BatchError{Errors: errs}
+		LogError(err)
+		return results, err
+	}
+
+	return results, nil
+}
+
+// errGlobLimit stops the listing of GlobN once it has enough matches
+var errGlobLimit = errors.New("glob limit reached")
+
+// Glob returns the names of the blobs matching pattern, sorted, where ? matches
+// any character and * any run of characters, "/" included, and [...] (or [!...]) a
+// character class. Any other character is matched literally. Only the blobs under
+// the literal prefix of the pattern (e.g. "logs/2024-" for "logs/2024-*") are listed.
+func (fs *Fs) Glob(pattern string) ([]string, error) {
+	return fs.GlobN(pattern, 0)
+}
+
+// GlobN is Glob returning at most limit names (0 for no limit), the listing stops
+// as soon as they are found and asks for no more than limit blobs per segment.
+func (fs *Fs) GlobN(pattern string, limit int) ([]string, error) {
+	pattern = trimLeadingSlash(pattern)
+	prefix := pattern
+	if i := strings.IndexAny(pattern, "?*["); i >= 0 {
+		prefix = pattern[:i]
+	}
+
+	rexp, err := getFilterRegExp(pattern)
+	if err != nil {
+		LogError(err)
+		return nil, err
+	}
+
+	pageSize := fs.options.ListPageSize
+	if limit > 0 && limit < 5000 && (pageSize == 0 || int32(limit) < pageSize) {
+		pageSize = int32(limit)
+	}
+
+	names := []string{}
+	err = fs.listBlobsPaged(*fs.ctx, prefix, pageSize, rexp, func(fi os.FileInfo) error {
+		names = append(names, fullName(fi))
+		if limit > 0 && len(names) >= limit {
+			return errGlobLimit
+		}
+		return nil
+	})
+	if err != nil && err != errGlobLimit {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// ListDirs returns the directories right under prefix, without listing the blobs
+// below them. Each name is relative to the Fs root and ends with the delimiter so
+// that it can be passed back to ListDirs, e.g. "dir/sub/".
+func (fs *Fs) ListDirs(prefix string) ([]string, error) {
+	prefix = trimLeadingSlash(prefix)
+	switch delimiter := fs.delimiter(); {
+	case prefix == "/":
+		prefix = ""
+	case prefix != "" && !strings.HasSuffix(prefix, delimiter):
+		prefix += delimiter
+	}
+
+	return fs.listBlobPrefixes(prefix)
+}
+
+// BlobType returns whether name is a block, page or append blob. Only block
+// blobs can be written through the Files of this package, append blobs can be
+// appended to with AppendBlock and page blobs written with WritePages.
+func (fs *Fs) BlobType(name string) (azblob.BlobType, error) {
+	fi, err := fs.getBlobFileInfo(trimLeadingSlash(name))
+	if err != nil {
+		return azblob.BlobNone, err
+	}
+
+	return fi.blobType, nil
+}
+
+// AppendBlock appends p to the append blob name, creating it when it doesn't exist,
+// and returns the offset p was appended at. The conditions make the append fail
+// with ErrAppendPositionMismatch unless the blob is exactly IfAppendPositionEqual
+// bytes long (-1 for an empty blob), so a retried append is never duplicated, or
+// would stay within IfMaxSizeLessThanOrEqual bytes; 0 leaves either unchecked.
+func (fs *Fs) AppendBlock(name string, p []byte, conditions azblob.AppendPositionAccessConditions) (offset int64, err error) {
+	if err := fs.checkWritable("append", name); err != nil {
+		return 0, err
+	}
+
+	return fs.appendBlock(trimLeadingSlash(name), p, conditions, true, azblob.BlobHTTPHeaders{}, nil)
+}
+
+// PageWriteOptions - optional settings for WritePages, the zero value writes unconditionally
+type PageWriteOptions struct {
+	// Conditions the sequence number of the page blob must meet for the pages to be
+	// written, WritePages fails with ErrSequenceNumberMismatch otherwise
+	Conditions azblob.SequenceNumberAccessConditions
+	// IncrementSequenceNumber increments the sequence number once the pages are written.
+	// It fails with a ConditionNotMet *StorageError when the blob was written again in between.
+	IncrementSequenceNumber bool
+}
+
+// CreatePageBlob creates or replaces the page blob name with size bytes of zeros
+// and the given sequence number, size must be a multiple of 512.
+func (fs *Fs) CreatePageBlob(name string, size, sequenceNumber int64) error {
+	if err := fs.checkWritable("create", name); err != nil {
+		return err
+	}
+
+	return fs.createPageBlob(trimLeadingSlash(name), size, sequenceNumber, azblob.BlobHTTPHeaders{}, nil)
+}
+
+// WritePages writes p at offset of the page blob name and returns its sequence
+// number, offset and the length of p must be multiples of 512. The options let
+// the sequence number serve for optimistic concurrency, see PageWriteOptions.
+func (fs *Fs) WritePages(name string, offset int64, p []byte, options PageWriteOptions) (sequenceNumber int64, err error) {
+	if err := fs.checkWritable("write", name); err != nil {
+		return 0, err
+	}
+
+	return fs.writePages(trimLeadingSlash(name), offset, p, options)
+}
+
+// SetSequenceNumber sets the sequence number of the page blob name, raises it to
+// sequenceNumber (SequenceNumberActionMax) or increments it, and returns the new one.
+func (fs *Fs) SetSequenceNumber(name string, action azblob.SequenceNumberActionType, sequenceNumber int64) (int64, error) {
+	if err := fs.checkWritable("write", name); err != nil {
+		return 0, err
+	}
+
+	return fs.updateSequenceNumber(trimLeadingSlash(name), action, sequenceNumber, azblob.ModifiedAccessConditions{})
+}
+
+// WaitForBlob polls until name exists, backing off between attempts, e.g. for
+// blobs written by another process. It returns context.DeadlineExceeded when
+// timeout elapses first, or the Fs context's error when it is done.
+func (fs *Fs) WaitForBlob(name string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(*fs.ctx, timeout)
+	defer cancel()
+
+	blob := trimLeadingSlash(name)
+	delay := waitForBlobMinDelay
+	for {
+		exists, err := fs.blobExists(ctx, blob)
+		if exists {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			LogError(err)
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clockOrReal(fs.options.Clock).After(delay):
+		}
+		if delay *= 2; delay > waitForBlobMaxDelay {
+			delay = waitForBlobMaxDelay
+		}
+	}
+}
+
+// ContainerURL returns the azblob URL of the container, for operations this
+// package doesn't wrap.
+func (fs *Fs) ContainerURL() azblob.ContainerURL {
+	return fs.serviceURL.NewContainerURL(fs.container)
+}
+
+// BlobURL returns the azblob URL of the named blob (under the RootPrefix), for
+// operations this package doesn't wrap.
+func (fs *Fs) BlobURL(name string) azblob.BlockBlobURL {
+	return fs.getBlobURL(trimLeadingSlash(name))
+}
+
+// Ping checks the credentials and that the container is reachable with a single
+// GetProperties on the container, e.g. for readiness probes
+func (fs *Fs) Ping() error {
+	_, err := fs.getContainerFileInfo()
+	return err
+}
+
+// Rehydrate starts moving an archived blob back to the given online tier
+// (azblob.AccessTierHot or azblob.AccessTierCool). Rehydration runs in the
+// background on Azure and the blob stays unreadable until it completes.
+// It always uses the Standard rehydrate priority, see the README's known limitations.
+func (fs *Fs) Rehydrate(name string, tier azblob.AccessTierType) error {
+	if tier == azblob.AccessTierArchive {
+		err := notSupported("rehydrating to the Archive tier")
+		LogError(err)
+		return err
+	}
+
+	if err := fs.checkWritable("rehydrate", name); err != nil {
+		return err
+	}
+
+	return fs.setBlobTier(trimLeadingSlash(name), tier)
+}
+
+// SetTierBatch moves the blobs to tier, e.g. from Hot to Cool for lifecycle transitions.
+// The azblob SDK in use has no Blob Batch API, so Set Blob Tier requests are sent
+// concurrently, FsOptions.Parallelism at a time. When some blobs fail the others are
+// still moved and the error is a *BatchError holding the error of each failed blob.
+func (fs *Fs) SetTierBatch(names []string, tier azblob.AccessTierType) error {
+	if len(names) == 0 {
+		return nil
+	}
+	if err := fs.checkWritable("settier", names[0]); err != nil {
+		return err
+	}
+
+	errs := fs.forEachConcurrently(names, func(name string) error {
+		return fs.setBlobTier(trimLeadingSlash(name), tier)
+	})
+	if len(errs) > 0 {
+		err := &BatchError{Errors: errs}
+		LogError(err)
+		return err
+	}
+	return nil
+}
+
+// MoveDir moves every blob under srcPrefix to the same name under dstPrefix, e.g.
+// to rename a folder. The blobs are copied server side, FsOptions.Parallelism at
+// a time, and the originals are only deleted once all the copies succeeded.
+// The blobs already under dstPrefix are never overwritten, their copy fails with
+// an error matching os.ErrExist, and prefixes containing one another are refused
+// with ErrOverlappingPrefixes. When a copy fails the copies made are deleted and the
+// error is a *BatchError holding the error of each blob that failed; when a delete
+// fails afterwards the blobs it names are left under both prefixes.
+func (fs *Fs) MoveDir(srcPrefix, dstPrefix string) error {
+	if err := fs.checkWritable("rename", dstPrefix); err != nil {
+		return err
+	}
+
+	src, dst := dirPrefix(srcPrefix), dirPrefix(dstPrefix)
+	if src == dst {
+		return nil
+	}
+	// the copies would overwrite blobs still to be moved, or be deleted with the sources
+	if strings.HasPrefix(dst, src) || strings.HasPrefix(src, dst) {
+		err := &os.LinkError{Op: "rename", Old: srcPrefix, New: dstPrefix, Err: ErrOverlappingPrefixes}
+		LogError(err)
+		return err
+	}
+
+	var names []string
+	err := fs.listBlobs(*fs.ctx, src, nil, func(fi os.FileInfo) error {
+		names = append(names, fullName(fi))
+		return nil
+	})
+	if err != nil {
+		LogError(err)
+		return err
+	}
+	if len(names) == 0 {
+		err = &os.LinkError{Op: "rename", Old: srcPrefix, New: dstPrefix, Err: os.ErrNotExist}
+		LogError(err)
+		return err
+	}
+
+	moved := func(name string) string {
+		return dst + strings.TrimPrefix(name, src)
+	}
+	// the copies never overwrite a blob, the rollback then only deletes blobs the move created
+	errs := fs.forEachConcurrently(names, func(name string) error {
+		err := fs.copyBlobIf(name, moved(name), azblob.BlobAccessConditions{
+			ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny},
+		})
+		if hasServiceCode(err, azblob.ServiceCodeBlobAlreadyExists) {
+			err = &os.PathError{Op: "rename", Path: moved(name), Err: os.ErrExist}
+		}
+		return err
+	})
+	if len(errs) > 0 {
+		var copied []string
+		for _, name := range names {
+			if errs[name] == nil {
+				copied = append(copied, moved(name))
+			}
+		}
+		fs.forEachConcurrently(copied, fs.deleteBlob)
+		err = &BatchError{Errors: errs}
+		LogError(err)
+		return err
+	}
+
+	errs = fs.forEachConcurrently(names, fs.deleteBlob)
+	if len(errs) > 0 {
+		err = &BatchError{Errors: errs}
+		LogError(err)
+		return err
+	}
+	return nil
+}
+
+// dirPrefix returns the blob name prefix of the directory name, "" for the root
+func dirPrefix(name string) string {
+	name = trimLeadingSlash(name)
+	if name == "" || name == "/" || hasTrailingSlash(name) {
+		return strings.TrimPrefix(name, "/")
+	}
+	return name + "/"
+}
+
+// forEachConcurrently calls fn for each name, FsOptions.Parallelism at a time within
+// FsOptions.MaxConcurrency, and returns the errors of the names it failed for
+func (fs *Fs) forEachConcurrently(names []string, fn func(name string) error) map[string]error {
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		errs  = make(map[string]error)
+		slots = make(chan struct{}, fs.transferParallelism())
+	)
+	for _, name := range names {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(name string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			fs.limiter.acquire(1)
+			err := fn(name)
+			fs.limiter.release(1)
+			if err != nil {
+				mu.Lock()
+				errs[name] = err
+				mu.Unlock()
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// SetHTTPHeaders replaces the HTTP headers (content type, cache control,
+// content disposition, ...) of an existing blob.
+func (fs *Fs) SetHTTPHeaders(name string, headers azblob.BlobHTTPHeaders) error {
+	if err := fs.checkWritable("setheaders", name); err != nil {
+		return err
+	}
+
+	return fs.setBlobHTTPHeaders(trimLeadingSlash(name), headers)
+}
+
+// delimiter returns the separator of the levels of the blob names
+func (fs *Fs) delimiter() string {
+	if fs.options.Delimiter != "" {
+		return fs.options.Delimiter
+	}
+	return "/"
+}
+
 func hasTrailingSlash(s string) bool {
 	return len(s) > 0 && s[len(s)-1] == '/'
 }
@@ -267,12 +1416,20 @@ func (fs Fs) Stat(name string) (os.FileInfo, error) {
 		return fi, nil
 	}
 
+	if err := fs.negative.get(nameClean); err != nil {
+		return nil, err
+	}
+
+	generation := fs.negative.start()
 	fi, err := fs.getBlobFileInfo(nameClean)
 	if err != nil {
 		// if strings.Contains(err.Error(), "Status: 404 The specified blob does not exist") {
 		// 	log.Debug("Is this a directory?")
 		// }
 		LogError(err)
+		if hasServiceCode(err, azblob.ServiceCodeBlobNotFound) {
+			fs.negative.put(nameClean, err, generation)
+		}
 		return nil, err
 	}
 
@@ -281,12 +1438,14 @@ func (fs Fs) Stat(name string) (os.FileInfo, error) {
 
 // Chmod doesn't exists in Azure Blob Storage
 func (fs Fs) Chmod(name string, mode os.FileMode) error {
-	LogError(ErrNotSupported)
-	return ErrNotSupported
+	err := notSupported("Chmod")
+	LogError(err)
+	return err
 }
 
 // Chtimes doesn't exists in Azure Blob Storage
 func (fs Fs) Chtimes(name string, old time.Time, new time.Time) error {
-	LogError(ErrNotSupported)
-	return ErrNotSupported
+	err := notSupported("Chtimes")
+	LogError(err)
+	return err
 }
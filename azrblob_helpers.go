@@ -2,17 +2,33 @@ package azrblob
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
 )
 
+const (
+	transferParallelism = 16
+	transferMaxRetries  = 5
+	throttleMaxRetries  = 5
+	throttleMinDelay    = time.Second
+	throttleMaxDelay    = 30 * time.Second
+)
+
 // A container name must be a valid DNS name, conforming to the following naming rules:
 // Container names must start or end with a letter or number, and can contain only letters, numbers, and the dash (-) character.
 // Every dash (-) character must be immediately preceded and followed by a letter or number; consecutive dashes are not permitted in container names.
@@ -27,11 +43,79 @@ import (
 // Reserved URL characters must be properly escaped.
 // The number of path segments comprising the blob name cannot exceed 254. A path segment is the string between consecutive delimiter characters (e.g., the forward slash '/') that corresponds to the name of a virtual directory.
 
+// serverContext bounds a single request to timeout (0 leaves ctx alone). The azblob retry
+// policy sends the time left as the timeout query parameter of the request, so the
+// service gives up on it at the same time as the client. It must only wrap one request:
+// a deadline around a whole transfer would be sent with, and cut, every request of it.
+func serverContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// listBlobsFlatSegment lists one segment of blobs, backing off and retrying while
+// Azure is throttling. Each request is bounded by timeout, see serverContext.
+func listBlobsFlatSegment(ctx context.Context, clock Clock, timeout time.Duration, containerURL azblob.ContainerURL, marker azblob.Marker, options azblob.ListBlobsSegmentOptions) (*azblob.ListBlobsFlatSegmentResponse, error) {
+	for attempt := 0; ; attempt++ {
+		requestCtx, cancel := serverContext(ctx, timeout)
+		listBlob, err := containerURL.ListBlobsFlatSegment(requestCtx, marker, options)
+		cancel()
+		if err == nil {
+			return listBlob, nil
+		}
+		err = wrapStorageError(err)
+		if !backoffThrottled(ctx, clock, err, attempt) {
+			return nil, err
+		}
+	}
+}
+
+// listBlobsHierarchySegment lists one segment of blobs and blob prefixes grouped on
+// delimiter, backing off and retrying while Azure is throttling. Each request is
+// bounded by timeout, see serverContext.
+func listBlobsHierarchySegment(ctx context.Context, clock Clock, timeout time.Duration, containerURL azblob.ContainerURL, marker azblob.Marker, delimiter string, options azblob.ListBlobsSegmentOptions) (*azblob.ListBlobsHierarchySegmentResponse, error) {
+	for attempt := 0; ; attempt++ {
+		requestCtx, cancel := serverContext(ctx, timeout)
+		listBlob, err := containerURL.ListBlobsHierarchySegment(requestCtx, marker, delimiter, options)
+		cancel()
+		if err == nil {
+			return listBlob, nil
+		}
+		err = wrapStorageError(err)
+		if !backoffThrottled(ctx, clock, err, attempt) {
+			return nil, err
+		}
+	}
+}
+
+// backoffThrottled waits an exponential delay with jitter before the next attempt
+// on clock when err is Azure throttling, it returns false when the request shouldn't be retried
+func backoffThrottled(ctx context.Context, clock Clock, err error, attempt int) bool {
+	if attempt >= throttleMaxRetries || !errors.Is(err, ErrThrottled) {
+		return false
+	}
+
+	delay := throttleMinDelay << uint(attempt)
+	if delay > throttleMaxDelay {
+		delay = throttleMaxDelay
+	}
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-clock.After(delay):
+		return true
+	}
+}
+
 func (fs *Fs) getContainers() ([]string, error) {
 	var containers []string
 	for marker := (azblob.Marker{}); marker.NotDone(); {
 		listCont, err := fs.serviceURL.ListContainersSegment(*fs.ctx, marker, azblob.ListContainersSegmentOptions{})
 		if err != nil {
+			err = wrapStorageError(err)
 			LogError(err)
 			return containers, err
 		}
@@ -50,6 +134,7 @@ func (fs *Fs) createContainer(name string) error {
 	containerURL := fs.serviceURL.NewContainerURL(strings.ToLower(name))
 	_, err := containerURL.Create(*fs.ctx, azblob.Metadata{}, azblob.PublicAccessNone)
 	if err != nil {
+		err = wrapStorageError(err)
 		LogError(err)
 	}
 
@@ -57,11 +142,17 @@ func (fs *Fs) createContainer(name string) error {
 }
 
 func (fs *Fs) getBlobsInContainer() (blobs []string, err error) {
+	return fs.getBlobsUnder("")
+}
+
+// getBlobsUnder returns the names of every blob under prefix, archived ones included
+func (fs *Fs) getBlobsUnder(prefix string) (blobs []string, err error) {
 	containerURL := fs.serviceURL.NewContainerURL(fs.container)
 	for marker := (azblob.Marker{}); marker.NotDone(); { // The parens around Marker{} are required to avoid compiler error.
 		// Get a result segment starting with the blob indicated by the current Marker.
-		listBlob, err := containerURL.ListBlobsFlatSegment(*fs.ctx, marker, azblob.ListBlobsSegmentOptions{})
+		listBlob, err := listBlobsFlatSegment(*fs.ctx, clockOrReal(fs.options.Clock), fs.options.ServerTimeout, containerURL, marker, azblob.ListBlobsSegmentOptions{Prefix: fs.options.RootPrefix + prefix, MaxResults: fs.options.ListPageSize})
 		if err != nil {
+			err = wrapStorageError(err)
 			LogError(err)
 			return blobs, err
 		}
@@ -72,11 +163,107 @@ func (fs *Fs) getBlobsInContainer() (blobs []string, err error) {
 
 		// Process the blobs returned in this result segment
 		for _, blobInfo := range listBlob.Segment.BlobItems {
-			blobs = append(blobs, blobInfo.Name)
+			blobs = append(blobs, fs.relativeName(blobInfo.Name))
 		}
 	}
 	return blobs, nil
 }
+
+// listBlobs walks every segment under prefix calling fn with each non-archived blob
+// matching rexp, it stops at the first error from the listing, ctx or fn
+func (fs *Fs) listBlobs(ctx context.Context, prefix string, rexp *regexp.Regexp, fn func(os.FileInfo) error) error {
+	return fs.listBlobsPaged(ctx, prefix, fs.options.ListPageSize, rexp, fn)
+}
+
+// listBlobsPaged is listBlobs asking for pageSize blobs per segment (0 lets Azure pick)
+func (fs *Fs) listBlobsPaged(ctx context.Context, prefix string, pageSize int32, rexp *regexp.Regexp, fn func(os.FileInfo) error) error {
+	containerURL := fs.serviceURL.NewContainerURL(fs.container)
+	options := azblob.ListBlobsSegmentOptions{Prefix: fs.options.RootPrefix + prefix, MaxResults: pageSize}
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		listBlob, err := listBlobsFlatSegment(ctx, clockOrReal(fs.options.Clock), fs.options.ServerTimeout, containerURL, marker, options)
+		if err != nil {
+			err = wrapStorageError(err)
+			LogError(err)
+			return err
+		}
+		marker = listBlob.NextMarker
+
+		for _, blobInfo := range listBlob.Segment.BlobItems {
+			// exclude archived blobs
+			if blobInfo.Properties.AccessTier == azblob.AccessTierArchive {
+				continue
+			}
+			// check for filter match if applicable
+			name := fs.relativeName(blobInfo.Name)
+			if rexp != nil && !rexp.Match([]byte(name)) {
+				continue
+			}
+			if err := fn(fs.listedFileInfo(name, blobInfo.Properties)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newFileInfo is NewFileInfo naming the file with the delimiter of the Fs
+func (fs *Fs) newFileInfo(name string, directory bool, sizeInBytes int64, modTime time.Time) FileInfo {
+	fi := NewFileInfo(name, directory, sizeInBytes, modTime)
+	fi.delimiter = fs.options.Delimiter
+	return fi
+}
+
+// listedFileInfo returns the FileInfo of a listed blob
+func (fs *Fs) listedFileInfo(name string, props azblob.BlobProperties) FileInfo {
+	fi := FileInfo{
+		directory:     false,
+		name:          name,
+		delimiter:     fs.options.Delimiter,
+		sizeInBytes:   *props.ContentLength,
+		modTime:       props.LastModified,
+		etag:          props.Etag,
+		blobType:      props.BlobType,
+		accessTier:    props.AccessTier,
+		archiveStatus: props.ArchiveStatus,
+		leaseStatus:   props.LeaseStatus,
+		leaseState:    props.LeaseState,
+		leaseDuration: props.LeaseDuration,
+	}
+	if props.CreationTime != nil {
+		fi.creationTime = *props.CreationTime
+	}
+	if props.AccessTierInferred != nil {
+		fi.accessTierInferred = *props.AccessTierInferred
+	}
+	if props.ContentEncoding != nil {
+		fi.contentEncoding = *props.ContentEncoding
+	}
+	if props.ContentLanguage != nil {
+		fi.contentLanguage = *props.ContentLanguage
+	}
+	return fi
+}
+
+// listBlobPrefixes returns the names of the blob prefixes right under prefix
+func (fs *Fs) listBlobPrefixes(prefix string) ([]string, error) {
+	containerURL := fs.serviceURL.NewContainerURL(fs.container)
+	options := azblob.ListBlobsSegmentOptions{Prefix: fs.options.RootPrefix + prefix, MaxResults: fs.options.ListPageSize}
+	prefixes := []string{}
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		listBlob, err := listBlobsHierarchySegment(*fs.ctx, clockOrReal(fs.options.Clock), fs.options.ServerTimeout, containerURL, marker, fs.delimiter(), options)
+		if err != nil {
+			LogError(err)
+			return nil, err
+		}
+		marker = listBlob.NextMarker
+
+		for _, blobPrefix := range listBlob.Segment.BlobPrefixes {
+			prefixes = append(prefixes, fs.relativeName(blobPrefix.Name))
+		}
+	}
+	return prefixes, nil
+}
+
 func (f *File) getBlobsInContainerFileInfoMarker(maxResults int32, prefix, filter string) (blobs []os.FileInfo, err error) {
 	// https://godoc.org/github.com/Azure/azure-storage-blob-go/azblob#ListBlobsSegmentOptions
 	// type ListBlobsSegmentOptions struct {
@@ -91,8 +278,8 @@ func (f *File) getBlobsInContainerFileInfoMarker(maxResults int32, prefix, filte
 	if maxResults > 0 {
 		options.MaxResults = maxResults
 	}
-	if prefix != "" {
-		options.Prefix = prefix
+	if prefix != "" || f.fs.options.RootPrefix != "" {
+		options.Prefix = f.fs.options.RootPrefix + prefix
 	}
 
 	var rexp *regexp.Regexp
@@ -105,8 +292,9 @@ func (f *File) getBlobsInContainerFileInfoMarker(maxResults int32, prefix, filte
 
 	containerURL := f.fs.serviceURL.NewContainerURL(f.fs.container)
 	if f.azureMarker.NotDone() {
-		listBlob, err := containerURL.ListBlobsFlatSegment(*f.fs.ctx, f.azureMarker, options)
+		listBlob, err := listBlobsFlatSegment(*f.fs.ctx, clockOrReal(f.fs.options.Clock), f.fs.options.ServerTimeout, containerURL, f.azureMarker, options)
 		if err != nil {
+			err = wrapStorageError(err)
 			LogError(err)
 			return blobs, err
 		}
@@ -163,35 +351,71 @@ func (f *File) getBlobsInContainerFileInfoMarker(maxResults int32, prefix, filte
 				continue
 			}
 			// check for filter match if applicable
-			if rexp != nil && !rexp.Match([]byte(blobInfo.Name)) {
+			name := f.fs.relativeName(blobInfo.Name)
+			if rexp != nil && !rexp.Match([]byte(name)) {
 				continue
 			}
-			fi := FileInfo{
-				directory:   false,
-				name:        blobInfo.Name,
-				sizeInBytes: *blobInfo.Properties.ContentLength,
-				modTime:     blobInfo.Properties.LastModified,
-			}
-			blobs = append(blobs, fi)
+			blobs = append(blobs, f.fs.listedFileInfo(name, blobInfo.Properties))
 		}
 	}
 
 	return blobs, nil
 }
 
+// getBlobURL returns the URL of blob, azblob percent-encodes the name so
+// characters like ' ', '#', '?' or '%' address the right blob
 func (fs *Fs) getBlobURL(blob string) azblob.BlockBlobURL {
 	containerURL := fs.serviceURL.NewContainerURL(fs.container)
-	return containerURL.NewBlockBlobURL(blob)
+	return containerURL.NewBlockBlobURL(fs.blobName(blob))
+}
+
+// blobName returns the name in the container of blob, i.e. under the RootPrefix.
+// With a RootPrefix the name is cleaned so that ".." can't leave the root.
+func (fs *Fs) blobName(blob string) string {
+	if fs.options.RootPrefix == "" {
+		return blob
+	}
+
+	clean := strings.TrimPrefix(path.Clean("/"+blob), "/")
+	if hasTrailingSlash(blob) && clean != "" {
+		clean += "/"
+	}
+	return fs.options.RootPrefix + clean
+}
+
+// relativeName returns the name of a listed blob relative to the RootPrefix
+func (fs *Fs) relativeName(blob string) string {
+	return strings.TrimPrefix(blob, fs.options.RootPrefix)
 }
 
-func (fs *Fs) blobRead(blob string, offset, count int64) (*[]byte, error) {
+// blobDownload downloads count bytes of blob from offset, or of its snapshot when one is given.
+// The body is read under ctx.
+func (fs *Fs) blobDownload(ctx context.Context, blob, snapshot string, offset, count int64, ac azblob.BlobAccessConditions) (*azblob.DownloadResponse, error) {
 	blobURL := fs.getBlobURL(blob)
-	resp, err := blobURL.Download(*fs.ctx, offset, count, azblob.BlobAccessConditions{}, false)
+	if snapshot != "" {
+		blobURL = blobURL.WithSnapshot(snapshot)
+	}
+	resp, err := blobURL.Download(ctx, offset, count, ac, false)
 	if err != nil {
+		err = wrapStorageError(err)
+		if hasServiceCode(err, azblob.ServiceCodeBlobArchived) {
+			err = &BlobArchivedError{Name: blob, err: err}
+		}
 		LogError(err)
 		return nil, err
 	}
 
+	return resp, nil
+}
+
+func (fs *Fs) blobRead(blob, snapshot string, offset, count int64, ac azblob.BlobAccessConditions) (*[]byte, error) {
+	ctx, cancel := serverContext(*fs.ctx, fs.options.ServerTimeout)
+	defer cancel()
+	resp, err := fs.blobDownload(ctx, blob, snapshot, offset, count, ac)
+	if err != nil {
+		return nil, err
+	}
+
 	result, err := ioutil.ReadAll(resp.Body(azblob.RetryReaderOptions{}))
 	if err != nil {
 		LogError(err)
@@ -206,14 +430,306 @@ func (fs *Fs) blobRead(blob string, offset, count int64) (*[]byte, error) {
 	return &result, nil
 }
 
+// blobContent returns the whole content of blob, downloading it only when it
+// changed since it was put in the content cache
+func (fs *Fs) blobContent(blob string) ([]byte, error) {
+	var ac azblob.BlobAccessConditions
+	cached := fs.content.get(blob)
+	if cached != nil {
+		ac.ModifiedAccessConditions.IfNoneMatch = cached.etag
+	}
+
+	ctx, cancel := serverContext(*fs.ctx, fs.options.ServerTimeout)
+	defer cancel()
+	blobURL := fs.getBlobURL(blob)
+	resp, err := blobURL.Download(ctx, 0, azblob.CountToEnd, ac, false)
+	if err != nil {
+		err = wrapStorageError(err)
+		var serr *StorageError
+		if cached != nil && errors.As(err, &serr) && serr.StatusCode() == http.StatusNotModified {
+			return cached.data, nil
+		}
+		LogError(err)
+		return nil, err
+	}
+
+	body := resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: transferMaxRetries})
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		LogError(err)
+		return nil, err
+	}
+
+	fs.content.put(blob, resp.ETag(), data)
+	return data, nil
+}
+
+func (fs *Fs) transferParallelism() uint16 {
+	if fs.options.Parallelism > 0 {
+		return fs.options.Parallelism
+	}
+	return transferParallelism
+}
+
+// transferSlots acquires the requests of a parallel transfer from the limiter of the Fs,
+// the transfer runs with the parallelism granted and calls release when it's done
+func (fs *Fs) transferSlots() (parallelism uint16, release func()) {
+	n := fs.limiter.acquire(int(fs.transferParallelism()))
+	return uint16(n), func() { fs.limiter.release(n) }
+}
+
+func (fs *Fs) blobDownloadToFile(blob string, file *os.File) error {
+	parallelism, release := fs.transferSlots()
+	defer release()
+	blobURL := fs.getBlobURL(blob)
+	options := azblob.DownloadFromBlobOptions{
+		Parallelism:                parallelism,
+		RetryReaderOptionsPerBlock: azblob.RetryReaderOptions{MaxRetryRequests: transferMaxRetries},
+	}
+	err := azblob.DownloadBlobToFile(*fs.ctx, blobURL.BlobURL, 0, azblob.CountToEnd, file, options)
+	return wrapStorageError(err)
+}
+
+func (fs *Fs) blobUploadFromFile(ctx context.Context, blob string, file *os.File, headers azblob.BlobHTTPHeaders, metadata azblob.Metadata) error {
+	parallelism, release := fs.transferSlots()
+	defer release()
+	blobURL := fs.getBlobURL(blob)
+	options := azblob.UploadToBlockBlobOptions{
+		BlockSize:       fs.options.BlockSize,
+		Parallelism:     parallelism,
+		BlobHTTPHeaders: headers,
+		Metadata:        metadata,
+	}
+	_, err := azblob.UploadFileToBlockBlob(ctx, file, blobURL, options)
+	if err == nil {
+		fs.negative.forget(blob)
+	}
+	return wrapImmutableError(blob, wrapStorageError(commitError(ctx, err)))
+}
+
+// createTempFileRetry - creates a temporary file in dir with the retry mechanism of the cache
+// files, waiting on clock between the attempts
+func createTempFileRetry(clock Clock, dir string, maxAttempts int) (*os.File, error) {
+	file, err := ioutil.TempFile(dir, "azrblob-")
+	for attempts := 0; err != nil && attempts < maxAttempts; attempts++ {
+		LogDebug(fmt.Sprintf("unable to create temporary file in %s on attempt %d due to %s", dir, attempts+1, err.Error()))
+		clock.Sleep(time.Second * secFileOpRetrySleep)
+		file, err = ioutil.TempFile(dir, "azrblob-")
+	}
+	return file, err
+}
+
+// commitContext returns the context of the commits made on Close, bounded by CommitTimeout
+func (fs *Fs) commitContext() (context.Context, context.CancelFunc) {
+	if fs.options.CommitTimeout > 0 {
+		return context.WithTimeout(*fs.ctx, fs.options.CommitTimeout)
+	}
+	return context.WithCancel(*fs.ctx)
+}
+
+// commitError returns the context error when the commit ran out of time, so that
+// errors.Is(err, context.DeadlineExceeded) holds whatever the pipeline made of it
+func commitError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (fs *Fs) blobUploadBuffer(blob string, buffer []byte, headers azblob.BlobHTTPHeaders, metadata azblob.Metadata) error {
+	ctx, cancel := fs.commitContext()
+	defer cancel()
+	parallelism, release := fs.transferSlots()
+	defer release()
+	blobURL := fs.getBlobURL(blob)
+	options := azblob.UploadToBlockBlobOptions{
+		BlockSize:       fs.options.BlockSize,
+		Parallelism:     parallelism,
+		BlobHTTPHeaders: headers,
+		Metadata:        metadata,
+	}
+	_, err := azblob.UploadBufferToBlockBlob(ctx, buffer, blobURL, options)
+	if err == nil {
+		fs.negative.forget(blob)
+	}
+	return wrapImmutableError(blob, wrapStorageError(commitError(ctx, err)))
+}
+
 func (fs *Fs) blobStageBlock(blob, base64BlockID string, p *[]byte) (*azblob.BlockBlobStageBlockResponse, error) {
 	blobURL := fs.getBlobURL(blob)
-	return blobURL.StageBlock(*fs.ctx, base64BlockID, bytes.NewReader(*p), azblob.LeaseAccessConditions{}, nil)
+	resp, err := blobURL.StageBlock(*fs.ctx, base64BlockID, bytes.NewReader(*p), azblob.LeaseAccessConditions{}, nil)
+	return resp, wrapStorageError(err)
 }
 
-func (fs *Fs) blobCommitBlockList(blob string, base64BlockIDs *[]string) (*azblob.BlockBlobCommitBlockListResponse, error) {
+func (fs *Fs) blobCommitBlockList(blob string, base64BlockIDs *[]string, headers azblob.BlobHTTPHeaders, metadata azblob.Metadata) (*azblob.BlockBlobCommitBlockListResponse, error) {
+	commitCtx, cancel := fs.commitContext()
+	defer cancel()
+	// only the Put Block List request gets the ServerTimeout, see serverContext
+	ctx, cancelRequest := serverContext(commitCtx, fs.options.ServerTimeout)
+	defer cancelRequest()
 	blobURL := fs.getBlobURL(blob)
-	return blobURL.CommitBlockList(*fs.ctx, *base64BlockIDs, azblob.BlobHTTPHeaders{}, nil, azblob.BlobAccessConditions{})
+	resp, err := blobURL.CommitBlockList(ctx, *base64BlockIDs, headers, metadata, azblob.BlobAccessConditions{})
+	if err == nil {
+		fs.negative.forget(blob)
+	}
+	return resp, wrapImmutableError(blob, wrapStorageError(commitError(ctx, err)))
+}
+
+// clearStagedBlocks recommits the committed block list of blob with its HTTP headers and
+// metadata, which drops its uncommitted blocks. Blobs that don't exist, or weren't
+// committed from blocks, are left alone: clearing would create or empty them.
+func (fs *Fs) clearStagedBlocks(blob string) error {
+	blobURL := fs.getBlobURL(blob)
+	props, err := blobURL.GetProperties(*fs.ctx, azblob.BlobAccessConditions{})
+	if hasServiceCode(wrapStorageError(err), azblob.ServiceCodeBlobNotFound) {
+		return nil
+	}
+	if err != nil {
+		err = wrapStorageError(err)
+		LogError(err)
+		return err
+	}
+
+	blockList, err := blobURL.GetBlockList(*fs.ctx, azblob.BlockListCommitted, azblob.LeaseAccessConditions{})
+	if err != nil {
+		err = wrapStorageError(err)
+		LogError(err)
+		return err
+	}
+	if len(blockList.CommittedBlocks) == 0 && props.ContentLength() > 0 {
+		return nil
+	}
+	base64BlockIDs := make([]string, len(blockList.CommittedBlocks))
+	for i, block := range blockList.CommittedBlocks {
+		base64BlockIDs[i] = block.Name
+	}
+
+	// a blob committed again in between has no uncommitted blocks left either
+	ac := azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: props.ETag()}}
+	_, err = blobURL.CommitBlockList(*fs.ctx, base64BlockIDs, props.NewHTTPHeaders(), props.NewMetadata(), ac)
+	if err != nil && !hasServiceCode(wrapStorageError(err), azblob.ServiceCodeConditionNotMet) {
+		err = wrapImmutableError(blob, wrapStorageError(err))
+		LogError(err)
+		return err
+	}
+
+	return nil
+}
+
+// truncateBlockBlob shrinks blob to size by committing the blocks it keeps, the part
+// of a block it cuts is downloaded and staged again in blocks of FsOptions.BlockSize
+// (4MB by default), so that no more is held in memory. The HTTP headers, metadata and
+// explicitly set tier of blob are read first and re-applied (except the MD5), they would
+// otherwise be dropped by the commit, which fails when blob changed in between.
+func (fs *Fs) truncateBlockBlob(blob string, size int64) error {
+	blobURL := fs.getBlobURL(blob)
+	props, err := blobURL.GetProperties(*fs.ctx, azblob.BlobAccessConditions{})
+	if err != nil {
+		err = wrapStorageError(err)
+		LogError(err)
+		return err
+	}
+	if size == props.ContentLength() {
+		return nil
+	}
+	if size > props.ContentLength() {
+		LogError(ErrNotImplemented)
+		return ErrNotImplemented
+	}
+
+	blockList, err := blobURL.GetBlockList(*fs.ctx, azblob.BlockListCommitted, azblob.LeaseAccessConditions{})
+	if err != nil {
+		err = wrapStorageError(err)
+		LogError(err)
+		return err
+	}
+	var (
+		base64BlockIDs []string
+		kept           int64
+	)
+	for _, block := range blockList.CommittedBlocks {
+		if kept+int64(block.Size) > size {
+			break
+		}
+		base64BlockIDs = append(base64BlockIDs, block.Name)
+		kept += int64(block.Size)
+	}
+
+	blockSize := fs.options.BlockSize
+	if blockSize <= 0 {
+		blockSize = writerBlockSize
+	} else if blockSize > azblob.BlockBlobMaxStageBlockBytes {
+		blockSize = azblob.BlockBlobMaxStageBlockBytes
+	}
+	ac := azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: props.ETag()}}
+	for kept < size {
+		count := size - kept
+		if count > blockSize {
+			count = blockSize
+		}
+		data, err := fs.blobRead(blob, "", kept, count, ac)
+		if err != nil {
+			return err
+		}
+		base64BlockID := newBase64BlockID()
+		if _, err := fs.blobStageBlock(blob, base64BlockID, data); err != nil {
+			LogError(err)
+			return err
+		}
+		base64BlockIDs = append(base64BlockIDs, base64BlockID)
+		kept += count
+	}
+
+	// the MD5 of the blob is the one of its longer content, it is dropped like on any commit
+	headers := props.NewHTTPHeaders()
+	headers.ContentMD5 = nil
+	_, err = blobURL.CommitBlockList(*fs.ctx, base64BlockIDs, headers, props.NewMetadata(), ac)
+	if err != nil {
+		err = wrapImmutableError(blob, wrapStorageError(err))
+		LogError(err)
+		return err
+	}
+	if tier := azblob.AccessTierType(props.AccessTier()); tier != "" && props.AccessTierInferred() != "true" {
+		return fs.setBlobTier(blob, tier)
+	}
+
+	return nil
+}
+
+func (fs *Fs) setBlobHTTPHeaders(blob string, headers azblob.BlobHTTPHeaders) error {
+	blobURL := fs.getBlobURL(blob)
+	_, err := blobURL.SetHTTPHeaders(*fs.ctx, headers, azblob.BlobAccessConditions{})
+	if err != nil {
+		err = wrapStorageError(err)
+		LogError(err)
+	}
+
+	return err
+}
+
+// setCommittedTier sets tier, or FsOptions.DefaultAccessTier when it's "", on the
+// block blob just committed
+func (fs *Fs) setCommittedTier(blob string, tier azblob.AccessTierType) error {
+	if tier == "" {
+		tier = fs.options.DefaultAccessTier
+	}
+	if tier == "" {
+		return nil
+	}
+
+	return fs.setBlobTier(blob, tier)
+}
+
+func (fs *Fs) setBlobTier(blob string, tier azblob.AccessTierType) error {
+	blobURL := fs.getBlobURL(blob)
+	_, err := blobURL.SetTier(*fs.ctx, tier, azblob.LeaseAccessConditions{})
+	if err != nil {
+		err = wrapStorageError(err)
+		LogError(err)
+	}
+
+	return err
 }
 
 func (fs *Fs) getContainerFileInfo() (*FileInfo, error) {
@@ -221,78 +737,376 @@ func (fs *Fs) getContainerFileInfo() (*FileInfo, error) {
 	containerURL := fs.serviceURL.NewContainerURL(fs.container)
 	contProps, err := containerURL.GetProperties(*fs.ctx, azblob.LeaseAccessConditions{})
 	if err != nil {
+		err = wrapStorageError(err)
 		LogError(err)
 		return &result, err
 	}
 
+	// the container root is a directory of size 0, see FileInfo.Size
 	result.directory = true
 	result.name = fs.container
 	result.modTime = contProps.LastModified()
 
 	return &result, nil
 }
+func (fs *Fs) getContainerImmutability() (legalHold, immutabilityPolicy bool, err error) {
+	containerURL := fs.serviceURL.NewContainerURL(fs.container)
+	contProps, err := containerURL.GetProperties(*fs.ctx, azblob.LeaseAccessConditions{})
+	if err != nil {
+		err = wrapStorageError(err)
+		LogError(err)
+		return false, false, err
+	}
+
+	return contProps.HasLegalHold() == "true", contProps.HasImmutabilityPolicy() == "true", nil
+}
+
 func (fs *Fs) getBlobFileInfo(blob string) (*FileInfo, error) {
 	var result FileInfo
 
-	if strings.ContainsAny(blob, "*?") {
-		// result.directory = false
-		// does this trigger read dir all?
-		result.directory = true
-		// result.name = "/" + container + "/" + blob
-		result.name = blob
-		result.sizeInBytes = -1
-		result.modTime = time.Now()
+	blobURL := fs.getBlobURL(blob)
+	blobProps, err := blobURL.GetProperties(*fs.ctx, azblob.BlobAccessConditions{})
+	if err != nil {
+		err = wrapStorageError(err)
 
-		return &result, nil
+		// names with wildcards that aren't an actual blob (names may contain '?') are listings
+		if strings.ContainsAny(blob, "*?") && hasServiceCode(err, azblob.ServiceCodeBlobNotFound) {
+			return &result, &os.PathError{Op: "stat", Path: blob, Err: ErrWildcard}
+		}
+
+		LogError(err)
+		return &result, err
+	}
+
+	return fs.propertiesFileInfo(blob, blobProps), nil
+}
+
+// propertiesFileInfo returns the FileInfo of blob from its properties
+func (fs *Fs) propertiesFileInfo(blob string, blobProps *azblob.BlobGetPropertiesResponse) *FileInfo {
+	return &FileInfo{
+		directory:       false,
+		name:            blob,
+		delimiter:       fs.options.Delimiter,
+		sizeInBytes:     blobProps.ContentLength(),
+		modTime:         blobProps.LastModified(),
+		creationTime:    blobProps.CreationTime(),
+		contentEncoding: blobProps.ContentEncoding(),
+		contentLanguage: blobProps.ContentLanguage(),
+		etag:            blobProps.ETag(),
+		blobType:        blobProps.BlobType(),
+
+		accessTier:         azblob.AccessTierType(blobProps.AccessTier()),
+		accessTierInferred: blobProps.AccessTierInferred() == "true",
+		archiveStatus:      azblob.ArchiveStatusType(blobProps.ArchiveStatus()),
+
+		leaseStatus:   blobProps.LeaseStatus(),
+		leaseState:    blobProps.LeaseState(),
+		leaseDuration: blobProps.LeaseDuration(),
+	}
+}
+
+// getSnapshotFileInfo returns the FileInfo of a snapshot of blob
+func (fs *Fs) getSnapshotFileInfo(blob, snapshot string) (*FileInfo, error) {
+	blobURL := fs.getBlobURL(blob).WithSnapshot(snapshot)
+	blobProps, err := blobURL.GetProperties(*fs.ctx, azblob.BlobAccessConditions{})
+	if err != nil {
+		err = wrapStorageError(err)
+		LogError(err)
+		return nil, err
 	}
 
+	return fs.propertiesFileInfo(blob, blobProps), nil
+}
+
+// blobExists reports whether blob exists, a missing blob isn't an error
+func (fs *Fs) blobExists(ctx context.Context, blob string) (bool, error) {
+	blobURL := fs.getBlobURL(blob)
+	_, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{})
+	if err != nil {
+		err = wrapStorageError(err)
+		if hasServiceCode(err, azblob.ServiceCodeBlobNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (fs *Fs) getBlobMD5(blob string) ([]byte, error) {
 	blobURL := fs.getBlobURL(blob)
 	blobProps, err := blobURL.GetProperties(*fs.ctx, azblob.BlobAccessConditions{})
 	if err != nil {
+		err = wrapStorageError(err)
 		LogError(err)
-		return &result, err
+		return nil, err
 	}
 
-	result.directory = false
-	// result.name = "/" + container + "/" + blob
-	result.name = blob
-	result.sizeInBytes = blobProps.ContentLength()
-	result.modTime = blobProps.LastModified()
+	return blobProps.ContentMD5(), nil
+}
 
-	return &result, nil
+// appendBlock appends data to the append blob, creating it first with headers and
+// metadata when it doesn't exist and create is set, and returns the offset the data
+// was appended at
+func (fs *Fs) appendBlock(blob string, data []byte, conditions azblob.AppendPositionAccessConditions, create bool, headers azblob.BlobHTTPHeaders, metadata azblob.Metadata) (int64, error) {
+	appendBlobURL := fs.serviceURL.NewContainerURL(fs.container).NewAppendBlobURL(fs.blobName(blob))
+	ac := azblob.AppendBlobAccessConditions{AppendPositionAccessConditions: conditions}
+	resp, err := appendBlobURL.AppendBlock(*fs.ctx, bytes.NewReader(data), ac, nil)
+	if create && hasServiceCode(wrapStorageError(err), azblob.ServiceCodeBlobNotFound) {
+		if err := fs.createAppendBlob(blob, headers, metadata, false); err != nil {
+			return 0, err
+		}
+		resp, err = appendBlobURL.AppendBlock(*fs.ctx, bytes.NewReader(data), ac, nil)
+	}
+	if err != nil {
+		err = wrapAppendPositionError(blob, wrapStorageError(err))
+		LogError(err)
+		return 0, err
+	}
+	fs.negative.forget(blob)
+
+	return strconv.ParseInt(resp.BlobAppendOffset(), 10, 64)
+}
+
+// createAppendBlob creates an empty append blob, an existing blob is replaced only when
+// asked: otherwise another appender may create it first, which is fine
+func (fs *Fs) createAppendBlob(blob string, headers azblob.BlobHTTPHeaders, metadata azblob.Metadata, replace bool) error {
+	var ac azblob.BlobAccessConditions
+	if !replace {
+		ac.ModifiedAccessConditions.IfNoneMatch = azblob.ETagAny
+	}
+	appendBlobURL := fs.serviceURL.NewContainerURL(fs.container).NewAppendBlobURL(fs.blobName(blob))
+	_, err := appendBlobURL.Create(*fs.ctx, headers, metadata, ac)
+	if err != nil && !hasServiceCode(wrapStorageError(err), azblob.ServiceCodeBlobAlreadyExists) {
+		err = wrapImmutableError(blob, wrapStorageError(err))
+		LogError(err)
+		return err
+	}
+	fs.negative.forget(blob)
+
+	return nil
+}
+
+func (fs *Fs) getPageBlobURL(blob string) azblob.PageBlobURL {
+	return fs.serviceURL.NewContainerURL(fs.container).NewPageBlobURL(fs.blobName(blob))
+}
+
+func (fs *Fs) createPageBlob(blob string, size, sequenceNumber int64, headers azblob.BlobHTTPHeaders, metadata azblob.Metadata) error {
+	_, err := fs.getPageBlobURL(blob).Create(*fs.ctx, size, sequenceNumber, headers, metadata, azblob.BlobAccessConditions{})
+	if err != nil {
+		err = wrapImmutableError(blob, wrapStorageError(err))
+		LogError(err)
+	} else {
+		fs.negative.forget(blob)
+	}
+
+	return err
+}
+
+// resizePageBlob changes the size of the page blob, the pages past the end are dropped
+func (fs *Fs) resizePageBlob(blob string, size int64) error {
+	_, err := fs.getPageBlobURL(blob).Resize(*fs.ctx, size, azblob.BlobAccessConditions{})
+	if err != nil {
+		err = wrapImmutableError(blob, wrapStorageError(err))
+		LogError(err)
+	}
+
+	return err
+}
+
+// writePages writes data at offset of the page blob when its sequence number meets the conditions,
+// then increments the sequence number when asked unless the blob was written again in between
+func (fs *Fs) writePages(blob string, offset int64, data []byte, options PageWriteOptions) (int64, error) {
+	pageBlobURL := fs.getPageBlobURL(blob)
+	ac := azblob.PageBlobAccessConditions{SequenceNumberAccessConditions: options.Conditions}
+	resp, err := pageBlobURL.UploadPages(*fs.ctx, offset, bytes.NewReader(data), ac, nil)
+	if err != nil {
+		err = wrapSequenceNumberError(blob, wrapStorageError(err))
+		LogError(err)
+		return 0, err
+	}
+	if !options.IncrementSequenceNumber {
+		return resp.BlobSequenceNumber(), nil
+	}
+
+	return fs.updateSequenceNumber(blob, azblob.SequenceNumberActionIncrement, 0, azblob.ModifiedAccessConditions{IfMatch: resp.ETag()})
+}
+
+func (fs *Fs) updateSequenceNumber(blob string, action azblob.SequenceNumberActionType, sequenceNumber int64, mac azblob.ModifiedAccessConditions) (int64, error) {
+	resp, err := fs.getPageBlobURL(blob).UpdateSequenceNumber(*fs.ctx, action, sequenceNumber, azblob.BlobAccessConditions{ModifiedAccessConditions: mac})
+	if err != nil {
+		err = wrapStorageError(err)
+		LogError(err)
+		return 0, err
+	}
+
+	return resp.BlobSequenceNumber(), nil
 }
 
 func (fs *Fs) deleteBlob(blob string) error {
+	return fs.deleteBlobIf(blob, azblob.BlobAccessConditions{})
+}
+
+func (fs *Fs) deleteBlobIf(blob string, conditions azblob.BlobAccessConditions) error {
 	blobURL := fs.getBlobURL(blob)
-	_, err := blobURL.Delete(*fs.ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	_, err := blobURL.Delete(*fs.ctx, azblob.DeleteSnapshotsOptionNone, conditions)
 	if err != nil {
+		err = wrapImmutableError(blob, wrapStorageError(err))
 		LogError(err)
 	}
 
 	return err
 }
 
+// copyBlob copies srcBlob into dstBlob, and checks the copy when FsOptions.VerifyCopies is set
 func (fs *Fs) copyBlob(srcBlob, dstBlob string) error {
-	srcBlobURL := fs.getBlobURL(srcBlob)
+	return fs.copyBlobIf(srcBlob, dstBlob, azblob.BlobAccessConditions{})
+}
+
+// copyBlobIf is copyBlob when dstBlob meets conditions
+func (fs *Fs) copyBlobIf(srcBlob, dstBlob string, conditions azblob.BlobAccessConditions) error {
+	err := fs.copyFromURLIf(fs.getBlobURL(srcBlob).URL(), dstBlob, conditions)
+	if err != nil || !fs.options.VerifyCopies {
+		return err
+	}
+
+	return fs.verifyCopy(srcBlob, dstBlob)
+}
+
+// verifyCopy compares the length and MD5 of dstBlob with srcBlob, hashing their
+// content when either has no stored MD5. A copy that doesn't match is deleted.
+func (fs *Fs) verifyCopy(srcBlob, dstBlob string) error {
+	srcProps, err := fs.getBlobURL(srcBlob).GetProperties(*fs.ctx, azblob.BlobAccessConditions{})
+	if err != nil {
+		err = wrapStorageError(err)
+		LogError(err)
+		return err
+	}
+	dstProps, err := fs.getBlobURL(dstBlob).GetProperties(*fs.ctx, azblob.BlobAccessConditions{})
+	if err != nil {
+		err = wrapStorageError(err)
+		LogError(err)
+		return err
+	}
+
+	match := srcProps.ContentLength() == dstProps.ContentLength()
+	if match {
+		srcMD5, dstMD5 := srcProps.ContentMD5(), dstProps.ContentMD5()
+		if len(srcMD5) == 0 || len(dstMD5) == 0 {
+			if srcMD5, err = fs.hashBlob(srcBlob); err != nil {
+				return err
+			}
+			if dstMD5, err = fs.hashBlob(dstBlob); err != nil {
+				return err
+			}
+		}
+		match = bytes.Equal(srcMD5, dstMD5)
+	}
+	if match {
+		return nil
+	}
+
+	err = &os.LinkError{Op: "verify", Old: srcBlob, New: dstBlob, Err: ErrCopyVerificationFailed}
+	LogError(err)
+	if delErr := fs.deleteBlob(dstBlob); delErr != nil {
+		LogError(delErr)
+	}
+
+	return err
+}
+
+// hashBlob downloads blob and returns the MD5 of its content
+func (fs *Fs) hashBlob(blob string) ([]byte, error) {
+	resp, err := fs.blobDownload(*fs.ctx, blob, "", 0, azblob.CountToEnd, azblob.BlobAccessConditions{})
+	if err != nil {
+		return nil, err
+	}
+	body := resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: transferMaxRetries})
+	defer body.Close()
+
+	hash := md5.New()
+	if _, err = io.Copy(hash, body); err != nil {
+		err = &os.PathError{Op: "read", Path: blob, Err: err}
+		LogError(err)
+		return nil, err
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// copyFromURL has Azure copy srcURL (a blob of this account or any URL it can
+// read) into dstBlob and waits for the copy to complete
+func (fs *Fs) copyFromURL(srcURL url.URL, dstBlob string) error {
+	return fs.copyFromURLIf(srcURL, dstBlob, azblob.BlobAccessConditions{})
+}
+
+// copyFromURLIf is copyFromURL when dstBlob meets conditions
+func (fs *Fs) copyFromURLIf(srcURL url.URL, dstBlob string, conditions azblob.BlobAccessConditions) error {
 	dstBlobURL := fs.getBlobURL(dstBlob)
-	startCopy, err := dstBlobURL.StartCopyFromURL(*fs.ctx, srcBlobURL.URL(), nil, azblob.ModifiedAccessConditions{}, azblob.BlobAccessConditions{})
+	startCopy, err := dstBlobURL.StartCopyFromURL(*fs.ctx, srcURL, nil, azblob.ModifiedAccessConditions{}, conditions)
 	if err != nil {
+		err = wrapStorageError(err)
 		LogError(err)
 		return err
 	}
 
-	copyStatus := startCopy.CopyStatus()
+	// the copy may exist even when it failed
+	fs.negative.forget(dstBlob)
+	_, err = fs.waitForCopy(dstBlobURL.BlobURL, dstBlob, startCopy.CopyStatus())
+	return err
+}
+
+// copyIncremental has Azure incrementally copy the page blob snapshot at srcURL
+// into the page blob dstBlob, waits for the copy to complete and returns the
+// snapshot of dstBlob it created
+func (fs *Fs) copyIncremental(srcURL url.URL, snapshot, dstBlob string) (string, error) {
+	dstBlobURL := fs.getPageBlobURL(dstBlob)
+	startCopy, err := dstBlobURL.StartCopyIncremental(*fs.ctx, srcURL, snapshot, azblob.BlobAccessConditions{})
+	if err != nil {
+		err = wrapStorageError(err)
+		LogError(err)
+		return "", err
+	}
+
+	fs.negative.forget(dstBlob)
+	props, err := fs.waitForCopy(dstBlobURL.BlobURL, dstBlob, startCopy.CopyStatus())
+	if err != nil {
+		return "", err
+	}
+	if props == nil {
+		props, err = dstBlobURL.GetProperties(*fs.ctx, azblob.BlobAccessConditions{})
+		if err != nil {
+			err = wrapStorageError(err)
+			LogError(err)
+			return "", err
+		}
+	}
+
+	return props.DestinationSnapshot(), nil
+}
+
+// waitForCopy polls the properties of dstBlobURL while its copy is pending, the
+// last properties read are returned (nil when the copy wasn't pending)
+func (fs *Fs) waitForCopy(dstBlobURL azblob.BlobURL, dstBlob string, copyStatus azblob.CopyStatusType) (*azblob.BlobGetPropertiesResponse, error) {
+	var props *azblob.BlobGetPropertiesResponse
 	for copyStatus == azblob.CopyStatusPending {
-		time.Sleep(time.Second * 2)
+		clockOrReal(fs.options.Clock).Sleep(time.Second * 2)
 		getMetadata, err := dstBlobURL.GetProperties(*fs.ctx, azblob.BlobAccessConditions{})
 		if err != nil {
+			err = wrapStorageError(err)
 			LogError(err)
-			return err
+			return nil, err
 		}
+		props = getMetadata
 		copyStatus = getMetadata.CopyStatus()
+		if copyStatus == azblob.CopyStatusFailed || copyStatus == azblob.CopyStatusAborted {
+			err = fmt.Errorf("copy to %s %s: %s", dstBlob, copyStatus, getMetadata.CopyStatusDescription())
+			LogError(err)
+			return nil, err
+		}
 	}
 
-	return nil
+	return props, nil
 }
 
 func (fs *Fs) renameBlob(oldName, newName string) error {
@@ -0,0 +1,51 @@
+package azrblob
+
+import "sync"
+
+// concurrencyLimiter caps the requests in flight for the bulk and parallel operations
+// of an Fs and its copies, see FsOptions.MaxConcurrency. Its methods do nothing on a
+// nil limiter.
+type concurrencyLimiter struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	max  int
+	used int
+}
+
+func newConcurrencyLimiter(max int) *concurrencyLimiter {
+	cl := &concurrencyLimiter{max: max}
+	cl.cond = sync.NewCond(&cl.mu)
+	return cl
+}
+
+// acquire waits until n requests can be made, no more than the maximum, and returns
+// how many were granted. They are granted at once so that operations needing several
+// can't each hold part of them and wait for the rest.
+func (cl *concurrencyLimiter) acquire(n int) int {
+	if cl == nil {
+		return n
+	}
+	if n > cl.max {
+		n = cl.max
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for cl.used+n > cl.max {
+		cl.cond.Wait()
+	}
+	cl.used += n
+	return n
+}
+
+// release gives back n requests granted by acquire
+func (cl *concurrencyLimiter) release(n int) {
+	if cl == nil {
+		return
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.used -= n
+	cl.cond.Broadcast()
+}
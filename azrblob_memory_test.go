@@ -0,0 +1,967 @@
+package azrblob
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/google/uuid"
+)
+
+// memoryService - an in memory emulation of the Blob service operations used by this package
+type memoryService struct {
+	mu         sync.Mutex
+	containers map[string]*memoryContainer
+	sequence   int64
+}
+
+type memoryContainer struct {
+	modified    time.Time
+	etag        string
+	blobs       map[string]*memoryBlob
+	uncommitted map[string]map[string][]byte
+	snapshots   map[string]map[string]*memoryBlob
+}
+
+type memoryBlob struct {
+	data     []byte
+	blocks   map[string][]byte
+	blockIDs []string
+	blobType azblob.BlobType
+	sequence int64
+	tier     azblob.AccessTierType
+	tierSet  bool
+	archive  azblob.ArchiveStatusType
+	lease    memoryLease
+	headers  azblob.BlobHTTPHeaders
+	metadata map[string]string
+	etag     string
+	created  time.Time
+	modified time.Time
+}
+
+// newMemoryTransport returns an http.RoundTripper that serves the Blob service requests made by
+// this package from memory, so the tests can run without a storage account. Build the
+// pipeline with azblob.NewAnonymousCredential() and NewHTTPClientSender(&http.Client{Transport: t});
+// the account name in the service URL is not checked. Each transport holds its own containers.
+func newMemoryTransport() http.RoundTripper {
+	return &memoryService{containers: make(map[string]*memoryContainer)}
+}
+
+// RoundTrip - dispatch the request on the container/blob path, the comp query and the method
+func (ms *memoryService) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	query := req.URL.Query()
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)
+	switch {
+	case parts[0] == "" && query.Get("comp") == "list":
+		return ms.listContainers(req), nil
+	case len(parts) == 1 && query.Get("restype") == "container":
+		return ms.container(req, parts[0]), nil
+	case len(parts) == 2 && parts[1] != "":
+		container, ok := ms.containers[parts[0]]
+		if !ok {
+			return ms.error(req, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist."), nil
+		}
+		return ms.blob(req, container, parts[1], body), nil
+	}
+	return ms.error(req, http.StatusBadRequest, "InvalidUri", "The requested URI does not represent any resource on the server."), nil
+}
+
+func (ms *memoryService) nextETag() string {
+	ms.sequence++
+	return fmt.Sprintf("\"0x%X\"", time.Now().UnixNano()+ms.sequence)
+}
+
+func (ms *memoryService) container(req *http.Request, name string) *http.Response {
+	container, ok := ms.containers[name]
+	switch {
+	case req.Method == http.MethodPut && ok:
+		return ms.error(req, http.StatusConflict, "ContainerAlreadyExists", "The specified container already exists.")
+	case req.Method == http.MethodPut:
+		ms.containers[name] = &memoryContainer{
+			modified:    time.Now().UTC(),
+			etag:        ms.nextETag(),
+			blobs:       make(map[string]*memoryBlob),
+			uncommitted: make(map[string]map[string][]byte),
+			snapshots:   make(map[string]map[string]*memoryBlob),
+		}
+		return ms.respond(req, http.StatusCreated, nil, nil)
+	case !ok:
+		return ms.error(req, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+	case req.Method == http.MethodDelete:
+		delete(ms.containers, name)
+		return ms.respond(req, http.StatusAccepted, nil, nil)
+	case req.URL.Query().Get("comp") == "list":
+		return ms.listBlobs(req, name, container)
+	case req.Method == http.MethodGet || req.Method == http.MethodHead:
+		header := http.Header{}
+		header.Set("Last-Modified", container.modified.Format(http.TimeFormat))
+		header.Set("ETag", container.etag)
+		header.Set("x-ms-has-immutability-policy", "false")
+		header.Set("x-ms-has-legal-hold", "false")
+		return ms.respond(req, http.StatusOK, header, nil)
+	}
+	return ms.error(req, http.StatusBadRequest, "UnsupportedHttpVerb", "The resource doesn't support the specified HTTP verb.")
+}
+
+type memoryContainerList struct {
+	XMLName    xml.Name     `xml:"EnumerationResults"`
+	Containers []memoryName `xml:"Containers>Container"`
+	NextMarker string       `xml:"NextMarker"`
+}
+
+type memoryName struct {
+	Name string `xml:"Name"`
+}
+
+func (ms *memoryService) listContainers(req *http.Request) *http.Response {
+	names := make([]string, 0, len(ms.containers))
+	for name := range ms.containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := memoryContainerList{}
+	for _, name := range names {
+		list.Containers = append(list.Containers, memoryName{Name: name})
+	}
+	return ms.respondXML(req, list)
+}
+
+type memoryBlobList struct {
+	XMLName    xml.Name         `xml:"EnumerationResults"`
+	Container  string           `xml:"ContainerName,attr"`
+	Prefix     string           `xml:"Prefix"`
+	Marker     string           `xml:"Marker"`
+	Delimiter  string           `xml:"Delimiter,omitempty"`
+	Prefixes   []memoryName     `xml:"Blobs>BlobPrefix"`
+	Blobs      []memoryBlobItem `xml:"Blobs>Blob"`
+	NextMarker string           `xml:"NextMarker"`
+}
+
+type memoryBlobItem struct {
+	Name            string `xml:"Name"`
+	CreationTime    string `xml:"Properties>Creation-Time"`
+	LastModified    string `xml:"Properties>Last-Modified"`
+	Etag            string `xml:"Properties>Etag"`
+	ContentLength   int64  `xml:"Properties>Content-Length"`
+	ContentType     string `xml:"Properties>Content-Type"`
+	ContentEncoding string `xml:"Properties>Content-Encoding"`
+	ContentLanguage string `xml:"Properties>Content-Language"`
+	ContentMD5      string `xml:"Properties>Content-MD5"`
+	BlobType        string `xml:"Properties>BlobType"`
+	AccessTier      string `xml:"Properties>AccessTier"`
+	TierInferred    bool   `xml:"Properties>AccessTierInferred,omitempty"`
+	ArchiveStatus   string `xml:"Properties>ArchiveStatus,omitempty"`
+	LeaseStatus     string `xml:"Properties>LeaseStatus"`
+	LeaseState      string `xml:"Properties>LeaseState"`
+	LeaseDuration   string `xml:"Properties>LeaseDuration,omitempty"`
+}
+
+func (ms *memoryService) listBlobs(req *http.Request, name string, container *memoryContainer) *http.Response {
+	query := req.URL.Query()
+	prefix := query.Get("prefix")
+	marker := query.Get("marker")
+	maxResults := 5000
+	if s := query.Get("maxresults"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			maxResults = n
+		}
+	}
+
+	// with a delimiter the blobs below it are rolled up into a single prefix
+	delimiter := query.Get("delimiter")
+	prefixes := make(map[string]bool)
+	names := make([]string, 0, len(container.blobs))
+	for blobName := range container.blobs {
+		if !strings.HasPrefix(blobName, prefix) {
+			continue
+		}
+		if i := strings.Index(blobName[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			blobPrefix := blobName[:len(prefix)+i+len(delimiter)]
+			if !prefixes[blobPrefix] && blobPrefix >= marker {
+				names = append(names, blobPrefix)
+			}
+			prefixes[blobPrefix] = true
+		} else if blobName >= marker {
+			names = append(names, blobName)
+		}
+	}
+	sort.Strings(names)
+
+	list := memoryBlobList{Container: name, Prefix: prefix, Marker: marker, Delimiter: delimiter}
+	for i, blobName := range names {
+		if i == maxResults {
+			list.NextMarker = blobName
+			break
+		}
+		if prefixes[blobName] {
+			list.Prefixes = append(list.Prefixes, memoryName{Name: blobName})
+			continue
+		}
+		blob := container.blobs[blobName]
+		list.Blobs = append(list.Blobs, memoryBlobItem{
+			Name:            blobName,
+			CreationTime:    blob.created.Format(http.TimeFormat),
+			LastModified:    blob.modified.Format(http.TimeFormat),
+			Etag:            blob.etag,
+			ContentLength:   int64(len(blob.data)),
+			ContentType:     blob.headers.ContentType,
+			ContentEncoding: blob.headers.ContentEncoding,
+			ContentLanguage: blob.headers.ContentLanguage,
+			ContentMD5:      base64.StdEncoding.EncodeToString(blob.headers.ContentMD5),
+			BlobType:        string(blob.blobType),
+			AccessTier:      string(blob.tier),
+			TierInferred:    !blob.tierSet,
+			ArchiveStatus:   string(blob.archive),
+			LeaseStatus:     string(blob.lease.status()),
+			LeaseState:      string(blob.lease.state()),
+			LeaseDuration:   string(blob.lease.duration()),
+		})
+	}
+	return ms.respondXML(req, list)
+}
+
+func (ms *memoryService) blob(req *http.Request, container *memoryContainer, name string, body []byte) *http.Response {
+	blob := container.blobs[name]
+	comp := req.URL.Query().Get("comp")
+
+	// blocks are staged without conditions
+	if req.Method == http.MethodPut && comp == "block" {
+		blockID := req.URL.Query().Get("blockid")
+		if blockID == "" {
+			return ms.error(req, http.StatusBadRequest, "InvalidQueryParameterValue", "Value for one of the query parameters specified in the request URI is invalid.")
+		}
+		if container.uncommitted[name] == nil {
+			container.uncommitted[name] = make(map[string][]byte)
+		}
+		container.uncommitted[name][blockID] = body
+		return ms.respond(req, http.StatusCreated, nil, nil)
+	}
+
+	if snapshot := req.URL.Query().Get("snapshot"); snapshot != "" {
+		return ms.snapshot(req, container, name, snapshot)
+	}
+
+	if resp := ms.checkConditions(req, blob); resp != nil {
+		return resp
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		if comp == "blocklist" {
+			return ms.blockList(req, container, name, blob)
+		}
+		if comp != "" {
+			break
+		}
+		if blob == nil {
+			return ms.error(req, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+		}
+		return ms.download(req, blob)
+	case http.MethodHead:
+		if blob == nil {
+			return ms.error(req, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+		}
+		header := blob.header()
+		header.Set("Content-Length", strconv.Itoa(len(blob.data)))
+		return ms.respond(req, http.StatusOK, header, nil)
+	case http.MethodDelete:
+		if blob == nil {
+			return ms.error(req, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+		}
+		switch req.Header.Get("x-ms-delete-snapshots") {
+		case "include":
+			delete(container.snapshots, name)
+		case "only":
+			delete(container.snapshots, name)
+			return ms.respond(req, http.StatusAccepted, nil, nil)
+		default:
+			if len(container.snapshots[name]) > 0 {
+				return ms.error(req, http.StatusConflict, "SnapshotsPresent", "This operation is not permitted because the blob has snapshots.")
+			}
+		}
+		delete(container.blobs, name)
+		delete(container.uncommitted, name)
+		return ms.respond(req, http.StatusAccepted, nil, nil)
+	case http.MethodPut:
+		switch comp {
+		case "":
+			if source := req.Header.Get("x-ms-copy-source"); source != "" {
+				return ms.copy(req, container, name, source)
+			}
+			switch azblob.BlobType(req.Header.Get("x-ms-blob-type")) {
+			case azblob.BlobBlockBlob:
+			case azblob.BlobAppendBlob:
+				blob = ms.newBlob(req, nil)
+				blob.blobType = azblob.BlobAppendBlob
+				container.put(name, blob)
+				delete(container.uncommitted, name)
+				return ms.respond(req, http.StatusCreated, blob.header(), nil)
+			case azblob.BlobPageBlob:
+				size, err := strconv.Atoi(req.Header.Get("x-ms-blob-content-length"))
+				if err != nil || size < 0 || size%512 != 0 {
+					return ms.error(req, http.StatusBadRequest, "InvalidHeaderValue", "The value for one of the HTTP headers is not in the correct format.")
+				}
+				blob = ms.newBlob(req, make([]byte, size))
+				blob.blobType = azblob.BlobPageBlob
+				blob.sequence, _ = strconv.ParseInt(req.Header.Get("x-ms-blob-sequence-number"), 10, 64)
+				container.put(name, blob)
+				delete(container.uncommitted, name)
+				return ms.respond(req, http.StatusCreated, blob.header(), nil)
+			default:
+				return ms.error(req, http.StatusBadRequest, "UnsupportedHeader", "Unknown blob type.")
+			}
+			blob = ms.newBlob(req, body)
+			if blob.headers.ContentMD5 == nil {
+				sum := md5.Sum(body)
+				blob.headers.ContentMD5 = sum[:]
+			}
+			container.put(name, blob)
+			delete(container.uncommitted, name)
+			return ms.respond(req, http.StatusCreated, blob.header(), nil)
+		case "blocklist":
+			return ms.commit(req, container, name, blob, body)
+		case "appendblock":
+			return ms.appendBlock(req, blob, body)
+		case "page":
+			return ms.uploadPages(req, blob, body)
+		case "properties":
+			if blob == nil {
+				return ms.error(req, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+			}
+			if action := req.Header.Get("x-ms-sequence-number-action"); action != "" {
+				return ms.updateSequenceNumber(req, blob, azblob.SequenceNumberActionType(action))
+			}
+			if length := req.Header.Get("x-ms-blob-content-length"); length != "" {
+				return ms.resize(req, blob, length)
+			}
+			blob.headers = blobHTTPHeaders(req.Header)
+			blob.etag = ms.nextETag()
+			blob.modified = time.Now().UTC()
+			return ms.respond(req, http.StatusOK, blob.header(), nil)
+		case "lease":
+			if blob == nil {
+				return ms.error(req, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+			}
+			return ms.leaseBlob(req, blob)
+		case "tier":
+			if blob == nil {
+				return ms.error(req, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+			}
+			blob.setTier(azblob.AccessTierType(req.Header.Get("x-ms-access-tier")))
+			return ms.respond(req, http.StatusOK, nil, nil)
+		case "snapshot":
+			if blob == nil {
+				return ms.error(req, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+			}
+			if container.snapshots[name] == nil {
+				container.snapshots[name] = make(map[string]*memoryBlob)
+			}
+			now := time.Now().UTC()
+			snapshot := now.Format(memorySnapshotFormat)
+			for ; container.snapshots[name][snapshot] != nil; now = now.Add(100 * time.Nanosecond) {
+				snapshot = now.Format(memorySnapshotFormat)
+			}
+			copied := *blob
+			container.snapshots[name][snapshot] = &copied
+			header := blob.header()
+			header.Set("x-ms-snapshot", snapshot)
+			return ms.respond(req, http.StatusCreated, header, nil)
+		}
+	}
+	return ms.error(req, http.StatusBadRequest, "UnsupportedQueryParameter", "One of the query parameters specified in the request URI is not supported.")
+}
+
+// appendBlock - append body to an append blob, checking the append position conditions
+func (ms *memoryService) appendBlock(req *http.Request, blob *memoryBlob, body []byte) *http.Response {
+	if blob == nil {
+		return ms.error(req, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+	}
+	if blob.blobType != azblob.BlobAppendBlob {
+		return ms.error(req, http.StatusConflict, "InvalidBlobType", "The blob type is invalid for this operation.")
+	}
+	if maxSize := req.Header.Get("x-ms-blob-condition-maxsize"); maxSize != "" {
+		if max, err := strconv.Atoi(maxSize); err != nil || len(blob.data)+len(body) > max {
+			return ms.error(req, http.StatusPreconditionFailed, "MaxBlobSizeConditionNotMet", "The max blob size condition specified was not met.")
+		}
+	}
+	if appendPos := req.Header.Get("x-ms-blob-condition-appendpos"); appendPos != "" {
+		if pos, err := strconv.Atoi(appendPos); err != nil || len(blob.data) != pos {
+			return ms.error(req, http.StatusPreconditionFailed, "AppendPositionConditionNotMet", "The append position condition specified was not met.")
+		}
+	}
+	offset := len(blob.data)
+	blob.data = append(blob.data, body...)
+	blob.etag = ms.nextETag()
+	blob.modified = time.Now().UTC()
+	header := blob.header()
+	header.Set("x-ms-blob-append-offset", strconv.Itoa(offset))
+	return ms.respond(req, http.StatusCreated, header, nil)
+}
+
+// uploadPages - write the pages of body at x-ms-range, checking the sequence number conditions
+func (ms *memoryService) uploadPages(req *http.Request, blob *memoryBlob, body []byte) *http.Response {
+	if blob == nil {
+		return ms.error(req, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+	}
+	if blob.blobType != azblob.BlobPageBlob {
+		return ms.error(req, http.StatusConflict, "InvalidBlobType", "The blob type is invalid for this operation.")
+	}
+	for name, holds := range map[string]func(int64) bool{
+		"x-ms-if-sequence-number-le": func(n int64) bool { return blob.sequence <= n },
+		"x-ms-if-sequence-number-lt": func(n int64) bool { return blob.sequence < n },
+		"x-ms-if-sequence-number-eq": func(n int64) bool { return blob.sequence == n },
+	} {
+		if value := req.Header.Get(name); value != "" {
+			if n, err := strconv.ParseInt(value, 10, 64); err != nil || !holds(n) {
+				return ms.error(req, http.StatusPreconditionFailed, "SequenceNumberConditionNotMet", "The sequence number condition specified was not met.")
+			}
+		}
+	}
+	var start, end int
+	if _, err := fmt.Sscanf(req.Header.Get("x-ms-range"), "bytes=%d-%d", &start, &end); err != nil || start%512 != 0 || (end+1)%512 != 0 || end+1-start != len(body) {
+		return ms.error(req, http.StatusBadRequest, "InvalidPageRange", "The page range specified is invalid.")
+	}
+	if end >= len(blob.data) {
+		return ms.error(req, http.StatusRequestedRangeNotSatisfiable, "InvalidPageRange", "The page range specified is invalid.")
+	}
+	data := append([]byte(nil), blob.data...)
+	copy(data[start:], body)
+	blob.data = data
+	blob.etag = ms.nextETag()
+	blob.modified = time.Now().UTC()
+	return ms.respond(req, http.StatusCreated, blob.header(), nil)
+}
+
+// updateSequenceNumber - apply a sequence number action to a page blob
+func (ms *memoryService) updateSequenceNumber(req *http.Request, blob *memoryBlob, action azblob.SequenceNumberActionType) *http.Response {
+	if blob.blobType != azblob.BlobPageBlob {
+		return ms.error(req, http.StatusConflict, "InvalidBlobType", "The blob type is invalid for this operation.")
+	}
+	n, _ := strconv.ParseInt(req.Header.Get("x-ms-blob-sequence-number"), 10, 64)
+	switch action {
+	case azblob.SequenceNumberActionIncrement:
+		blob.sequence++
+	case azblob.SequenceNumberActionMax:
+		if n > blob.sequence {
+			blob.sequence = n
+		}
+	case azblob.SequenceNumberActionUpdate:
+		blob.sequence = n
+	default:
+		return ms.error(req, http.StatusBadRequest, "InvalidHeaderValue", "The value for one of the HTTP headers is not in the correct format.")
+	}
+	blob.etag = ms.nextETag()
+	blob.modified = time.Now().UTC()
+	return ms.respond(req, http.StatusOK, blob.header(), nil)
+}
+
+// resize - the pages of a page blob past its new length are dropped, the new ones are zeros
+func (ms *memoryService) resize(req *http.Request, blob *memoryBlob, length string) *http.Response {
+	if blob.blobType != azblob.BlobPageBlob {
+		return ms.error(req, http.StatusConflict, "InvalidBlobType", "The blob type is invalid for this operation.")
+	}
+	size, err := strconv.Atoi(length)
+	if err != nil || size < 0 || size%512 != 0 {
+		return ms.error(req, http.StatusBadRequest, "InvalidHeaderValue", "The value for one of the HTTP headers is not in the correct format.")
+	}
+	if size <= len(blob.data) {
+		blob.data = blob.data[:size]
+	} else {
+		blob.data = append(blob.data, make([]byte, size-len(blob.data))...)
+	}
+	blob.etag = ms.nextETag()
+	blob.modified = time.Now().UTC()
+	return ms.respond(req, http.StatusOK, blob.header(), nil)
+}
+
+type memoryBlockList struct {
+	XMLName     xml.Name      `xml:"BlockList"`
+	Committed   []memoryBlock `xml:"CommittedBlocks>Block"`
+	Uncommitted []memoryBlock `xml:"UncommittedBlocks>Block"`
+}
+
+type memoryBlock struct {
+	Name string `xml:"Name"`
+	Size int    `xml:"Size"`
+}
+
+// blockList - the committed and/or uncommitted blocks of a blob, as asked by blocklisttype
+func (ms *memoryService) blockList(req *http.Request, container *memoryContainer, name string, blob *memoryBlob) *http.Response {
+	uncommitted := container.uncommitted[name]
+	if blob == nil && uncommitted == nil {
+		return ms.error(req, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+	}
+	listType := req.URL.Query().Get("blocklisttype")
+	list := memoryBlockList{}
+	if blob != nil && listType != "uncommitted" {
+		for _, id := range blob.blockIDs {
+			list.Committed = append(list.Committed, memoryBlock{Name: id, Size: len(blob.blocks[id])})
+		}
+	}
+	if listType == "uncommitted" || listType == "all" {
+		ids := make([]string, 0, len(uncommitted))
+		for id := range uncommitted {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			list.Uncommitted = append(list.Uncommitted, memoryBlock{Name: id, Size: len(uncommitted[id])})
+		}
+	}
+	return ms.respondXML(req, list)
+}
+
+// memorySnapshotFormat is the format of the snapshot identifiers, Azure's DateTime with 7 fractional digits
+const memorySnapshotFormat = "2006-01-02T15:04:05.0000000Z"
+
+// snapshot - the read and delete operations on a snapshot of a blob
+func (ms *memoryService) snapshot(req *http.Request, container *memoryContainer, name, snapshot string) *http.Response {
+	blob := container.snapshots[name][snapshot]
+	if blob == nil {
+		return ms.error(req, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+	}
+	if resp := ms.checkConditions(req, blob); resp != nil {
+		return resp
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		return ms.download(req, blob)
+	case http.MethodHead:
+		header := blob.header()
+		header.Set("Content-Length", strconv.Itoa(len(blob.data)))
+		return ms.respond(req, http.StatusOK, header, nil)
+	case http.MethodDelete:
+		delete(container.snapshots[name], snapshot)
+		return ms.respond(req, http.StatusAccepted, nil, nil)
+	}
+	return ms.error(req, http.StatusBadRequest, "InvalidQueryParameterValue", "Value for one of the query parameters specified in the request URI is invalid.")
+}
+
+// checkConditions - apply If-Match, If-None-Match and If-Unmodified-Since, returning the failure response if one fails
+func (ms *memoryService) checkConditions(req *http.Request, blob *memoryBlob) *http.Response {
+	if since, err := http.ParseTime(req.Header.Get("If-Unmodified-Since")); err == nil && blob != nil {
+		if blob.modified.Truncate(time.Second).After(since) {
+			return ms.error(req, http.StatusPreconditionFailed, "ConditionNotMet", "The condition specified using HTTP conditional header(s) is not met.")
+		}
+	}
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" {
+		if blob == nil || (ifMatch != "*" && ifMatch != blob.etag) {
+			return ms.error(req, http.StatusPreconditionFailed, "ConditionNotMet", "The condition specified using HTTP conditional header(s) is not met.")
+		}
+	}
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" && blob != nil {
+		if ifNoneMatch == "*" || ifNoneMatch == blob.etag {
+			if req.Method == http.MethodGet || req.Method == http.MethodHead {
+				return ms.respond(req, http.StatusNotModified, blob.header(), nil)
+			}
+			if ifNoneMatch == "*" {
+				return ms.error(req, http.StatusConflict, "BlobAlreadyExists", "The specified blob already exists.")
+			}
+			return ms.error(req, http.StatusPreconditionFailed, "ConditionNotMet", "The condition specified using HTTP conditional header(s) is not met.")
+		}
+	}
+	return nil
+}
+
+// put stores blob as name, an overwritten blob keeps its creation time
+func (container *memoryContainer) put(name string, blob *memoryBlob) {
+	if old, ok := container.blobs[name]; ok {
+		blob.created = old.created
+	}
+	container.blobs[name] = blob
+}
+
+func (ms *memoryService) newBlob(req *http.Request, data []byte) *memoryBlob {
+	return &memoryBlob{
+		data:     data,
+		blobType: azblob.BlobBlockBlob,
+		tier:     azblob.AccessTierHot,
+		headers:  blobHTTPHeaders(req.Header),
+		metadata: blobMetadata(req.Header),
+		etag:     ms.nextETag(),
+		created:  time.Now().UTC(),
+		modified: time.Now().UTC(),
+	}
+}
+
+func (ms *memoryService) download(req *http.Request, blob *memoryBlob) *http.Response {
+	if blob.tier == azblob.AccessTierArchive {
+		return ms.error(req, http.StatusConflict, "BlobArchived", "This operation is not permitted on an archived blob.")
+	}
+
+	header := blob.header()
+	overrideResponseHeaders(header, req.URL.Query())
+	size := int64(len(blob.data))
+	rangeHeader := req.Header.Get("x-ms-range")
+	if rangeHeader == "" {
+		header.Set("Content-Length", strconv.FormatInt(size, 10))
+		return ms.respond(req, http.StatusOK, header, blob.data)
+	}
+
+	var start, end int64 = 0, -1
+	bounds := strings.SplitN(strings.TrimPrefix(rangeHeader, "bytes="), "-", 2)
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err == nil && len(bounds) == 2 && bounds[1] != "" {
+		end, err = strconv.ParseInt(bounds[1], 10, 64)
+	}
+	if err != nil || start >= size {
+		return ms.error(req, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The range specified is invalid for the current size of the resource.")
+	}
+	if end < 0 || end >= size {
+		end = size - 1
+	}
+
+	header.Del("Content-MD5")
+	header.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	return ms.respond(req, http.StatusPartialContent, header, blob.data[start:end+1])
+}
+
+// commit - build the blob from the block list, ids are looked up as the Azure service does
+func (ms *memoryService) commit(req *http.Request, container *memoryContainer, name string, blob *memoryBlob, body []byte) *http.Response {
+	committed := map[string][]byte{}
+	if blob != nil && blob.blocks != nil {
+		committed = blob.blocks
+	}
+	uncommitted := container.uncommitted[name]
+
+	blocks := make(map[string][]byte)
+	var (
+		blockIDs []string
+		data     []byte
+	)
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ms.error(req, http.StatusBadRequest, "InvalidXmlDocument", "XML specified is not syntactically valid.")
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local == "BlockList" {
+			continue
+		}
+		var id string
+		if err := decoder.DecodeElement(&id, &start); err != nil {
+			return ms.error(req, http.StatusBadRequest, "InvalidXmlDocument", "XML specified is not syntactically valid.")
+		}
+		block, found := []byte(nil), false
+		switch start.Name.Local {
+		case "Committed":
+			block, found = committed[id]
+		case "Uncommitted":
+			block, found = uncommitted[id]
+		case "Latest":
+			if block, found = uncommitted[id]; !found {
+				block, found = committed[id]
+			}
+		}
+		if !found {
+			return ms.error(req, http.StatusBadRequest, "InvalidBlockList", "The specified block list is invalid.")
+		}
+		blocks[id] = block
+		blockIDs = append(blockIDs, id)
+		data = append(data, block...)
+	}
+
+	newBlob := ms.newBlob(req, data)
+	newBlob.blocks = blocks
+	newBlob.blockIDs = blockIDs
+	if blob != nil {
+		newBlob.tier = blob.tier
+	}
+	container.put(name, newBlob)
+	delete(container.uncommitted, name)
+	return ms.respond(req, http.StatusCreated, newBlob.header(), nil)
+}
+
+// copy - a synchronous copy from a blob served by this transport
+func (ms *memoryService) copy(req *http.Request, container *memoryContainer, name, source string) *http.Response {
+	u, err := url.Parse(source)
+	if err != nil {
+		return ms.error(req, http.StatusBadRequest, "InvalidHeaderValue", "The value for one of the HTTP headers is not in the correct format.")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	var src *memoryBlob
+	if len(parts) == 2 && ms.containers[parts[0]] != nil {
+		src = ms.containers[parts[0]].blobs[parts[1]]
+	}
+	if src == nil || u.Host != req.URL.Host {
+		return ms.error(req, http.StatusNotFound, "CannotVerifyCopySource", "The specified blob does not exist.")
+	}
+
+	blob := &memoryBlob{
+		data:     append([]byte(nil), src.data...),
+		blobType: src.blobType,
+		tier:     azblob.AccessTierHot,
+		headers:  src.headers,
+		metadata: src.metadata,
+		etag:     ms.nextETag(),
+		created:  time.Now().UTC(),
+		modified: time.Now().UTC(),
+	}
+	container.put(name, blob)
+
+	header := blob.header()
+	header.Set("x-ms-copy-id", strings.Trim(ms.nextETag(), "\""))
+	header.Set("x-ms-copy-status", string(azblob.CopyStatusSuccess))
+	return ms.respond(req, http.StatusAccepted, header, nil)
+}
+
+// overrideResponseHeaders - the response headers asked by the query of a SAS (not checked)
+func overrideResponseHeaders(header http.Header, query url.Values) {
+	for param, name := range map[string]string{
+		"rsct": "Content-Type",
+		"rscd": "Content-Disposition",
+		"rscc": "Cache-Control",
+		"rsce": "Content-Encoding",
+		"rscl": "Content-Language",
+	} {
+		if value := query.Get(param); value != "" {
+			header.Set(name, value)
+		}
+	}
+}
+
+// memoryLease - the lease of a blob, the leases are reported but not enforced
+type memoryLease struct {
+	id      string
+	fixed   bool
+	expires time.Time // of a fixed lease, or when a broken lease is broken
+	broken  bool
+}
+
+func (lease memoryLease) state() azblob.LeaseStateType {
+	switch {
+	case lease.id == "":
+		return azblob.LeaseStateAvailable
+	case lease.broken && time.Now().Before(lease.expires):
+		return azblob.LeaseStateBreaking
+	case lease.broken:
+		return azblob.LeaseStateBroken
+	case lease.fixed && !time.Now().Before(lease.expires):
+		return azblob.LeaseStateExpired
+	}
+	return azblob.LeaseStateLeased
+}
+
+func (lease memoryLease) status() azblob.LeaseStatusType {
+	if state := lease.state(); state == azblob.LeaseStateLeased || state == azblob.LeaseStateBreaking {
+		return azblob.LeaseStatusLocked
+	}
+	return azblob.LeaseStatusUnlocked
+}
+
+func (lease memoryLease) duration() azblob.LeaseDurationType {
+	switch {
+	case lease.state() != azblob.LeaseStateLeased:
+		return ""
+	case lease.fixed:
+		return azblob.LeaseDurationFixed
+	}
+	return azblob.LeaseDurationInfinite
+}
+
+// leaseBlob - acquire, release and break the lease of a blob
+func (ms *memoryService) leaseBlob(req *http.Request, blob *memoryBlob) *http.Response {
+	header := http.Header{}
+	switch req.Header.Get("x-ms-lease-action") {
+	case "acquire":
+		if blob.lease.status() == azblob.LeaseStatusLocked {
+			return ms.error(req, http.StatusConflict, "LeaseAlreadyPresent", "There is already a lease present.")
+		}
+		lease := memoryLease{id: req.Header.Get("x-ms-proposed-lease-id")}
+		if lease.id == "" {
+			lease.id = uuid.New().String()
+		}
+		if seconds, _ := strconv.Atoi(req.Header.Get("x-ms-lease-duration")); seconds > 0 {
+			lease.fixed = true
+			lease.expires = time.Now().Add(time.Duration(seconds) * time.Second)
+		}
+		blob.lease = lease
+		header.Set("x-ms-lease-id", lease.id)
+		return ms.respond(req, http.StatusCreated, header, nil)
+	case "release":
+		if req.Header.Get("x-ms-lease-id") != blob.lease.id {
+			return ms.error(req, http.StatusConflict, "LeaseIdMismatchWithLeaseOperation", "The lease ID specified did not match the lease ID for the blob.")
+		}
+		blob.lease = memoryLease{}
+		return ms.respond(req, http.StatusOK, header, nil)
+	case "break":
+		if blob.lease.id == "" {
+			return ms.error(req, http.StatusConflict, "LeaseNotPresentWithLeaseOperation", "There is currently no lease on the blob.")
+		}
+		seconds, _ := strconv.Atoi(req.Header.Get("x-ms-lease-break-period"))
+		blob.lease.broken = true
+		blob.lease.expires = time.Now().Add(time.Duration(seconds) * time.Second)
+		header.Set("x-ms-lease-time", strconv.Itoa(seconds))
+		return ms.respond(req, http.StatusAccepted, header, nil)
+	}
+	return ms.error(req, http.StatusBadRequest, "InvalidHeaderValue", "The value for one of the HTTP headers is not in the correct format.")
+}
+
+// setTier - moving an archived blob to another tier starts a rehydration
+// that the emulation never completes, the blob stays archived
+func (blob *memoryBlob) setTier(tier azblob.AccessTierType) {
+	blob.tierSet = true
+	if blob.tier == azblob.AccessTierArchive && tier != azblob.AccessTierArchive {
+		blob.archive = azblob.ArchiveStatusType("rehydrate-pending-to-" + strings.ToLower(string(tier)))
+		return
+	}
+	blob.tier = tier
+	blob.archive = ""
+}
+
+// header - the properties of the blob as response headers
+func (blob *memoryBlob) header() http.Header {
+	header := http.Header{}
+	header.Set("Last-Modified", blob.modified.Format(http.TimeFormat))
+	header.Set("x-ms-creation-time", blob.created.Format(http.TimeFormat))
+	header.Set("ETag", blob.etag)
+	header.Set("x-ms-blob-type", string(blob.blobType))
+	header.Set("x-ms-access-tier", string(blob.tier))
+	if !blob.tierSet {
+		header.Set("x-ms-access-tier-inferred", "true")
+	}
+	if blob.archive != "" {
+		header.Set("x-ms-archive-status", string(blob.archive))
+	}
+	header.Set("x-ms-lease-status", string(blob.lease.status()))
+	header.Set("x-ms-lease-state", string(blob.lease.state()))
+	if duration := blob.lease.duration(); duration != "" {
+		header.Set("x-ms-lease-duration", string(duration))
+	}
+	if blob.blobType == azblob.BlobPageBlob {
+		header.Set("x-ms-blob-sequence-number", strconv.FormatInt(blob.sequence, 10))
+	}
+	if blob.headers.ContentType != "" {
+		header.Set("Content-Type", blob.headers.ContentType)
+	}
+	if blob.headers.ContentEncoding != "" {
+		header.Set("Content-Encoding", blob.headers.ContentEncoding)
+	}
+	if blob.headers.ContentLanguage != "" {
+		header.Set("Content-Language", blob.headers.ContentLanguage)
+	}
+	if blob.headers.ContentDisposition != "" {
+		header.Set("Content-Disposition", blob.headers.ContentDisposition)
+	}
+	if blob.headers.CacheControl != "" {
+		header.Set("Cache-Control", blob.headers.CacheControl)
+	}
+	if blob.headers.ContentMD5 != nil {
+		header.Set("Content-MD5", base64.StdEncoding.EncodeToString(blob.headers.ContentMD5))
+	}
+	for key, value := range blob.metadata {
+		header.Set("x-ms-meta-"+key, value)
+	}
+	return header
+}
+
+// blobMetadata - the x-ms-meta-* request headers, keyed by the lower case name after the prefix
+func blobMetadata(header http.Header) map[string]string {
+	var metadata map[string]string
+	for key, values := range header {
+		if name := strings.ToLower(key); strings.HasPrefix(name, "x-ms-meta-") && len(values) > 0 {
+			if metadata == nil {
+				metadata = make(map[string]string)
+			}
+			metadata[strings.TrimPrefix(name, "x-ms-meta-")] = values[0]
+		}
+	}
+	return metadata
+}
+
+// blobHTTPHeaders - the x-ms-blob-* request headers
+func blobHTTPHeaders(header http.Header) azblob.BlobHTTPHeaders {
+	h := azblob.BlobHTTPHeaders{
+		ContentType:        header.Get("x-ms-blob-content-type"),
+		ContentEncoding:    header.Get("x-ms-blob-content-encoding"),
+		ContentLanguage:    header.Get("x-ms-blob-content-language"),
+		ContentDisposition: header.Get("x-ms-blob-content-disposition"),
+		CacheControl:       header.Get("x-ms-blob-cache-control"),
+	}
+	if s := header.Get("x-ms-blob-content-md5"); s != "" {
+		h.ContentMD5, _ = base64.StdEncoding.DecodeString(s)
+	}
+	return h
+}
+
+func (ms *memoryService) respondXML(req *http.Request, v interface{}) *http.Response {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		return ms.error(req, http.StatusInternalServerError, "InternalError", err.Error())
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/xml")
+	return ms.respond(req, http.StatusOK, header, append([]byte(xml.Header), body...))
+}
+
+func (ms *memoryService) error(req *http.Request, status int, code, message string) *http.Response {
+	header := http.Header{}
+	header.Set("x-ms-error-code", code)
+	var body []byte
+	if req.Method != http.MethodHead {
+		header.Set("Content-Type", "application/xml")
+		body = []byte(fmt.Sprintf("%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, message))
+	}
+	return ms.respond(req, status, header, body)
+}
+
+func (ms *memoryService) respond(req *http.Request, status int, header http.Header, body []byte) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	ms.sequence++
+	header.Set("x-ms-request-id", fmt.Sprintf("%08x-0000-0000-0000-000000000000", ms.sequence))
+	header.Set("x-ms-version", azblob.ServiceVersion)
+	header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	if req.Method == http.MethodHead {
+		body = nil
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
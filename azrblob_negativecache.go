@@ -0,0 +1,102 @@
+package azrblob
+
+import (
+	"sync"
+	"time"
+)
+
+// negativeCacheSweepSize is the number of entries past which adding one drops the expired ones
+const negativeCacheSweepSize = 10000
+
+// negativeMiss is the error of a Stat of a missing blob and when it stops being served
+type negativeMiss struct {
+	err     error
+	expires time.Time
+}
+
+// negativeCache remembers the blobs Stat found missing for a while, so probing them
+// again doesn't go to Azure. It is shared by the copies of an Fs, and its methods
+// do nothing on a nil cache (FsOptions.NegativeCacheTTL unset).
+type negativeCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	clock      Clock
+	entries    map[string]negativeMiss
+	generation uint64 // incremented by forget
+}
+
+func newNegativeCache(ttl time.Duration, clock Clock) *negativeCache {
+	return &negativeCache{
+		ttl:     ttl,
+		clock:   clockOrReal(clock),
+		entries: make(map[string]negativeMiss),
+	}
+}
+
+// get returns the error of the last Stat of name if it was missing less than ttl ago
+func (nc *negativeCache) get(name string) error {
+	if nc == nil {
+		return nil
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	miss, ok := nc.entries[name]
+	if !ok {
+		return nil
+	}
+	if nc.clock.Now().After(miss.expires) {
+		delete(nc.entries, name)
+		return nil
+	}
+	return miss.err
+}
+
+// start returns the generation to give put for a lookup about to be made
+func (nc *negativeCache) start() uint64 {
+	if nc == nil {
+		return 0
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.generation
+}
+
+// put remembers that name was missing, unless a blob was written since the lookup
+// started at generation: the miss could be older than the write
+func (nc *negativeCache) put(name string, err error, generation uint64) {
+	if nc == nil {
+		return
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	if generation != nc.generation {
+		return
+	}
+	now := nc.clock.Now()
+	if len(nc.entries) >= negativeCacheSweepSize {
+		for name, miss := range nc.entries {
+			if now.After(miss.expires) {
+				delete(nc.entries, name)
+			}
+		}
+	}
+	nc.entries[name] = negativeMiss{err: err, expires: now.Add(nc.ttl)}
+}
+
+// forget drops name once it was written
+func (nc *negativeCache) forget(name string) {
+	if nc == nil {
+		return
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	delete(nc.entries, name)
+	nc.generation++
+}
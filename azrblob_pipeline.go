@@ -0,0 +1,32 @@
+package azrblob
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+)
+
+// SecondaryHost returns the host of the read-only secondary endpoint of accountName, for
+// read-access geo-redundant (RA-GRS) accounts. Set it as azblob.PipelineOptions.Retry.RetryReadsFromSecondaryHost
+// (or CreateCache.SecondaryHost for cached containers) so that the reads failing on the
+// primary endpoint are retried on it, the writes are never sent to the secondary.
+func SecondaryHost(accountName string) string {
+	return fmt.Sprintf("%s-secondary.blob.core.windows.net", accountName)
+}
+
+// NewHTTPClientSender returns a pipeline.Factory that sends the requests through the given
+// client. Set it as azblob.PipelineOptions.HTTPSender (or CreateCache.HTTPClient for cached
+// containers) so the client's proxy, TLS and timeout settings apply to Azure traffic.
+func NewHTTPClientSender(client *http.Client) pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			r, err := client.Do(request.WithContext(ctx))
+			if err != nil {
+				err = pipeline.NewError(err, "HTTP request failed")
+			}
+			return pipeline.NewHTTPResponse(r), err
+		}
+	})
+}
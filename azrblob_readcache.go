@@ -0,0 +1,43 @@
+package azrblob
+
+const (
+	readCacheBlockSize = 1024 * 1024
+)
+
+// cachedRange is a downloaded range of a blob starting at offset
+type cachedRange struct {
+	offset int64
+	data   []byte
+}
+
+// rangeCache keeps the most recently downloaded ranges of a blob so that
+// repeated seeks within a window don't download the same bytes again
+type rangeCache struct {
+	size   int
+	ranges []cachedRange // least recently used first
+}
+
+func newRangeCache(size int) *rangeCache {
+	return &rangeCache{size: size}
+}
+
+// get returns the cached bytes from offset to the end of the range holding it,
+// or nil if no cached range holds offset
+func (rc *rangeCache) get(offset int64) []byte {
+	for i, r := range rc.ranges {
+		if offset >= r.offset && offset < r.offset+int64(len(r.data)) {
+			// move the range to the most recently used end
+			rc.ranges = append(append(rc.ranges[:i:i], rc.ranges[i+1:]...), r)
+			return r.data[offset-r.offset:]
+		}
+	}
+	return nil
+}
+
+// put adds a range, evicting the least recently used one when the cache is full
+func (rc *rangeCache) put(offset int64, data []byte) {
+	if len(rc.ranges) >= rc.size {
+		rc.ranges = rc.ranges[1:]
+	}
+	rc.ranges = append(rc.ranges, cachedRange{offset: offset, data: data})
+}
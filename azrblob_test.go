@@ -2,11 +2,25 @@
 package azrblob
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -71,23 +85,40 @@ func TestCompatibleOsFileInfo(t *testing.T) {
 	var _ os.FileInfo = (*FileInfo)(nil)
 }
 
-func GetFs(t *testing.T) afero.Fs {
-	accountName, accountKey := accountInfo()
-	container := "afero-test"
+// testMemoryTransport - serves the tests when there is no .env file
+var testMemoryTransport = newMemoryTransport()
 
+// testServiceURL - the service URL for the account in the .env file, or for an in memory
+// emulation of the Blob service so the tests can run without an account
+func testServiceURL() (azblob.ServiceURL, error) {
+	accountName, accountKey := accountInfo()
 	if accountName == "" || accountKey == "" {
-		t.Fatal("Error loading .env file")
+		p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{
+			HTTPSender: NewHTTPClientSender(&http.Client{Transport: testMemoryTransport}),
+		})
+		u, _ := url.Parse("https://afero.blob.core.windows.net")
+		return azblob.NewServiceURL(*u, p), nil
 	}
+
 	// get the credentials
 	credential, err := azblob.NewSharedKeyCredential(accountName, accountKey)
 	if err != nil {
-		return nil
+		return azblob.ServiceURL{}, err
 	}
 
 	// build the context for the Azure Blob Storage
 	p := azblob.NewPipeline(credential, azblob.PipelineOptions{})
 	u, _ := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net", accountName))
-	serviceURL := azblob.NewServiceURL(*u, p)
+	return azblob.NewServiceURL(*u, p), nil
+}
+
+func GetFs(t *testing.T) afero.Fs {
+	container := "afero-test"
+
+	serviceURL, err := testServiceURL()
+	if err != nil {
+		return nil
+	}
 	ctx := context.Background()
 
 	// Initialize the file system
@@ -102,23 +133,12 @@ func GetFs(t *testing.T) afero.Fs {
 	return azrblobFs
 }
 func GetCachedFs(t *testing.T) afero.Fs {
-	accountName, accountKey := accountInfo()
 	container := "afero-test"
 
-	if accountName == "" || accountKey == "" {
-		t.Fatal("Error loading .env file")
-	}
-
-	// get the credentials
-	credential, err := azblob.NewSharedKeyCredential(accountName, accountKey)
+	serviceURL, err := testServiceURL()
 	if err != nil {
 		return nil
 	}
-
-	// build the context for the Azure Blob Storage
-	p := azblob.NewPipeline(credential, azblob.PipelineOptions{})
-	u, _ := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net", accountName))
-	serviceURL := azblob.NewServiceURL(*u, p)
 	ctx := context.Background()
 
 	// Initialize the file system
@@ -130,7 +150,7 @@ func GetCachedFs(t *testing.T) afero.Fs {
 	}
 
 	// cache the test container
-	cache := []CreateCache{{Name: container, Cycle: 1.0, Path: "/tmp", AccountName: accountName, AccountKey: accountKey}}
+	cache := []CreateCache{{Name: container, Cycle: 1.0, Path: "/tmp", ServiceURL: &serviceURL}}
 	err = InitCachedContainers(cache)
 	if err != nil {
 		return nil
@@ -434,17 +454,16 @@ func TestFileCreate(t *testing.T) {
 		t.Fatal("Couldn't close file:", err)
 	}
 
-	// Empty files are not acually created on Azure
-	// so getting the Stat or deleting them isn't possible
-	// if stat, err := fs.Stat("/file1"); err != nil {
-	// 	t.Fatal("Could not access file:", err)
-	// } else if stat.Size() != 0 {
-	// 	t.Fatal("File should be empty")
-	// }
+	// Closing a created file without writing commits an empty blob
+	if stat, err := fs.Stat("/file1"); err != nil {
+		t.Fatal("Could not access file:", err)
+	} else if stat.Size() != 0 {
+		t.Fatal("File should be empty")
+	}
 
-	// if err := fs.Remove("/file1"); err != nil {
-	// 	t.Fatal("Could not delete file:", err)
-	// }
+	if err := fs.Remove("/file1"); err != nil {
+		t.Fatal("Could not delete file:", err)
+	}
 
 	if _, err := fs.Stat("/file1"); err == nil {
 		t.Fatal("Should not be able to access file")
@@ -859,3 +878,3512 @@ func TestWildCardListingCached(t *testing.T) {
 	}
 
 }
+
+func TestReaddirSorted(t *testing.T) {
+	fs := GetFs(t)
+
+	testCreateFile(t, fs, "file3", "content of file 3")
+	testCreateFile(t, fs, "file1", "content of file 1")
+	testCreateFile(t, fs, "file2", "content of file 2")
+
+	root, err := fs.Open("/")
+	if err != nil {
+		t.Fatal("Could not open root:", err)
+	}
+
+	fi, err := root.Readdir(-1)
+	if err != nil {
+		t.Fatal("Could not readdir:", err)
+	}
+
+	if len(fi) != 3 || fi[0].Name() != "file1" || fi[1].Name() != "file2" || fi[2].Name() != "file3" {
+		t.Fatal("Listed files are not sorted by name")
+	}
+}
+
+func TestDownloadToFile(t *testing.T) {
+	fs := GetFs(t)
+	testCreateFile(t, fs, "/file1", "Hello world !")
+
+	localPath := os.TempDir() + "/afero-azrblob-download"
+	defer os.Remove(localPath)
+
+	if err := fs.(*Fs).DownloadToFile("/file1", localPath); err != nil {
+		t.Fatal("Could not download file:", err)
+	}
+
+	if content, err := ioutil.ReadFile(localPath); err != nil {
+		t.Fatal("Could not read downloaded file:", err)
+	} else if string(content) != "Hello world !" {
+		t.Fatal("Bad download:", string(content))
+	}
+}
+
+func TestUploadFromFile(t *testing.T) {
+	fs := GetFs(t)
+
+	localPath := os.TempDir() + "/afero-azrblob-upload.txt"
+	defer os.Remove(localPath)
+	if err := ioutil.WriteFile(localPath, []byte("Hello world !"), 0644); err != nil {
+		t.Fatal("Could not write local file:", err)
+	}
+
+	if err := fs.(*Fs).UploadFromFile(localPath, "/file1.txt"); err != nil {
+		t.Fatal("Could not upload file:", err)
+	}
+
+	if stat, err := fs.Stat("/file1.txt"); err != nil {
+		t.Fatal("Could not stat uploaded file:", err)
+	} else if stat.Size() != int64(len("Hello world !")) {
+		t.Fatal("Bad upload size:", stat.Size())
+	}
+}
+
+func TestReaddirStream(t *testing.T) {
+	fs := GetFs(t)
+
+	testCreateFile(t, fs, "a-file1", "content of file 1")
+	testCreateFile(t, fs, "b-file2", "content of file 2")
+	testCreateFile(t, fs, "b-file3", "content of file 3")
+
+	root, err := fs.Open("/")
+	if err != nil {
+		t.Fatal("Could not open root:", err)
+	}
+
+	fileInfos, errs := root.(*File).ReaddirStream(context.Background(), []string{"a", "b"})
+	count := 0
+	for range fileInfos {
+		count++
+	}
+	if err := <-errs; err != nil {
+		t.Fatal("Could not stream dir:", err)
+	}
+
+	if count != 3 {
+		t.Fatal(fmt.Sprintf("3 Blobs expected but %d streamed", count))
+	}
+}
+
+func TestStorageError(t *testing.T) {
+	fs := GetFs(t)
+
+	_, err := fs.Stat("/missing-file")
+	serr, ok := err.(*StorageError)
+	if !ok {
+		t.Fatal("Stat of a missing blob should return a *StorageError:", err)
+	}
+
+	if serr.StatusCode() != 404 || serr.ServiceCode() != azblob.ServiceCodeBlobNotFound || serr.RequestID() == "" {
+		t.Fatal("Bad storage error details:", serr.StatusCode(), serr.ServiceCode(), serr.RequestID())
+	}
+
+	// the description is what LogError logs, it must not vary per request
+	if serr.Description() != string(azblob.ServiceCodeBlobNotFound)+": "+serr.Unwrap().(azblob.StorageError).Response().Status {
+		t.Fatal("Bad storage error description:", serr.Description())
+	}
+}
+
+// recordingTransport - answers every request with an empty 200 response, counting them
+// and recording the User-Agent of the last one
+type recordingTransport struct {
+	requests  int
+	userAgent string
+}
+
+func (r *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.requests++
+	r.userAgent = req.Header.Get("User-Agent")
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func TestHTTPClientSender(t *testing.T) {
+	transport := &recordingTransport{}
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), CreateCache{HTTPClient: &http.Client{Transport: transport}}.pipelineOptions())
+	u, _ := url.Parse("https://afero.blob.core.windows.net")
+	containerURL := azblob.NewServiceURL(*u, p).NewContainerURL("afero-test")
+
+	if _, err := containerURL.GetProperties(context.Background(), azblob.LeaseAccessConditions{}); err != nil {
+		t.Fatal("Could not get container properties:", err)
+	}
+	if transport.requests != 1 {
+		t.Fatal("The request wasn't sent through the client:", transport.requests)
+	}
+}
+
+func TestCacheTelemetry(t *testing.T) {
+	transport := &recordingTransport{}
+	cache := CreateCache{HTTPClient: &http.Client{Transport: transport}, Telemetry: "myapp/1.0"}
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), cache.pipelineOptions())
+	u, _ := url.Parse("https://afero.blob.core.windows.net")
+	containerURL := azblob.NewServiceURL(*u, p).NewContainerURL("afero-test")
+
+	if _, err := containerURL.GetProperties(context.Background(), azblob.LeaseAccessConditions{}); err != nil {
+		t.Fatal("Could not get container properties:", err)
+	}
+	if !strings.HasPrefix(transport.userAgent, "myapp/1.0 ") {
+		t.Fatal("Telemetry not prepended to the User-Agent:", transport.userAgent)
+	}
+}
+
+func TestJitteredCycle(t *testing.T) {
+	cache := &ContainerCache{Cycle: 10}
+	cycles := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		cycle := cache.jitteredCycle()
+		if cycle < 10*time.Minute || cycle > 11*time.Minute {
+			t.Fatal("Jittered cycle out of bounds:", cycle)
+		}
+		cycles[cycle] = true
+	}
+	if len(cycles) < 2 {
+		t.Fatal("Cycles not jittered:", cycles)
+	}
+}
+
+// archivedTransport - serves the properties of any blob, but fails their downloads with BlobArchived
+type archivedTransport struct{}
+
+func (archivedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Length": {"13"},
+			"Last-Modified":  {time.Now().UTC().Format(http.TimeFormat)},
+		},
+		Body:    ioutil.NopCloser(strings.NewReader("")),
+		Request: req,
+	}
+	if req.Method == http.MethodGet {
+		resp.StatusCode = http.StatusConflict
+		resp.Header = http.Header{"X-Ms-Error-Code": {"BlobArchived"}}
+	}
+	return resp, nil
+}
+
+func TestBlobArchived(t *testing.T) {
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{
+		HTTPSender: NewHTTPClientSender(&http.Client{Transport: archivedTransport{}}),
+	})
+	u, _ := url.Parse("https://afero.blob.core.windows.net")
+	serviceURL := azblob.NewServiceURL(*u, p)
+	ctx := context.Background()
+	fs := NewFs(&ctx, &serviceURL, "afero-test", false)
+
+	file, err := fs.Open("/file1")
+	if err != nil {
+		t.Fatal("Could not open file:", err)
+	}
+	defer file.Close()
+	_, err = file.Read(make([]byte, 13))
+	var aerr *BlobArchivedError
+	if !errors.Is(err, ErrBlobArchived) || !errors.As(err, &aerr) || aerr.Name != "file1" {
+		t.Fatal("Reading an archived blob didn't fail with a *BlobArchivedError:", err)
+	}
+
+	if err := fs.Rehydrate("/file1", azblob.AccessTierArchive); !errors.Is(err, ErrNotSupported) {
+		t.Fatal("Rehydrating to the Archive tier didn't fail with ErrNotSupported:", err)
+	}
+}
+
+// gzipTransport - serves any blob as the gzip encoded body
+type gzipTransport struct {
+	body []byte
+}
+
+func (g *gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Length":   {fmt.Sprint(len(g.body))},
+			"Content-Encoding": {"gzip"},
+			"Last-Modified":    {time.Now().UTC().Format(http.TimeFormat)},
+		},
+		Body:    ioutil.NopCloser(strings.NewReader("")),
+		Request: req,
+	}
+	if req.Method == http.MethodGet {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(g.body))
+	}
+	return resp, nil
+}
+
+func TestDecompressGzip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("Hello world !"))
+	zw.Close()
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{
+		HTTPSender: NewHTTPClientSender(&http.Client{Transport: &gzipTransport{body: buf.Bytes()}}),
+	})
+	u, _ := url.Parse("https://afero.blob.core.windows.net")
+	serviceURL := azblob.NewServiceURL(*u, p)
+	ctx := context.Background()
+
+	fs := NewFsWithOptions(&ctx, &serviceURL, "afero-test", false, FsOptions{DecompressGzip: true})
+	if content, err := afero.ReadFile(fs, "/file1.gz"); err != nil || string(content) != "Hello world !" {
+		t.Fatal("Bad decompressed content:", string(content), err)
+	}
+	file, err := fs.Open("/file1.gz")
+	if err != nil {
+		t.Fatal("Could not open file:", err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(5, io.SeekStart); !errors.Is(err, ErrNotSupported) {
+		t.Fatal("Seeking a decompressed file didn't fail with ErrNotSupported:", err)
+	}
+	if _, err := file.ReadAt(make([]byte, 5), 0); !errors.Is(err, ErrNotSupported) {
+		t.Fatal("ReadAt on a decompressed file didn't fail with ErrNotSupported:", err)
+	}
+	if content, err := ioutil.ReadAll(file); err != nil || string(content) != "Hello world !" {
+		t.Fatal("Bad decompressed content after the rejected calls:", string(content), err)
+	}
+
+	// without the option the stored bytes are read
+	fs = NewFsWithOptions(&ctx, &serviceURL, "afero-test", false, FsOptions{})
+	if content, err := afero.ReadFile(fs, "/file1.gz"); err != nil || !bytes.Equal(content, buf.Bytes()) {
+		t.Fatal("Bad stored content:", content, err)
+	}
+}
+
+// busyTransport - answers every request with ServerBusy
+type busyTransport struct{}
+
+func (busyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Header:     http.Header{"X-Ms-Error-Code": {"ServerBusy"}},
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func TestBackoffThrottled(t *testing.T) {
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{
+		HTTPSender: NewHTTPClientSender(&http.Client{Transport: busyTransport{}}),
+		Retry:      azblob.RetryOptions{MaxTries: 1},
+	})
+	u, _ := url.Parse("https://afero.blob.core.windows.net")
+	containerURL := azblob.NewServiceURL(*u, p).NewContainerURL("afero-test")
+	_, err := containerURL.GetProperties(context.Background(), azblob.LeaseAccessConditions{})
+	err = wrapStorageError(err)
+	if !errors.Is(err, ErrThrottled) {
+		t.Fatal("ServerBusy doesn't match ErrThrottled:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	start := time.Now()
+	if !backoffThrottled(ctx, realClock{}, err, 0) {
+		t.Fatal("Throttled request not retried")
+	}
+	if waited := time.Since(start); waited < throttleMinDelay/2 {
+		t.Fatal("Retried without backing off:", waited)
+	}
+	if backoffThrottled(ctx, realClock{}, err, throttleMaxRetries) {
+		t.Fatal("Throttled request retried past the maximum")
+	}
+	if backoffThrottled(ctx, realClock{}, errors.New("not throttled"), 0) {
+		t.Fatal("Request retried without throttling")
+	}
+	cancel()
+	if backoffThrottled(ctx, realClock{}, err, 0) {
+		t.Fatal("Request retried once the context was done")
+	}
+}
+
+func TestAccountFs(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	afs := NewAccountFs(fs.ctx, fs.serviceURL, FsOptions{})
+
+	testCreateFile(t, afs, "/afero-test/dir1/file1", "Hello world !")
+
+	if stat, err := fs.Stat("/dir1/file1"); err != nil {
+		t.Fatal("Could not stat file written through the account:", err)
+	} else if stat.Size() != int64(len("Hello world !")) {
+		t.Fatal("Bad file size:", stat.Size())
+	}
+
+	root, err := afs.Open("/")
+	if err != nil {
+		t.Fatal("Could not open account root:", err)
+	}
+
+	names, err := root.Readdirnames(-1)
+	if err != nil {
+		t.Fatal("Could not list containers:", err)
+	}
+
+	found := false
+	for _, name := range names {
+		if name == "afero-test" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("Test container not listed at the account root")
+	}
+}
+
+func TestRangeCache(t *testing.T) {
+	rc := newRangeCache(2)
+	rc.put(0, []byte("Hello "))
+	rc.put(6, []byte("world "))
+
+	if data := rc.get(2); string(data) != "llo " {
+		t.Fatal("Bad cached range:", string(data))
+	}
+
+	// "world " is now the least recently used and gets evicted
+	rc.put(12, []byte("!"))
+
+	if data := rc.get(7); data != nil {
+		t.Fatal("Range should have been evicted:", string(data))
+	}
+
+	if data := rc.get(12); string(data) != "!" {
+		t.Fatal("Bad cached range:", string(data))
+	}
+}
+
+func TestHead(t *testing.T) {
+	fs := GetFs(t)
+	testCreateFile(t, fs, "/file1", "Hello world !")
+
+	if data, err := fs.(*Fs).Head("/file1", 5); err != nil {
+		t.Fatal("Could not read head:", err)
+	} else if string(data) != "Hello" {
+		t.Fatal("Bad head:", string(data))
+	}
+
+	if data, err := fs.(*Fs).Head("/file1", 1024); err != nil {
+		t.Fatal("Could not read head:", err)
+	} else if string(data) != "Hello world !" {
+		t.Fatal("Bad head:", string(data))
+	}
+}
+
+func TestOpenReader(t *testing.T) {
+	fs := GetFs(t)
+	content := bytes.Repeat([]byte("Hello world !"), 100000)
+	if err := afero.WriteFile(fs, "/file1", content, 0644); err != nil {
+		t.Fatal("Could not write file:", err)
+	}
+
+	reader, err := fs.(*Fs).OpenReader("/file1")
+	if err != nil {
+		t.Fatal("Could not open reader:", err)
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, reader); err != nil {
+		t.Fatal("Could not copy reader:", err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatal("Could not close reader:", err)
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Fatal("Bad content, read", buf.Len(), "bytes")
+	}
+
+	if _, err := fs.(*Fs).OpenReader("/file2"); err == nil {
+		t.Fatal("Opened a reader on a missing blob")
+	}
+}
+
+func TestOpenWriter(t *testing.T) {
+	fs := GetFs(t)
+	azrFs := NewFsWithOptions(fs.(*Fs).ctx, fs.(*Fs).serviceURL, fs.(*Fs).container, false, FsOptions{BlockSize: 1024, Parallelism: 3})
+	content := bytes.Repeat([]byte("Hello world !"), 1000)
+
+	writer, err := azrFs.OpenWriter("/file1.txt")
+	if err != nil {
+		t.Fatal("Could not open writer:", err)
+	}
+	for i := 0; i < len(content); i += 100 {
+		end := i + 100
+		if end > len(content) {
+			end = len(content)
+		}
+		if _, err := writer.Write(content[i:end]); err != nil {
+			t.Fatal("Could not write:", err)
+		}
+	}
+	if _, err := azrFs.Stat("/file1.txt"); err == nil {
+		t.Fatal("File visible before Close")
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal("Could not close writer:", err)
+	}
+	if _, err := writer.Write(content); !errors.Is(err, os.ErrClosed) {
+		t.Fatal("Write after Close didn't fail with os.ErrClosed:", err)
+	}
+
+	if data, err := afero.ReadFile(azrFs, "/file1.txt"); err != nil {
+		t.Fatal("Could not read file:", err)
+	} else if !bytes.Equal(data, content) {
+		t.Fatal("Bad content, read", len(data), "bytes")
+	}
+
+	// nothing written still creates the blob
+	writer, err = azrFs.OpenWriter("/file2")
+	if err != nil {
+		t.Fatal("Could not open writer:", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal("Could not close writer:", err)
+	}
+	if stat, err := azrFs.Stat("/file2"); err != nil {
+		t.Fatal("Could not stat empty file:", err)
+	} else if stat.Size() != 0 {
+		t.Fatal("Bad size:", stat.Size())
+	}
+}
+
+// hangingCommitTransport - blocks the block list commits until their request is cancelled while hang is set
+type hangingCommitTransport struct {
+	hang int32
+}
+
+func (h *hangingCommitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.LoadInt32(&h.hang) == 1 && req.URL.Query().Get("comp") == "blocklist" {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}
+	return testMemoryTransport.RoundTrip(req)
+}
+
+func TestCommitTimeout(t *testing.T) {
+	GetFs(t)
+	transport := &hangingCommitTransport{hang: 1}
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{
+		HTTPSender: NewHTTPClientSender(&http.Client{Transport: transport}),
+	})
+	u, _ := url.Parse("https://afero.blob.core.windows.net")
+	serviceURL := azblob.NewServiceURL(*u, p)
+	ctx := context.Background()
+	// the azblob retry policy truncates the time left to whole seconds, a sub-second timeout fails every try
+	fs := NewFsWithOptions(&ctx, &serviceURL, "afero-test", false, FsOptions{CommitTimeout: 1500 * time.Millisecond})
+
+	file, err := fs.Create("/file1")
+	if err != nil {
+		t.Fatal("Could not create file:", err)
+	}
+	if _, err := file.WriteString("Hello world !"); err != nil {
+		t.Fatal("Could not write file:", err)
+	}
+	start := time.Now()
+	if err := file.Close(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("Stuck commit didn't fail with context.DeadlineExceeded:", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("Commit timed out late:", time.Since(start))
+	}
+
+	// the staged blocks are kept, closing again retries the commit
+	atomic.StoreInt32(&transport.hang, 0)
+	if err := file.Close(); err != nil {
+		t.Fatal("Could not retry the commit:", err)
+	}
+	if content, err := afero.ReadFile(fs, "/file1"); err != nil {
+		t.Fatal("Could not read file:", err)
+	} else if string(content) != "Hello world !" {
+		t.Fatal("Bad content:", string(content))
+	}
+}
+
+func TestListDirs(t *testing.T) {
+	fs := GetFs(t)
+	for _, name := range []string{"/file1", "/dir1/file2", "/dir1/sub1/file3", "/dir1/sub2/sub3/file4", "/dir2/file5"} {
+		testCreateFile(t, fs, name, "Hello world !")
+	}
+
+	tests := map[string][]string{
+		"/":      {"dir1/", "dir2/"},
+		"/dir1":  {"dir1/sub1/", "dir1/sub2/"},
+		"dir1/":  {"dir1/sub1/", "dir1/sub2/"},
+		"/dir2":  {},
+		"/file1": {},
+	}
+	for prefix, expected := range tests {
+		dirs, err := fs.(*Fs).ListDirs(prefix)
+		if err != nil {
+			t.Fatal("Could not list dirs:", err)
+		}
+		if fmt.Sprint(dirs) != fmt.Sprint(expected) {
+			t.Fatal("Bad dirs for", prefix, ":", dirs)
+		}
+	}
+}
+
+func TestHTTPHeaders(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+
+	headers := azblob.BlobHTTPHeaders{CacheControl: "max-age=60", ContentDisposition: "attachment; filename=file1.txt"}
+	file, err := fs.OpenFileWithOptions("/file1", os.O_WRONLY, 0750, FileOptions{HTTPHeaders: headers})
+	if err != nil {
+		t.Fatal("Could not open file:", err)
+	}
+	if _, err := file.WriteString("Hello world !"); err != nil {
+		t.Fatal("Could not write file:", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal("Could not close file:", err)
+	}
+
+	props, err := fs.getBlobURL("file1").GetProperties(*fs.ctx, azblob.BlobAccessConditions{})
+	if err != nil {
+		t.Fatal("Could not get blob properties:", err)
+	}
+	if props.CacheControl() != headers.CacheControl || props.ContentDisposition() != headers.ContentDisposition {
+		t.Fatal("Headers not set at commit:", props.CacheControl(), props.ContentDisposition())
+	}
+
+	if err := fs.SetHTTPHeaders("/file1", azblob.BlobHTTPHeaders{CacheControl: "no-cache"}); err != nil {
+		t.Fatal("Could not set headers:", err)
+	}
+
+	props, err = fs.getBlobURL("file1").GetProperties(*fs.ctx, azblob.BlobAccessConditions{})
+	if err != nil {
+		t.Fatal("Could not get blob properties:", err)
+	}
+	if props.CacheControl() != "no-cache" {
+		t.Fatal("Headers not updated:", props.CacheControl())
+	}
+}
+
+func TestSync(t *testing.T) {
+	fs := GetFs(t)
+
+	file, err := fs.OpenFile("/file1", os.O_WRONLY, 0750)
+	if err != nil {
+		t.Fatal("Could not open file:", err)
+	}
+	if _, err := file.WriteString("Hello "); err != nil {
+		t.Fatal("Could not write file:", err)
+	}
+	if err := file.Sync(); err != nil {
+		t.Fatal("Could not sync file:", err)
+	}
+
+	if stat, err := fs.Stat("/file1"); err != nil {
+		t.Fatal("Synced file should exist:", err)
+	} else if stat.Size() != 6 {
+		t.Fatal("Bad synced size:", stat.Size())
+	}
+
+	if _, err := file.WriteString("world !"); err != nil {
+		t.Fatal("Could not write file:", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal("Could not close file:", err)
+	}
+
+	if stat, err := fs.Stat("/file1"); err != nil {
+		t.Fatal("Could not stat file:", err)
+	} else if stat.Size() != int64(len("Hello world !")) {
+		t.Fatal("Bad closed size:", stat.Size())
+	}
+}
+
+func TestOpenReaders(t *testing.T) {
+	fs := GetFs(t)
+	testCreateFile(t, fs, "/file1", "Hello world !")
+
+	readers, err := fs.(*Fs).OpenReaders("/file1", 2)
+	if err != nil {
+		t.Fatal("Could not open readers:", err)
+	}
+
+	buffer := make([]byte, 5)
+	if _, err := readers[1].ReadAt(buffer, 6); err != nil {
+		t.Fatal("Could not read:", err)
+	} else if string(buffer) != "world" {
+		t.Fatal("Bad fetch:", string(buffer))
+	}
+
+	if _, err := readers[0].Read(buffer); err != nil {
+		t.Fatal("Could not read:", err)
+	} else if string(buffer) != "Hello" {
+		t.Fatal("Readers should not share their offset:", string(buffer))
+	}
+
+	// Once the blob changes the pinned readers fail
+	testCreateFile(t, fs, "/file1", "Bye world !")
+	if _, err := readers[0].Read(buffer); err == nil {
+		t.Fatal("Reading a modified blob should fail")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+
+	localPath := os.TempDir() + "/afero-azrblob-checksum"
+	defer os.Remove(localPath)
+	if err := ioutil.WriteFile(localPath, []byte("Hello world !"), 0644); err != nil {
+		t.Fatal("Could not write local file:", err)
+	}
+
+	// single shot uploads get their MD5 stored by Azure
+	if err := fs.UploadFromFile(localPath, "/file1"); err != nil {
+		t.Fatal("Could not upload file:", err)
+	}
+
+	expected := md5.Sum([]byte("Hello world !"))
+	if sum, _, err := fs.Checksum("/file1"); err != nil {
+		t.Fatal("Could not get checksum:", err)
+	} else if !bytes.Equal(sum, expected[:]) {
+		t.Fatal("Bad checksum")
+	}
+
+	// blobs committed block by block don't have one
+	testCreateFile(t, fs, "/file2", "Hello world !")
+	if _, _, err := fs.Checksum("/file2"); err != ErrNoChecksum {
+		t.Fatal("Expected ErrNoChecksum:", err)
+	}
+}
+
+func TestImmutability(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+
+	// the test container has no legal hold nor immutability policy
+	legalHold, immutabilityPolicy, err := fs.Immutability()
+	if err != nil {
+		t.Fatal("Could not get immutability:", err)
+	}
+	if legalHold || immutabilityPolicy {
+		t.Fatal("Unexpected immutability:", legalHold, immutabilityPolicy)
+	}
+
+	if err := (&BlobImmutableError{Name: "file1"}); !errors.Is(err, ErrImmutable) {
+		t.Fatal("BlobImmutableError should match ErrImmutable")
+	}
+}
+
+func TestPing(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+
+	if err := fs.Ping(); err != nil {
+		t.Fatal("Could not ping the container:", err)
+	}
+
+	missing := NewFs(fs.ctx, fs.serviceURL, "afero-missing-container", false)
+	if err := missing.Ping(); err == nil {
+		t.Fatal("Ping of a missing container should fail")
+	}
+}
+
+func TestListEach(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+
+	for i := 0; i < 3; i++ {
+		testCreateFile(t, fs, fmt.Sprintf("/dir1/file%d", i), "Hello world !")
+	}
+
+	count := 0
+	if err := fs.ListEach("/dir1/", func(fi os.FileInfo) error {
+		count++
+		return nil
+	}); err != nil {
+		t.Fatal("Could not list blobs:", err)
+	}
+	if count != 3 {
+		t.Fatal("Bad number of blobs:", count)
+	}
+
+	// the error of the callback stops the listing
+	stop := errors.New("stop")
+	count = 0
+	if err := fs.ListEach("/dir1/", func(fi os.FileInfo) error {
+		count++
+		return stop
+	}); err != stop {
+		t.Fatal("Expected the callback error:", err)
+	}
+	if count != 1 {
+		t.Fatal("Listing should have stopped after the first blob:", count)
+	}
+}
+
+func TestEntryNames(t *testing.T) {
+	fileInfos := []os.FileInfo{
+		NewFileInfo("dir1/file1", false, 0, time.Now()),
+		NewFileInfo("dir1/sub1/file2", false, 0, time.Now()),
+		NewFileInfo("dir1/sub1/file3", false, 0, time.Now()),
+		NewFileInfo("dir1/sub2/file4", false, 0, time.Now()),
+	}
+
+	names := entryNames(fileInfos, "dir1/", "/", "")
+	if len(names) != 3 || names[0] != "file1" || names[1] != "sub1" || names[2] != "sub2" {
+		t.Fatal("Bad entry names:", names)
+	}
+
+	names = entryNames(fileInfos, "", "/", "")
+	if len(names) != 1 || names[0] != "dir1" {
+		t.Fatal("Bad root entry names:", names)
+	}
+}
+
+func TestReaddirnamesPaged(t *testing.T) {
+	fs := GetFs(t)
+	for _, name := range []string{"/dir1/a", "/dir1/b", "/dir1/c", "/dir1/d", "/file1", "/sub1/e"} {
+		testCreateFile(t, fs, name, "Hello world !")
+	}
+
+	dir, err := fs.Open("/")
+	if err != nil {
+		t.Fatal("Could not open root:", err)
+	}
+	// the second page only holds dir1 again
+	var pages [][]string
+	for {
+		names, err := dir.Readdirnames(2)
+		if err == io.EOF {
+			break
+		}
+		if err != nil || len(names) == 0 {
+			t.Fatal("Could not read names:", names, err)
+		}
+		pages = append(pages, names)
+	}
+	if fmt.Sprint(pages) != "[[dir1] [file1 sub1]]" {
+		t.Fatal("Bad pages of names:", pages)
+	}
+
+	// the next listing starts over
+	if names, err := dir.Readdirnames(2); err != nil || fmt.Sprint(names) != "[dir1]" {
+		t.Fatal("Bad first page of the next listing:", names, err)
+	}
+}
+
+func TestDelimiter(t *testing.T) {
+	base := GetFs(t).(*Fs)
+	fs := NewFsWithOptions(base.ctx, base.serviceURL, base.container, false, FsOptions{Delimiter: ":"})
+	for _, name := range []string{"/tenant1:file1", "/tenant1:2024:file2", "/tenant1:2025:file3", "/tenant2:file4"} {
+		testCreateFile(t, fs, name, "Hello world !")
+	}
+
+	if dirs, err := fs.ListDirs("/"); err != nil {
+		t.Fatal("Could not list dirs:", err)
+	} else if fmt.Sprint(dirs) != "[tenant1: tenant2:]" {
+		t.Fatal("Bad root dirs:", dirs)
+	}
+	if dirs, err := fs.ListDirs("tenant1"); err != nil {
+		t.Fatal("Could not list dirs:", err)
+	} else if fmt.Sprint(dirs) != "[tenant1:2024: tenant1:2025:]" {
+		t.Fatal("Bad dirs:", dirs)
+	}
+
+	dir, err := fs.Open("/tenant1:")
+	if err != nil {
+		t.Fatal("Could not open dir:", err)
+	}
+	if names, err := dir.Readdirnames(-1); err != nil {
+		t.Fatal("Could not read names:", err)
+	} else if fmt.Sprint(names) != "[2024 2025 file1]" {
+		t.Fatal("Bad names:", names)
+	}
+
+	// the base names are cut at the delimiter too
+	if stat, err := fs.Stat("/tenant1:2024:file2"); err != nil || stat.Name() != "file2" {
+		t.Fatal("Bad stat name:", stat, err)
+	}
+	if dir, err = fs.Open("/tenant1:2024:"); err != nil {
+		t.Fatal("Could not open dir:", err)
+	} else if name := dir.(*File).cachedInfo.Name(); name != "2024" {
+		t.Fatal("Bad dir name:", name)
+	}
+	if dir, err = fs.Open("/tenant2:"); err != nil {
+		t.Fatal("Could not open dir:", err)
+	} else if fileInfos, err := dir.Readdir(-1); err != nil || len(fileInfos) != 1 || fileInfos[0].Name() != "file4" {
+		t.Fatal("Bad listed names:", fileInfos, err)
+	}
+}
+
+func TestCreationTime(t *testing.T) {
+	fs := GetFs(t)
+	testCreateFile(t, fs, "/file1", "Hello world !")
+
+	stat, err := fs.Stat("/file1")
+	if err != nil {
+		t.Fatal("Could not stat file:", err)
+	}
+	created := stat.(*FileInfo).CreationTime()
+	if created.IsZero() {
+		t.Fatal("No creation time")
+	}
+	if sys, ok := stat.Sys().(*BlobSys); !ok || !sys.CreationTime.Equal(created) {
+		t.Fatal("Bad Sys:", stat.Sys())
+	}
+
+	// overwriting changes the modification time only
+	time.Sleep(1100 * time.Millisecond)
+	testCreateFile(t, fs, "/file1", "Hello again !")
+	if stat, err = fs.Stat("/file1"); err != nil {
+		t.Fatal("Could not stat file:", err)
+	}
+	if !stat.(*FileInfo).CreationTime().Equal(created) {
+		t.Fatal("Creation time changed:", stat.(*FileInfo).CreationTime(), created)
+	}
+	if !stat.ModTime().After(created) {
+		t.Fatal("Modification time not updated:", stat.ModTime())
+	}
+
+	root, err := fs.Open("/")
+	if err != nil {
+		t.Fatal("Could not open root:", err)
+	}
+	if fi, err := root.Readdir(-1); err != nil || len(fi) != 1 {
+		t.Fatal("Could not readdir:", err)
+	} else if !fi[0].(FileInfo).CreationTime().Equal(created) {
+		t.Fatal("Bad listed creation time:", fi[0].(FileInfo).CreationTime())
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	testCreateFile(t, fs, "/file1", "Hello world !")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := fs.WithContext(ctx).Stat("/file1"); !errors.Is(err, context.Canceled) {
+		t.Fatal("Stat with a cancelled context didn't fail with context.Canceled:", err)
+	}
+
+	// the original Fs keeps its context
+	if _, err := fs.Stat("/file1"); err != nil {
+		t.Fatal("Could not stat file:", err)
+	}
+}
+
+func TestSetTierBatch(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	names := []string{"/file1", "/file2", "/dir1/file3"}
+	for _, name := range names {
+		testCreateFile(t, fs, name, "Hello world !")
+	}
+
+	if err := fs.SetTierBatch(names, azblob.AccessTierCool); err != nil {
+		t.Fatal("Could not set tiers:", err)
+	}
+	for _, name := range names {
+		props, err := fs.BlobURL(name).GetProperties(context.Background(), azblob.BlobAccessConditions{})
+		if err != nil {
+			t.Fatal("Could not get properties:", err)
+		}
+		if props.AccessTier() != string(azblob.AccessTierCool) {
+			t.Fatal("Bad tier for", name, ":", props.AccessTier())
+		}
+	}
+
+	// the failures are reported per blob, the others are still moved
+	err := fs.SetTierBatch([]string{"/file1", "/file4"}, azblob.AccessTierHot)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatal("Expected a *BatchError:", err)
+	}
+	if len(batchErr.Errors) != 1 || !hasServiceCode(batchErr.Errors["/file4"], azblob.ServiceCodeBlobNotFound) {
+		t.Fatal("Bad batch errors:", batchErr.Errors)
+	}
+	if props, err := fs.BlobURL("/file1").GetProperties(context.Background(), azblob.BlobAccessConditions{}); err != nil {
+		t.Fatal("Could not get properties:", err)
+	} else if props.AccessTier() != string(azblob.AccessTierHot) {
+		t.Fatal("Bad tier:", props.AccessTier())
+	}
+}
+
+func TestOpenSnapshotReader(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	testCreateFile(t, fs, "/file1", "Hello world !")
+
+	blobURL := fs.BlobURL("/file1")
+	snapshot, err := blobURL.CreateSnapshot(context.Background(), nil, azblob.BlobAccessConditions{})
+	if err != nil {
+		t.Fatal("Could not create snapshot:", err)
+	}
+	defer blobURL.Delete(context.Background(), azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+
+	testCreateFile(t, fs, "/file1", "Hello again, world !")
+
+	file, err := fs.OpenSnapshotReader("/file1", snapshot.Snapshot())
+	if err != nil {
+		t.Fatal("Could not open snapshot:", err)
+	}
+	if stat, err := file.Stat(); err != nil {
+		t.Fatal("Could not stat snapshot:", err)
+	} else if stat.Size() != int64(len("Hello world !")) {
+		t.Fatal("Bad snapshot size:", stat.Size())
+	}
+	if content, err := ioutil.ReadAll(file); err != nil {
+		t.Fatal("Could not read snapshot:", err)
+	} else if string(content) != "Hello world !" {
+		t.Fatal("Bad snapshot content:", string(content))
+	}
+	file.Close()
+
+	if content, err := afero.ReadFile(fs, "/file1"); err != nil {
+		t.Fatal("Could not read file:", err)
+	} else if string(content) != "Hello again, world !" {
+		t.Fatal("Bad content:", string(content))
+	}
+
+	if _, err := fs.OpenSnapshotReader("/file1", "2001-01-01T00:00:00.0000000Z"); !hasServiceCode(err, azblob.ServiceCodeBlobNotFound) {
+		t.Fatal("Opening a missing snapshot didn't fail with BlobNotFound:", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	fs := NewFsWithOptions(&ctx, nil, "afero-test", false, FsOptions{ReadOnly: true})
+
+	// every write is refused before reaching Azure
+	if _, err := fs.Create("/file1"); !errors.Is(err, syscall.EROFS) {
+		t.Fatal("Create should be refused:", err)
+	}
+	if _, err := fs.OpenFile("/file1", os.O_WRONLY, 0777); !errors.Is(err, syscall.EROFS) {
+		t.Fatal("OpenFile for writing should be refused:", err)
+	}
+	if err := fs.Mkdir("/dir1", 0750); !errors.Is(err, syscall.EROFS) {
+		t.Fatal("Mkdir should be refused:", err)
+	}
+	if err := fs.Remove("/file1"); !errors.Is(err, syscall.EROFS) {
+		t.Fatal("Remove should be refused:", err)
+	}
+	if err := fs.RemoveAll("/"); !errors.Is(err, syscall.EROFS) {
+		t.Fatal("RemoveAll should be refused:", err)
+	}
+	if err := fs.Rename("/file1", "/file2"); !errors.Is(err, syscall.EROFS) {
+		t.Fatal("Rename should be refused:", err)
+	}
+}
+
+func TestInMemoryCache(t *testing.T) {
+	modified := time.Now().UTC().Format(cacheDateFormat)
+	cache := ContainerCache{Container: "afero-test", Path: "/nonexistent", inMemory: true, view: &memoryCache{}}
+	cache.view.set([][]string{
+		{"dir1/file1", "12", modified},
+		{"dir1/file2", "34", modified},
+		{"file3", "56", modified},
+	})
+
+	// reading never touches Path
+	fi, err := cache.ReadCache("dir1/", "", "", -1)
+	if err != nil {
+		t.Fatal("Could not read the in memory cache:", err)
+	}
+	if len(fi) != 2 || fi[0].Name() != "file1" || fi[0].(FileInfo).FullName() != "dir1/file1" || fi[1].Size() != 34 {
+		t.Fatal("Bad in memory cache listing:", fi)
+	}
+
+	if err := cache.renameNew(); err != nil {
+		t.Fatal("renameNew should be a no-op for in memory caches:", err)
+	}
+}
+
+// listRecordingTransport - records the maxresults parameter of the listing requests
+type listRecordingTransport struct {
+	mu         sync.Mutex
+	maxResults []string
+}
+
+func (l *listRecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Query().Get("comp") == "list" {
+		l.mu.Lock()
+		l.maxResults = append(l.maxResults, req.URL.Query().Get("maxresults"))
+		l.mu.Unlock()
+	}
+	return testMemoryTransport.RoundTrip(req)
+}
+
+func TestListPageSize(t *testing.T) {
+	GetFs(t)
+	transport := &listRecordingTransport{}
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{
+		HTTPSender: NewHTTPClientSender(&http.Client{Transport: transport}),
+	})
+	u, _ := url.Parse("https://afero.blob.core.windows.net")
+	serviceURL := azblob.NewServiceURL(*u, p)
+	ctx := context.Background()
+	fs := NewFsWithOptions(&ctx, &serviceURL, "afero-test", false, FsOptions{ListPageSize: 2})
+
+	for i := 0; i < 5; i++ {
+		testCreateFile(t, fs, fmt.Sprintf("/file%d", i), "Hello world !")
+	}
+
+	// the listing spans several small pages
+	root, err := fs.Open("/")
+	if err != nil {
+		t.Fatal("Could not open root:", err)
+	}
+	if fi, err := root.(*File).ReaddirAll(); err != nil {
+		t.Fatal("Could not readdir:", err)
+	} else if len(fi) != 5 {
+		t.Fatal(fmt.Sprintf("5 Blobs expected but %d returned", len(fi)))
+	}
+	if fmt.Sprint(transport.maxResults) != "[2 2 2]" {
+		t.Fatal("Bad page sizes of ReaddirAll:", transport.maxResults)
+	}
+
+	transport.maxResults = nil
+	if err := fs.ListEach("", func(os.FileInfo) error { return nil }); err != nil {
+		t.Fatal("Could not list:", err)
+	}
+	if fmt.Sprint(transport.maxResults) != "[2 2 2]" {
+		t.Fatal("Bad page sizes of ListEach:", transport.maxResults)
+	}
+}
+
+func TestReaddirPages(t *testing.T) {
+	base := GetFs(t).(*Fs)
+	fs := NewFsWithOptions(base.ctx, base.serviceURL, base.container, false, FsOptions{ListPageSize: 2})
+
+	// exactly two full pages
+	for i := 0; i < 4; i++ {
+		testCreateFile(t, fs, fmt.Sprintf("/file%d", i), "Hello world !")
+	}
+
+	root, err := fs.Open("/")
+	if err != nil {
+		t.Fatal("Could not open root:", err)
+	}
+	for pass := 0; pass < 2; pass++ {
+		var names []string
+		for calls := 0; ; calls++ {
+			if calls > 4 {
+				t.Fatal("Readdir didn't terminate")
+			}
+			fi, err := root.Readdir(2)
+			if err == io.EOF {
+				if len(fi) != 0 {
+					t.Fatal("Entries returned with io.EOF:", len(fi))
+				}
+				break
+			}
+			if err != nil {
+				t.Fatal("Could not readdir:", err)
+			}
+			for _, info := range fi {
+				names = append(names, info.Name())
+			}
+		}
+		if fmt.Sprint(names) != "[file0 file1 file2 file3]" {
+			t.Fatal("Bad entries on pass", pass, ":", names)
+		}
+	}
+
+	// a partial Readdir doesn't shorten ReaddirAll
+	if _, err := root.Readdir(2); err != nil {
+		t.Fatal("Could not readdir:", err)
+	}
+	for pass := 0; pass < 2; pass++ {
+		if fi, err := root.(*File).ReaddirAll(); err != nil {
+			t.Fatal("Could not readdir:", err)
+		} else if len(fi) != 4 {
+			t.Fatal(fmt.Sprintf("4 Blobs expected but %d returned", len(fi)))
+		}
+	}
+}
+
+func TestReaddirEmpty(t *testing.T) {
+	fs := GetFs(t)
+	testCreateFile(t, fs, "/dir1/file1", "Hello world !")
+
+	for _, name := range []string{"/dir2/", "/none*"} {
+		dir, err := fs.Open(name)
+		if err != nil {
+			t.Fatal("Could not open", name, ":", err)
+		}
+		if fi, err := dir.Readdir(10); err != io.EOF || fi == nil || len(fi) != 0 {
+			t.Fatal("Expected an empty slice with io.EOF for", name, ":", fi, err)
+		}
+		if fi, err := dir.Readdir(-1); err != nil || fi == nil || len(fi) != 0 {
+			t.Fatal("Expected an empty slice for", name, ":", fi, err)
+		}
+	}
+
+	// a failed listing isn't an empty directory
+	base := fs.(*Fs)
+	missing := NewFs(base.ctx, base.serviceURL, "afero-missing", false)
+	dir, err := missing.Open("/dir1/")
+	if err != nil {
+		t.Fatal("Could not open dir:", err)
+	}
+	if _, err := dir.Readdir(10); !hasServiceCode(err, azblob.ServiceCodeContainerNotFound) {
+		t.Fatal("Listing a missing container didn't fail with ContainerNotFound:", err)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	for _, name := range []string{"/logs/2023-12-31.log", "/logs/2024-01-01.log", "/logs/2024-01-02.log", "/logs/2024-01-03.txt", "/other/2024-01-01.log"} {
+		testCreateFile(t, fs, name, "Hello world !")
+	}
+
+	if names, err := fs.Glob("/logs/2024-*.log"); err != nil {
+		t.Fatal("Could not glob:", err)
+	} else if fmt.Sprint(names) != "[logs/2024-01-01.log logs/2024-01-02.log]" {
+		t.Fatal("Bad matches:", names)
+	}
+	if names, err := fs.Glob("*/2024-01-01.log"); err != nil {
+		t.Fatal("Could not glob:", err)
+	} else if fmt.Sprint(names) != "[logs/2024-01-01.log other/2024-01-01.log]" {
+		t.Fatal("Bad matches:", names)
+	}
+	if names, err := fs.GlobN("/logs/2024-*", 2); err != nil {
+		t.Fatal("Could not glob:", err)
+	} else if fmt.Sprint(names) != "[logs/2024-01-01.log logs/2024-01-02.log]" {
+		t.Fatal("Bad limited matches:", names)
+	}
+	if names, err := fs.Glob("/logs/2025-*"); err != nil {
+		t.Fatal("Could not glob:", err)
+	} else if names == nil || len(names) != 0 {
+		t.Fatal("Expected no matches:", names)
+	}
+
+	// the regular expression metacharacters are matched literally
+	for _, name := range []string{"/x+y/c", "/xxy/c", "/a(1)/b", "/cost$/d", "/cost/d"} {
+		testCreateFile(t, fs, name, "Hello world !")
+	}
+	for pattern, expected := range map[string]string{
+		"/x+y/*":                  "[x+y/c]",
+		"/a(1)/*":                 "[a(1)/b]",
+		"/cost$/*":                "[cost$/d]",
+		"/logs/2024-01-0[12].log": "[logs/2024-01-01.log logs/2024-01-02.log]",
+		"/logs/2024-01-0[!12].*":  "[logs/2024-01-03.txt]",
+	} {
+		if names, err := fs.Glob(pattern); err != nil {
+			t.Fatal("Could not glob", pattern, ":", err)
+		} else if fmt.Sprint(names) != expected {
+			t.Fatal("Bad matches of", pattern, ":", names)
+		}
+	}
+}
+
+func TestRemoveDir(t *testing.T) {
+	fs := GetFs(t)
+
+	if err := fs.Mkdir("/dir1", 0750); err != nil {
+		t.Fatal("Could not create dir:", err)
+	}
+	testCreateFile(t, fs, "/dir1/file1", "Hello world !")
+
+	if err := fs.Remove("/dir1"); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Fatal("Removing a non-empty dir should fail with ENOTEMPTY:", err)
+	}
+
+	if err := fs.Remove("/dir1/file1"); err != nil {
+		t.Fatal("Could not remove file:", err)
+	}
+	if err := fs.Remove("/dir1"); err != nil {
+		t.Fatal("Could not remove the empty dir:", err)
+	}
+
+	if err := fs.Remove("/dir1"); err == nil {
+		t.Fatal("Removing a missing dir should fail")
+	}
+}
+
+func TestCopyFromURL(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	testCreateFile(t, fs, "/file1", "Hello world !")
+
+	srcURL := fs.getBlobURL("file1").URL()
+	if err := fs.CopyFromURL(srcURL.String(), "/file2"); err != nil {
+		t.Fatal("Could not copy from URL:", err)
+	}
+
+	if stat, err := fs.Stat("/file2"); err != nil {
+		t.Fatal("Could not stat copied file:", err)
+	} else if stat.Size() != int64(len("Hello world !")) {
+		t.Fatal("Bad copy size:", stat.Size())
+	}
+}
+
+func TestReaddirOnBlob(t *testing.T) {
+	ctx := context.Background()
+	fs := NewFs(&ctx, nil, "afero-test", false)
+
+	// a File opened on a blob isn't a directory
+	file := NewFile(fs, "/file1")
+	file.openRead(NewFileInfo("file1", false, 12, time.Now()))
+
+	if _, err := file.Readdir(-1); !errors.Is(err, syscall.ENOTDIR) {
+		t.Fatal("Readdir of a blob should fail with ENOTDIR:", err)
+	}
+	if _, err := file.Readdirnames(-1); !errors.Is(err, syscall.ENOTDIR) {
+		t.Fatal("Readdirnames of a blob should fail with ENOTDIR:", err)
+	}
+}
+
+func TestBufferWrites(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+
+	file, err := fs.OpenFileWithOptions("/file1", os.O_WRONLY, 0777, FileOptions{BufferWrites: true})
+	if err != nil {
+		t.Fatal("Could not open file:", err)
+	}
+
+	if _, err := file.WriteString("Hello world !"); err != nil {
+		t.Fatal("Could not write file:", err)
+	}
+
+	// go back to patch the beginning
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		t.Fatal("Could not seek in buffered write:", err)
+	}
+	if _, err := file.WriteString("J"); err != nil {
+		t.Fatal("Could not write file:", err)
+	}
+	if _, err := file.WriteAt([]byte("W"), 6); err != nil {
+		t.Fatal("Could not write at:", err)
+	}
+
+	if err := file.Close(); err != nil {
+		t.Fatal("Could not close file:", err)
+	}
+
+	if content, err := afero.ReadFile(fs, "/file1"); err != nil {
+		t.Fatal("Could not read file:", err)
+	} else if string(content) != "Jello World !" {
+		t.Fatal("Bad content:", string(content))
+	}
+}
+
+func TestBlobType(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	testCreateFile(t, fs, "/file1", "Hello world !")
+
+	if blobType, err := fs.BlobType("/file1"); err != nil {
+		t.Fatal("Could not get blob type:", err)
+	} else if blobType != azblob.BlobBlockBlob {
+		t.Fatal("Bad blob type:", blobType)
+	}
+
+	stat, err := fs.Stat("/file1")
+	if err != nil {
+		t.Fatal("Could not stat file:", err)
+	}
+	if sys, ok := stat.Sys().(*BlobSys); !ok || sys.BlobType != azblob.BlobBlockBlob {
+		t.Fatal("Bad Sys data:", stat.Sys())
+	}
+}
+
+func TestSpecialCharacters(t *testing.T) {
+	fs := GetFs(t)
+	name := "/dir1/a b#c?.txt"
+
+	testCreateFile(t, fs, name, "Hello world !")
+
+	if stat, err := fs.Stat(name); err != nil {
+		t.Fatal("Could not stat file:", err)
+	} else if stat.IsDir() || stat.Size() != int64(len("Hello world !")) {
+		t.Fatal("Bad stat of a name with special characters:", stat.IsDir(), stat.Size())
+	}
+
+	if content, err := afero.ReadFile(fs, name); err != nil {
+		t.Fatal("Could not read file:", err)
+	} else if string(content) != "Hello world !" {
+		t.Fatal("Bad content:", string(content))
+	}
+
+	if err := fs.Remove(name); err != nil {
+		t.Fatal("Could not remove file:", err)
+	}
+	// once removed the name is only a wildcard listing
+	if _, err := fs.Stat(name); !errors.Is(err, ErrWildcard) {
+		t.Fatal("File should have been removed:", err)
+	}
+}
+
+func TestStatWildcard(t *testing.T) {
+	fs := GetFs(t)
+	testCreateFile(t, fs, "/file1", "Hello world !")
+	testCreateFile(t, fs, "/file2", "Hello world !")
+
+	var pathErr *os.PathError
+	if _, err := fs.Stat("/file*"); !errors.Is(err, ErrWildcard) || !errors.As(err, &pathErr) {
+		t.Fatal("Stat of a wildcard name didn't fail with ErrWildcard:", err)
+	}
+
+	// opening it still lists the matches
+	dir, err := fs.Open("/file*")
+	if err != nil {
+		t.Fatal("Could not open wildcard:", err)
+	}
+	if fi, err := dir.Readdir(-1); err != nil {
+		t.Fatal("Could not readdir:", err)
+	} else if len(fi) != 2 {
+		t.Fatal("2 Blobs expected but", len(fi), "returned")
+	}
+}
+
+func TestWaitForBlob(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+
+	if err := fs.WaitForBlob("/file1", time.Second); err != context.DeadlineExceeded {
+		t.Fatal("Waiting for a missing blob should time out:", err)
+	}
+
+	created := make(chan error, 1)
+	go func() {
+		time.Sleep(time.Second)
+		created <- afero.WriteFile(fs, "/file1", []byte("Hello world !"), 0750)
+	}()
+	if err := fs.WaitForBlob("/file1", 30*time.Second); err != nil {
+		t.Fatal("Could not wait for blob:", err)
+	}
+	if err := <-created; err != nil {
+		t.Fatal("Could not create file:", err)
+	}
+}
+
+func TestOpenTrailingSlash(t *testing.T) {
+	fs := GetFs(t)
+	testCreateFile(t, fs, "/logs/file1", "Hello world !")
+	testCreateFile(t, fs, "/logs/file2", "Hello world !")
+	testCreateFile(t, fs, "/other", "Hello world !")
+
+	dir, err := fs.Open("/logs/")
+	if err != nil {
+		t.Fatal("Could not open dir:", err)
+	}
+
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		t.Fatal("Could not readdir:", err)
+	}
+	if len(names) != 2 || names[0] != "file1" || names[1] != "file2" {
+		t.Fatal("Bad dir listing:", names)
+	}
+}
+
+func TestIncrementalCopyNeedsSnapshot(t *testing.T) {
+	ctx := context.Background()
+	fs := NewFs(&ctx, nil, "afero-test", false)
+
+	// the source must be a page blob snapshot
+	if _, err := fs.IncrementalCopy("https://account.blob.core.windows.net/disks/disk1.vhd", "/disk1.vhd"); err == nil {
+		t.Fatal("IncrementalCopy from a URL without snapshot should fail")
+	}
+}
+
+func TestRootPrefixNames(t *testing.T) {
+	ctx := context.Background()
+	fs := NewFsWithOptions(&ctx, nil, "afero-test", false, FsOptions{RootPrefix: "/tenant1/"})
+
+	for name, expected := range map[string]string{
+		"file1":         "tenant1/file1",
+		"dir1/":         "tenant1/dir1/",
+		"../file1":      "tenant1/file1",
+		"dir1/../../f1": "tenant1/f1",
+	} {
+		if blobName := fs.blobName(name); blobName != expected {
+			t.Fatal("Bad blob name for", name, ":", blobName)
+		}
+	}
+
+	if name := fs.relativeName("tenant1/dir1/file1"); name != "dir1/file1" {
+		t.Fatal("Bad relative name:", name)
+	}
+}
+
+func TestRootPrefix(t *testing.T) {
+	base := GetFs(t).(*Fs)
+	tenant1 := NewFsWithOptions(base.ctx, base.serviceURL, base.container, false, FsOptions{RootPrefix: "tenant1"})
+	tenant2 := NewFsWithOptions(base.ctx, base.serviceURL, base.container, false, FsOptions{RootPrefix: "tenant2"})
+
+	testCreateFile(t, tenant1, "/file1", "Hello world !")
+
+	// the blob lives under the prefix
+	if _, err := base.Stat("/tenant1/file1"); err != nil {
+		t.Fatal("Could not stat the prefixed blob:", err)
+	}
+	if _, err := tenant2.Stat("/file1"); err == nil {
+		t.Fatal("Other tenants should not see the file")
+	}
+
+	root, err := tenant1.Open("/")
+	if err != nil {
+		t.Fatal("Could not open root:", err)
+	}
+	if names, err := root.Readdirnames(-1); err != nil {
+		t.Fatal("Could not readdir:", err)
+	} else if len(names) != 1 || names[0] != "file1" {
+		t.Fatal("Bad listing under the prefix:", names)
+	}
+}
+
+func TestContentCache(t *testing.T) {
+	cache := newContentCache(10)
+
+	cache.put("file1", "etag1", []byte("12345"))
+	cache.put("file2", "etag2", []byte("12345"))
+	if cached := cache.get("file1"); cached == nil || cached.etag != "etag1" {
+		t.Fatal("file1 should be cached")
+	}
+
+	// file2 is the least recently used and gets evicted
+	cache.put("file3", "etag3", []byte("123"))
+	if cache.get("file2") != nil {
+		t.Fatal("file2 should have been evicted")
+	}
+	if cache.get("file1") == nil || cache.get("file3") == nil {
+		t.Fatal("file1 and file3 should be cached")
+	}
+
+	// blobs bigger than the cache are never kept
+	cache.put("file4", "etag4", []byte("12345678901"))
+	if cache.get("file4") != nil {
+		t.Fatal("file4 is too big to be cached")
+	}
+}
+
+func TestContentCacheRead(t *testing.T) {
+	base := GetFs(t).(*Fs)
+	fs := NewFsWithOptions(base.ctx, base.serviceURL, base.container, false, FsOptions{ContentCacheSize: 1024})
+
+	testCreateFile(t, fs, "/file1", "Hello world !")
+	for i := 0; i < 2; i++ {
+		if content, err := afero.ReadFile(fs, "/file1"); err != nil {
+			t.Fatal("Could not read file:", err)
+		} else if string(content) != "Hello world !" {
+			t.Fatal("Bad content:", string(content))
+		}
+	}
+
+	// a changed blob is downloaded again
+	testCreateFile(t, fs, "/file1", "Hello again !")
+	if content, err := afero.ReadFile(fs, "/file1"); err != nil {
+		t.Fatal("Could not read file:", err)
+	} else if string(content) != "Hello again !" {
+		t.Fatal("Stale content:", string(content))
+	}
+}
+
+func TestURLAccessors(t *testing.T) {
+	u, _ := url.Parse("https://account.blob.core.windows.net")
+	serviceURL := azblob.NewServiceURL(*u, azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{}))
+	ctx := context.Background()
+	fs := NewFsWithOptions(&ctx, &serviceURL, "afero-test", false, FsOptions{RootPrefix: "tenant1"})
+
+	containerURL := fs.ContainerURL()
+	if u := containerURL.URL(); u.String() != "https://account.blob.core.windows.net/afero-test" {
+		t.Fatal("Bad container URL:", u.String())
+	}
+
+	blobURL := fs.BlobURL("/dir1/file1")
+	if u := blobURL.URL(); u.String() != "https://account.blob.core.windows.net/afero-test/tenant1/dir1/file1" {
+		t.Fatal("Bad blob URL:", u.String())
+	}
+}
+
+// corruptCopyTransport - makes the copies read the blob "decoy" instead of their source while corrupt is set
+type corruptCopyTransport struct {
+	corrupt int32
+}
+
+func (c *corruptCopyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if src := req.Header.Get("x-ms-copy-source"); src != "" && atomic.LoadInt32(&c.corrupt) == 1 {
+		req.Header.Set("x-ms-copy-source", src[:strings.LastIndex(src, "/")+1]+"decoy")
+	}
+	return testMemoryTransport.RoundTrip(req)
+}
+
+func TestVerifyCopies(t *testing.T) {
+	GetFs(t)
+	transport := &corruptCopyTransport{}
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{
+		HTTPSender: NewHTTPClientSender(&http.Client{Transport: transport}),
+	})
+	u, _ := url.Parse("https://afero.blob.core.windows.net")
+	serviceURL := azblob.NewServiceURL(*u, p)
+	ctx := context.Background()
+	fs := NewFsWithOptions(&ctx, &serviceURL, "afero-test", false, FsOptions{VerifyCopies: true})
+
+	// blobs committed from blocks have no stored MD5 and are hashed
+	testCreateFile(t, fs, "/file1", "Hello world !")
+	testCreateFile(t, fs, "/decoy", "Hello decoy !")
+	if err := fs.Copy("/file1", "/file2"); err != nil {
+		t.Fatal("Could not copy file:", err)
+	}
+	if err := fs.Rename("/file2", "/file3"); err != nil {
+		t.Fatal("Could not rename file:", err)
+	}
+	if content, err := afero.ReadFile(fs, "/file3"); err != nil {
+		t.Fatal("Could not read file:", err)
+	} else if string(content) != "Hello world !" {
+		t.Fatal("Bad content:", string(content))
+	}
+
+	// a bad copy is deleted and the source is kept
+	atomic.StoreInt32(&transport.corrupt, 1)
+	if err := fs.Rename("/file1", "/file4"); !errors.Is(err, ErrCopyVerificationFailed) {
+		t.Fatal("Bad copy didn't fail with ErrCopyVerificationFailed:", err)
+	}
+	if _, err := fs.Stat("/file1"); err != nil {
+		t.Fatal("Source of a bad copy was deleted:", err)
+	}
+	if _, err := fs.Stat("/file4"); err == nil {
+		t.Fatal("Bad copy was kept:", err)
+	}
+	if err := fs.Copy("/file1", "/file4"); !errors.Is(err, ErrCopyVerificationFailed) {
+		t.Fatal("Bad copy didn't fail with ErrCopyVerificationFailed:", err)
+	}
+}
+
+func TestAppendBlock(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+
+	// the first append creates the append blob
+	if offset, err := fs.AppendBlock("/log1", []byte("line1\n"), azblob.AppendPositionAccessConditions{IfAppendPositionEqual: -1}); err != nil {
+		t.Fatal("Could not append:", err)
+	} else if offset != 0 {
+		t.Fatal("Bad offset:", offset)
+	}
+	if offset, err := fs.AppendBlock("/log1", []byte("line2\n"), azblob.AppendPositionAccessConditions{IfAppendPositionEqual: 6}); err != nil {
+		t.Fatal("Could not append:", err)
+	} else if offset != 6 {
+		t.Fatal("Bad offset:", offset)
+	}
+
+	// a retried append doesn't land twice
+	_, err := fs.AppendBlock("/log1", []byte("line2\n"), azblob.AppendPositionAccessConditions{IfAppendPositionEqual: 6})
+	var perr *AppendPositionError
+	if !errors.Is(err, ErrAppendPositionMismatch) || !errors.As(err, &perr) || perr.Name != "log1" {
+		t.Fatal("Retried append didn't fail with ErrAppendPositionMismatch:", err)
+	}
+	if _, err := fs.AppendBlock("/log1", []byte("line3\n"), azblob.AppendPositionAccessConditions{IfMaxSizeLessThanOrEqual: 16}); !errors.Is(err, ErrAppendPositionMismatch) {
+		t.Fatal("Append past the max size didn't fail with ErrAppendPositionMismatch:", err)
+	}
+
+	if content, err := afero.ReadFile(fs, "/log1"); err != nil {
+		t.Fatal("Could not read file:", err)
+	} else if string(content) != "line1\nline2\n" {
+		t.Fatal("Bad content:", string(content))
+	}
+	if blobType, err := fs.BlobType("/log1"); err != nil || blobType != azblob.BlobAppendBlob {
+		t.Fatal("Bad blob type:", blobType, err)
+	}
+}
+
+func TestFileInfoNames(t *testing.T) {
+	fs := GetFs(t)
+	testCreateFile(t, fs, "/dir1/sub1/file1", "Hello world !")
+
+	stat, err := fs.Stat("/dir1/sub1/file1")
+	if err != nil {
+		t.Fatal("Could not stat file:", err)
+	}
+	if stat.Name() != "file1" || stat.(*FileInfo).FullName() != "dir1/sub1/file1" {
+		t.Fatal("Bad stat names:", stat.Name(), stat.(*FileInfo).FullName())
+	}
+
+	dir, err := fs.Open("/dir1/sub1/")
+	if err != nil {
+		t.Fatal("Could not open dir:", err)
+	}
+	fi, err := dir.Readdir(-1)
+	if err != nil {
+		t.Fatal("Could not readdir:", err)
+	}
+	if len(fi) != 1 || fi[0].Name() != "file1" || fullName(fi[0]) != "dir1/sub1/file1" {
+		t.Fatal("Bad listed names:", fi)
+	}
+
+	if name := NewFileInfo("dir1/sub1/", true, 0, time.Time{}).Name(); name != "sub1" {
+		t.Fatal("Bad directory name:", name)
+	}
+}
+
+func TestShardedCacheUpdate(t *testing.T) {
+	base := GetFs(t).(*Fs)
+	for _, name := range []string{"/b2", "/a1", "/c3", "/a2/file1", "/b1"} {
+		testCreateFile(t, base, name, "Hello world !")
+	}
+
+	if _, err := sortShardPrefixes([]string{"a", "ab"}); err == nil {
+		t.Fatal("Overlapping shard prefixes should be refused")
+	}
+
+	cache := ContainerCache{Container: "afero-test", ctx: base.ctx, serviceURL: base.serviceURL, pageSize: 1, inMemory: true, view: &memoryCache{}}
+	cache.shards, _ = sortShardPrefixes([]string{"c", "a", "b"})
+	if err := cache.update(); err != nil {
+		t.Fatal("Could not update the cache:", err)
+	}
+	names := []string{}
+	records, _ := cache.view.get()
+	for _, record := range records {
+		names = append(names, record[0])
+	}
+	if fmt.Sprint(names) != "[a1 a2/file1 b1 b2 c3]" {
+		t.Fatal("Bad sharded listing:", names)
+	}
+}
+
+func TestCacheServesLastListing(t *testing.T) {
+	base := GetFs(t).(*Fs)
+	testCreateFile(t, base, "/file1", "Hello world !")
+
+	dir, err := ioutil.TempDir("", "afero-azrblob-cache")
+	if err != nil {
+		t.Fatal("Could not create the cache directory:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := ContainerCache{Container: "afero-test", Path: dir, ctx: base.ctx, serviceURL: base.serviceURL, view: &memoryCache{}}
+	if err := cache.update(); err != nil {
+		t.Fatal("Could not update the cache:", err)
+	}
+	if err := cache.renameNew(); err != nil {
+		t.Fatal("Could not rename the new cache file:", err)
+	}
+
+	// the listing is served from memory while the files are swapped or missing
+	if err := os.Remove(cache.getCacheFilePath()); err != nil {
+		t.Fatal("Could not remove the cache file:", err)
+	}
+	fi, err := cache.ReadCache("", "", "", -1)
+	if err != nil || len(fi) != 1 || fi[0].Name() != "file1" {
+		t.Fatal("Bad cache listing:", fi, err)
+	}
+
+	// a failed update keeps the last listing
+	testCreateFile(t, base, "/file2", "Hello world !")
+	cache.Container = "afero-missing"
+	if err := cache.update(); err == nil {
+		t.Fatal("Update of a missing container should fail")
+	}
+	if fi, err := cache.ReadCache("", "", "", -1); err != nil || len(fi) != 1 {
+		t.Fatal("Bad cache listing after a failed update:", fi, err)
+	}
+}
+
+func TestOpenFileAccessMode(t *testing.T) {
+	fs := GetFs(t)
+	testCreateFile(t, fs, "/file1", "Hello world !")
+
+	_, err := fs.OpenFile("/file1", os.O_WRONLY|os.O_RDWR, 0777)
+	var perr *os.PathError
+	if !errors.Is(err, ErrInvalidAccessMode) || !errors.As(err, &perr) || perr.Op != "open" {
+		t.Fatal("O_WRONLY|O_RDWR should fail with ErrInvalidAccessMode:", err)
+	}
+	if _, err := fs.OpenFile("/file1", os.O_RDWR, 0777); !errors.Is(err, ErrNotSupported) {
+		t.Fatal("O_RDWR should fail with ErrNotSupported:", err)
+	}
+	if file, err := fs.OpenFile("/file1", os.O_RDONLY, 0777); err != nil {
+		t.Fatal("Could not open file for reading:", err)
+	} else {
+		file.Close()
+	}
+}
+
+func TestWritePages(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	if err := fs.CreatePageBlob("/index1", 1024, 5); err != nil {
+		t.Fatal("Could not create page blob:", err)
+	}
+
+	page := bytes.Repeat([]byte("a"), 512)
+	options := PageWriteOptions{Conditions: azblob.SequenceNumberAccessConditions{IfSequenceNumberLessThan: 6}, IncrementSequenceNumber: true}
+	if sequenceNumber, err := fs.WritePages("/index1", 512, page, options); err != nil {
+		t.Fatal("Could not write pages:", err)
+	} else if sequenceNumber != 6 {
+		t.Fatal("Bad sequence number:", sequenceNumber)
+	}
+
+	// the sequence number moved on, the same write is refused
+	_, err := fs.WritePages("/index1", 0, page, options)
+	var serr *SequenceNumberError
+	if !errors.Is(err, ErrSequenceNumberMismatch) || !errors.As(err, &serr) || serr.Name != "index1" {
+		t.Fatal("Stale write didn't fail with ErrSequenceNumberMismatch:", err)
+	}
+
+	if sequenceNumber, err := fs.SetSequenceNumber("/index1", azblob.SequenceNumberActionMax, 3); err != nil || sequenceNumber != 6 {
+		t.Fatal("Bad sequence number:", sequenceNumber, err)
+	}
+	if sequenceNumber, err := fs.SetSequenceNumber("/index1", azblob.SequenceNumberActionUpdate, 1); err != nil || sequenceNumber != 1 {
+		t.Fatal("Bad sequence number:", sequenceNumber, err)
+	}
+
+	content, err := afero.ReadFile(fs, "/index1")
+	if err != nil {
+		t.Fatal("Could not read page blob:", err)
+	}
+	if !bytes.Equal(content, append(make([]byte, 512), page...)) {
+		t.Fatal("Bad content")
+	}
+}
+
+// failingCopyTransport - fails the copies into blobs whose name contains fail
+type failingCopyTransport struct {
+	fail string
+}
+
+func (f *failingCopyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("x-ms-copy-source") != "" && strings.Contains(req.URL.Path, f.fail) {
+		return &http.Response{
+			StatusCode: http.StatusInternalServerError,
+			Header:     http.Header{"X-Ms-Error-Code": {"InternalError"}},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	}
+	return testMemoryTransport.RoundTrip(req)
+}
+
+func TestMoveDir(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	for _, name := range []string{"/dir1/file1", "/dir1/sub1/file2", "/dir10/file3"} {
+		testCreateFile(t, fs, name, "Hello world !")
+	}
+
+	if err := fs.MoveDir("/dir1", "/dir2/"); err != nil {
+		t.Fatal("Could not move dir:", err)
+	}
+	names, err := fs.Glob("/*")
+	if err != nil {
+		t.Fatal("Could not list blobs:", err)
+	}
+	if fmt.Sprint(names) != "[dir10/file3 dir2/file1 dir2/sub1/file2]" {
+		t.Fatal("Bad blobs after the move:", names)
+	}
+	if err := fs.MoveDir("/dir1", "/dir3"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("Moving a missing dir should fail with os.ErrNotExist:", err)
+	}
+
+	// a failed copy rolls the move back
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{
+		HTTPSender: NewHTTPClientSender(&http.Client{Transport: &failingCopyTransport{fail: "sub1"}}),
+		Retry:      azblob.RetryOptions{MaxTries: 1},
+	})
+	u, _ := url.Parse("https://afero.blob.core.windows.net")
+	serviceURL := azblob.NewServiceURL(*u, p)
+	failing := NewFsWithOptions(fs.ctx, &serviceURL, fs.container, false, FsOptions{})
+	err = failing.MoveDir("/dir2", "/dir3")
+	var berr *BatchError
+	if !errors.As(err, &berr) || len(berr.Errors) != 1 || berr.Errors["dir2/sub1/file2"] == nil {
+		t.Fatal("Failed copy didn't return a *BatchError:", err)
+	}
+	if names, _ := fs.Glob("/*"); fmt.Sprint(names) != "[dir10/file3 dir2/file1 dir2/sub1/file2]" {
+		t.Fatal("Failed move wasn't rolled back:", names)
+	}
+
+	// the blobs that existed under the destination are neither overwritten nor deleted
+	testCreateFile(t, fs, "/dir3/file1", "Hello dir3 !")
+	err = fs.MoveDir("/dir2", "/dir3")
+	if !errors.As(err, &berr) || len(berr.Errors) != 1 || !errors.Is(berr.Errors["dir2/file1"], os.ErrExist) {
+		t.Fatal("Moving onto an existing blob didn't fail with os.ErrExist:", err)
+	}
+	if names, _ := fs.Glob("/*"); fmt.Sprint(names) != "[dir10/file3 dir2/file1 dir2/sub1/file2 dir3/file1]" {
+		t.Fatal("Bad blobs after the failed move:", names)
+	}
+	for name, expected := range map[string]string{"/dir3/file1": "Hello dir3 !", "/dir2/file1": "Hello world !", "/dir2/sub1/file2": "Hello world !"} {
+		if content, err := afero.ReadFile(fs, name); err != nil || string(content) != expected {
+			t.Fatal("Bad content of", name, "after the failed move:", string(content), err)
+		}
+	}
+
+	for _, prefixes := range [][2]string{{"/dir2/sub1", "/dir2"}, {"/dir2", "/dir2/sub2"}, {"/", "/dir4"}} {
+		if err := fs.MoveDir(prefixes[0], prefixes[1]); !errors.Is(err, ErrOverlappingPrefixes) {
+			t.Fatal("Moving", prefixes[0], "to", prefixes[1], "didn't fail with ErrOverlappingPrefixes:", err)
+		}
+	}
+}
+
+func TestNotSupportedDetails(t *testing.T) {
+	fs := GetFs(t)
+	testCreateFile(t, fs, "/file1", "Hello world !")
+
+	_, err := fs.OpenFile("/file1", os.O_WRONLY|os.O_APPEND, 0777)
+	if !errors.Is(err, ErrNotSupported) || !strings.Contains(err.Error(), "O_APPEND") {
+		t.Fatal("O_APPEND should fail with a wrapped ErrNotSupported:", err)
+	}
+	err = fs.Chmod("/file1", 0750)
+	if !errors.Is(err, ErrNotSupported) || !strings.Contains(err.Error(), "Chmod") {
+		t.Fatal("Chmod should fail with a wrapped ErrNotSupported:", err)
+	}
+
+	file, err := fs.Create("/file2")
+	if err != nil {
+		t.Fatal("Could not create file:", err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(1, io.SeekStart); !errors.Is(err, ErrNotSupported) || !strings.Contains(err.Error(), "Seek") {
+		t.Fatal("Write seek should fail with a wrapped ErrNotSupported:", err)
+	}
+}
+
+func TestCommitMetadata(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	metadata := azblob.Metadata{"source": "ingest", "batch": "42"}
+
+	for name, options := range map[string]FileOptions{
+		"/file1": {Metadata: metadata},
+		"/file2": {Metadata: metadata, BufferWrites: true},
+	} {
+		file, err := fs.OpenFileWithOptions(name, os.O_WRONLY|os.O_CREATE, 0777, options)
+		if err != nil {
+			t.Fatal("Could not create file:", err)
+		}
+		if _, err := file.WriteString("Hello world !"); err != nil {
+			t.Fatal("Could not write file:", err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatal("Could not close file:", err)
+		}
+
+		blobURL := fs.BlobURL(name)
+		props, err := blobURL.GetProperties(context.Background(), azblob.BlobAccessConditions{})
+		if err != nil {
+			t.Fatal("Could not get properties:", err)
+		}
+		if got := props.NewMetadata(); got["source"] != "ingest" || got["batch"] != "42" {
+			t.Fatal("Bad metadata for", name, ":", got)
+		}
+	}
+}
+
+func TestStagedProgress(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	file, err := fs.OpenFileWithOptions("/file1", os.O_WRONLY|os.O_CREATE, 0777, FileOptions{})
+	if err != nil {
+		t.Fatal("Could not create file:", err)
+	}
+	for _, s := range []string{"Hello ", "world !"} {
+		if _, err := file.WriteString(s); err != nil {
+			t.Fatal("Could not write file:", err)
+		}
+	}
+	if file.BlocksStaged() != 2 || file.BytesStaged() != 13 {
+		t.Fatal("Bad progress:", file.BlocksStaged(), file.BytesStaged())
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal("Could not close file:", err)
+	}
+	if file.BlocksStaged() != 0 || file.BytesStaged() != 0 {
+		t.Fatal("Committed blocks are still counted:", file.BlocksStaged(), file.BytesStaged())
+	}
+}
+
+func TestAbort(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	testCreateFile(t, fs, "/file1", "Hello world !")
+	blobURL := fs.BlobURL("/file1")
+	uncommitted := func() int {
+		blockList, err := blobURL.GetBlockList(context.Background(), azblob.BlockListAll, azblob.LeaseAccessConditions{})
+		if err != nil {
+			t.Fatal("Could not get block list:", err)
+		}
+		return len(blockList.UncommittedBlocks)
+	}
+
+	for _, clear := range []bool{false, true} {
+		file, err := fs.OpenFileWithOptions("/file1", os.O_WRONLY, 0777, FileOptions{ClearStagedOnAbort: clear})
+		if err != nil {
+			t.Fatal("Could not open file:", err)
+		}
+		if _, err := file.WriteString("Goodbye !"); err != nil {
+			t.Fatal("Could not write file:", err)
+		}
+		if err := file.Abort(); err != nil {
+			t.Fatal("Could not abort:", err)
+		}
+		if _, err := file.WriteString("Goodbye !"); err != afero.ErrFileClosed {
+			t.Fatal("Writing an aborted file didn't fail with ErrFileClosed:", err)
+		}
+		if err := file.Abort(); err != afero.ErrFileClosed {
+			t.Fatal("Aborting again didn't fail with ErrFileClosed:", err)
+		}
+		if err := file.Close(); err != afero.ErrFileClosed {
+			t.Fatal("Closing an aborted file didn't fail with ErrFileClosed:", err)
+		}
+
+		if content, err := afero.ReadFile(fs, "/file1"); err != nil {
+			t.Fatal("Could not read file:", err)
+		} else if string(content) != "Hello world !" {
+			t.Fatal("Aborted write was committed:", string(content))
+		}
+		if n := uncommitted(); (n == 0) != clear {
+			t.Fatal("Bad number of uncommitted blocks with ClearStagedOnAbort", clear, ":", n)
+		}
+	}
+}
+
+func TestCreateContainerIfNotExists(t *testing.T) {
+	base := GetFs(t).(*Fs)
+	container := fmt.Sprintf("afero-created-%d", time.Now().UnixNano())
+	fs := NewFsWithOptions(base.ctx, base.serviceURL, container, false, FsOptions{CreateContainerIfNotExists: true})
+	containerURL := base.serviceURL.NewContainerURL(container)
+	defer containerURL.Delete(context.Background(), azblob.ContainerAccessConditions{})
+
+	if _, err := containerURL.GetProperties(context.Background(), azblob.LeaseAccessConditions{}); err == nil {
+		t.Fatal("Container exists before the first write")
+	}
+	testCreateFile(t, fs, "/file1", "Hello world !")
+	if content, err := afero.ReadFile(fs, "/file1"); err != nil {
+		t.Fatal("Could not read file:", err)
+	} else if string(content) != "Hello world !" {
+		t.Fatal("Bad content:", string(content))
+	}
+
+	// the other copies of the Fs find the container already there
+	if err := fs.WithContext(context.Background()).Rename("/file1", "/file2"); err != nil {
+		t.Fatal("Could not rename file:", err)
+	}
+	other := NewFsWithOptions(base.ctx, base.serviceURL, container, false, FsOptions{CreateContainerIfNotExists: true})
+	testCreateFile(t, other, "/file3", "Hello world !")
+}
+
+func TestStatAccessTier(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	testCreateFile(t, fs, "/file1", "Hello world !")
+	stat := func() FileInfo {
+		fi, err := fs.Stat("/file1")
+		if err != nil {
+			t.Fatal("Could not stat file:", err)
+		}
+		return *fi.(*FileInfo)
+	}
+
+	if fi := stat(); fi.AccessTier() != azblob.AccessTierHot || !fi.AccessTierInferred() || fi.Rehydrating() {
+		t.Fatal("Bad tier of a new blob:", fi.AccessTier(), fi.AccessTierInferred(), fi.ArchiveStatus())
+	}
+	if err := fs.SetTierBatch([]string{"/file1"}, azblob.AccessTierArchive); err != nil {
+		t.Fatal("Could not archive file:", err)
+	}
+	if err := fs.Rehydrate("/file1", azblob.AccessTierCool); err != nil {
+		t.Fatal("Could not rehydrate file:", err)
+	}
+
+	fi := stat()
+	if fi.AccessTier() != azblob.AccessTierArchive || fi.AccessTierInferred() || !fi.Rehydrating() {
+		t.Fatal("Bad tier of a rehydrating blob:", fi.AccessTier(), fi.AccessTierInferred(), fi.ArchiveStatus())
+	}
+	sys, ok := fi.Sys().(*BlobSys)
+	if !ok || sys.AccessTier != azblob.AccessTierArchive || sys.ArchiveStatus != azblob.ArchiveStatusRehydratePendingToCool {
+		t.Fatal("Bad Sys:", fi.Sys())
+	}
+}
+
+// hangingListTransport - blocks the listings until their request is cancelled, recording the timeout parameter of the first one
+type hangingListTransport struct {
+	once    sync.Once
+	timeout string
+}
+
+func (h *hangingListTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Query().Get("comp") == "list" {
+		h.once.Do(func() { h.timeout = req.URL.Query().Get("timeout") })
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}
+	return testMemoryTransport.RoundTrip(req)
+}
+
+func TestServerTimeout(t *testing.T) {
+	GetFs(t)
+	transport := &hangingListTransport{}
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{
+		HTTPSender: NewHTTPClientSender(&http.Client{Transport: transport}),
+	})
+	u, _ := url.Parse("https://afero.blob.core.windows.net")
+	serviceURL := azblob.NewServiceURL(*u, p)
+	ctx := context.Background()
+	fs := NewFsWithOptions(&ctx, &serviceURL, "afero-test", false, FsOptions{ServerTimeout: 1500 * time.Millisecond})
+
+	dir, err := fs.Open("/")
+	if err != nil {
+		t.Fatal("Could not open dir:", err)
+	}
+	start := time.Now()
+	if _, err := dir.Readdir(10); err == nil {
+		t.Fatal("Stuck listing didn't fail")
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("Listing timed out late:", time.Since(start))
+	}
+	if transport.timeout != "2" {
+		t.Fatal("Bad timeout parameter:", transport.timeout)
+	}
+}
+
+// timeoutRecordingTransport - records the timeout parameter of the requests, by their comp parameter
+type timeoutRecordingTransport struct {
+	mu       sync.Mutex
+	timeouts map[string]string
+}
+
+func (r *timeoutRecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPut {
+		r.mu.Lock()
+		r.timeouts[req.URL.Query().Get("comp")] = req.URL.Query().Get("timeout")
+		r.mu.Unlock()
+	}
+	return testMemoryTransport.RoundTrip(req)
+}
+
+func TestServerTimeoutCommit(t *testing.T) {
+	GetFs(t)
+	transport := &timeoutRecordingTransport{timeouts: map[string]string{}}
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{
+		HTTPSender: NewHTTPClientSender(&http.Client{Transport: transport}),
+	})
+	u, _ := url.Parse("https://afero.blob.core.windows.net")
+	serviceURL := azblob.NewServiceURL(*u, p)
+	ctx := context.Background()
+	fs := NewFsWithOptions(&ctx, &serviceURL, "afero-test", false, FsOptions{ServerTimeout: 1500 * time.Millisecond})
+
+	testCreateFile(t, fs, "/file1", "Hello world !")
+	file, err := fs.OpenFileWithOptions("/file2", os.O_CREATE|os.O_WRONLY, 0666, FileOptions{BufferWrites: true})
+	if err != nil {
+		t.Fatal("Could not create file:", err)
+	}
+	if _, err := file.WriteString("Hello world !"); err != nil {
+		t.Fatal("Could not write file:", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal("Could not close file:", err)
+	}
+
+	// only the block list commit is bounded, the uploads keep the timeout of the retry policy
+	if transport.timeouts["blocklist"] != "2" {
+		t.Fatal("Bad Put Block List timeout:", transport.timeouts["blocklist"])
+	}
+	if transport.timeouts["block"] == "" || transport.timeouts["block"] == "2" {
+		t.Fatal("Bad Put Block timeout:", transport.timeouts["block"])
+	}
+	if transport.timeouts[""] == "" || transport.timeouts[""] == "2" {
+		t.Fatal("Bad Put Blob timeout:", transport.timeouts[""])
+	}
+}
+
+func TestReadEmpty(t *testing.T) {
+	fs := GetFs(t)
+	testCreateFile(t, fs, "/file1", "Hello world !")
+	file, err := fs.Open("/file1")
+	if err != nil {
+		t.Fatal("Could not open file:", err)
+	}
+	defer file.Close()
+
+	if n, err := file.Read([]byte{}); n != 0 || err != nil {
+		t.Fatal("Zero length read returned", n, err)
+	}
+	if content, err := ioutil.ReadAll(file); err != nil || string(content) != "Hello world !" {
+		t.Fatal("Bad content after a zero length read:", string(content), err)
+	}
+}
+
+func TestSpillBufferedWrites(t *testing.T) {
+	base := GetFs(t).(*Fs)
+	dir, err := ioutil.TempDir("", "azrblob-spill")
+	if err != nil {
+		t.Fatal("Could not create temp dir:", err)
+	}
+	defer os.RemoveAll(dir)
+	fs := NewFsWithOptions(base.ctx, base.serviceURL, "afero-test", false, FsOptions{SpillThreshold: 8, SpillDir: dir})
+
+	file, err := fs.OpenFileWithOptions("/file1", os.O_WRONLY|os.O_CREATE, 0777, FileOptions{BufferWrites: true})
+	if err != nil {
+		t.Fatal("Could not open file:", err)
+	}
+	spilled := func() int {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal("Could not read temp dir:", err)
+		}
+		return len(entries)
+	}
+	if _, err := file.WriteString("Hello "); err != nil {
+		t.Fatal("Could not write file:", err)
+	}
+	if n := spilled(); n != 0 {
+		t.Fatal("Buffer under the threshold was spilled:", n)
+	}
+	if _, err := file.WriteString("world !"); err != nil {
+		t.Fatal("Could not write file:", err)
+	}
+	if n := spilled(); n != 1 {
+		t.Fatal("Buffer over the threshold wasn't spilled:", n)
+	}
+	if _, err := file.WriteAt([]byte("J"), 0); err != nil {
+		t.Fatal("Could not patch file:", err)
+	}
+	if offset, err := file.Seek(0, io.SeekEnd); err != nil || offset != 13 {
+		t.Fatal("Bad end of spilled buffer:", offset, err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal("Could not close file:", err)
+	}
+
+	if content, err := afero.ReadFile(fs, "/file1"); err != nil {
+		t.Fatal("Could not read file:", err)
+	} else if string(content) != "Jello world !" {
+		t.Fatal("Bad content:", string(content))
+	}
+	if n := spilled(); n != 0 {
+		t.Fatal("Spilled buffer wasn't removed:", n)
+	}
+}
+
+func TestSpillRetry(t *testing.T) {
+	base := GetFs(t).(*Fs)
+	dir, err := ioutil.TempDir("", "azrblob-spill")
+	if err != nil {
+		t.Fatal("Could not create temp dir:", err)
+	}
+	defer os.RemoveAll(dir)
+	// the attempts to create the spill file wait on the clock of the Fs
+	clock := &manualClock{now: time.Now(), sleeps: make(chan time.Duration, maxFileOpRetries)}
+	fs := NewFsWithOptions(base.ctx, base.serviceURL, "afero-test", false, FsOptions{SpillThreshold: 8, SpillDir: filepath.Join(dir, "missing"), Clock: clock})
+
+	file, err := fs.OpenFileWithOptions("/file1", os.O_WRONLY|os.O_CREATE, 0777, FileOptions{BufferWrites: true})
+	if err != nil {
+		t.Fatal("Could not open file:", err)
+	}
+	defer file.Abort()
+	if _, err := file.WriteString("Hello world !"); err == nil {
+		t.Fatal("Spilling into a missing dir didn't fail")
+	}
+	if len(clock.sleeps) != maxFileOpRetries {
+		t.Fatal("Bad number of waits on the clock:", len(clock.sleeps))
+	}
+}
+
+func TestListModifiedSince(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	testCreateFile(t, fs, "/dir1/file1", "Hello world !")
+	testCreateFile(t, fs, "/dir1/file2", "Hello world !")
+	fi, err := fs.Stat("/dir1/file2")
+	if err != nil {
+		t.Fatal("Could not stat file:", err)
+	}
+	since := fi.ModTime()
+
+	// the modification times have a one second resolution
+	time.Sleep(1100 * time.Millisecond)
+	testCreateFile(t, fs, "/dir1/file3", "Hello world !")
+	testCreateFile(t, fs, "/dir2/file4", "Hello world !")
+
+	fileInfos, err := fs.ListModifiedSince("/dir1/", since)
+	if err != nil {
+		t.Fatal("Could not list modified files:", err)
+	}
+	if len(fileInfos) != 1 || fullName(fileInfos[0]) != "dir1/file3" {
+		t.Fatal("Bad modified files:", fileInfos)
+	}
+}
+
+func TestContentLanguage(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	headers := azblob.BlobHTTPHeaders{ContentLanguage: "fr-CA", ContentEncoding: "identity"}
+	file, err := fs.OpenFileWithOptions("/file1", os.O_WRONLY|os.O_CREATE, 0777, FileOptions{HTTPHeaders: headers})
+	if err != nil {
+		t.Fatal("Could not open file:", err)
+	}
+	if _, err := file.WriteString("Bonjour le monde !"); err != nil {
+		t.Fatal("Could not write file:", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal("Could not close file:", err)
+	}
+
+	fi, err := fs.Stat("/file1")
+	if err != nil {
+		t.Fatal("Could not stat file:", err)
+	}
+	if info := fi.(*FileInfo); info.ContentLanguage() != "fr-CA" || info.ContentEncoding() != "identity" {
+		t.Fatal("Bad headers:", info.ContentLanguage(), info.ContentEncoding())
+	}
+	if sys := fi.Sys().(*BlobSys); sys.ContentLanguage != "fr-CA" || sys.ContentEncoding != "identity" {
+		t.Fatal("Bad Sys:", sys)
+	}
+
+	err = fs.ListEach("/", func(fi os.FileInfo) error {
+		if language := fi.(FileInfo).ContentLanguage(); language != "fr-CA" {
+			t.Fatal("Bad listed language:", language)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Could not list files:", err)
+	}
+}
+
+func TestTruncatePageBlob(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	if err := fs.CreatePageBlob("/disk1", 512, 0); err != nil {
+		t.Fatal("Could not create page blob:", err)
+	}
+	if _, err := fs.WritePages("/disk1", 0, bytes.Repeat([]byte{1}, 512), PageWriteOptions{}); err != nil {
+		t.Fatal("Could not write pages:", err)
+	}
+
+	file, err := fs.OpenFileWithOptions("/disk1", os.O_WRONLY, 0777, FileOptions{BlobType: azblob.BlobPageBlob})
+	if err != nil {
+		t.Fatal("Could not open page blob:", err)
+	}
+	defer file.Close()
+	if _, err := file.Stat(); err != nil {
+		t.Fatal("Could not stat page blob:", err)
+	}
+	if err := file.Truncate(4096); err != nil {
+		t.Fatal("Could not grow page blob:", err)
+	}
+	if fi, err := fs.Stat("/disk1"); err != nil || fi.Size() != 4096 {
+		t.Fatal("Bad size of grown page blob:", fi, err)
+	}
+	if file.cachedInfo.Size() != 4096 {
+		t.Fatal("Bad cached size of grown page blob:", file.cachedInfo.Size())
+	}
+	if err := file.Truncate(1000); err == nil {
+		t.Fatal("Truncated a page blob to a size that isn't a multiple of 512")
+	}
+	if err := file.Truncate(0); err != nil {
+		t.Fatal("Could not shrink page blob:", err)
+	}
+	if fi, err := fs.Stat("/disk1"); err != nil || fi.Size() != 0 {
+		t.Fatal("Bad size of shrunk page blob:", fi, err)
+	}
+
+	testCreateFile(t, fs, "/file1", "Hello world !")
+	block, err := fs.OpenFile("/file1", os.O_WRONLY, 0777)
+	if err != nil {
+		t.Fatal("Could not open file:", err)
+	}
+	defer block.Close()
+	if err := block.Truncate(4096); !errors.Is(err, ErrNotImplemented) {
+		t.Fatal("Truncating a block blob didn't fail with ErrNotImplemented:", err)
+	}
+}
+
+func TestSignedURL(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	testCreateFile(t, fs, "/dir1/report 1.csv", "Hello world !")
+	credential, err := azblob.NewSharedKeyCredential("afero", base64.StdEncoding.EncodeToString([]byte("afero-test-key")))
+	if err != nil {
+		t.Fatal("Could not create credential:", err)
+	}
+
+	headers := ResponseHeaders{ContentType: "text/csv", ContentDisposition: `attachment; filename="report.csv"`}
+	signed, err := fs.SignedURL("/dir1/report 1.csv", credential, time.Now().Add(time.Hour), headers)
+	if err != nil {
+		t.Fatal("Could not sign URL:", err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal("Could not parse signed URL:", err)
+	}
+	if query := u.Query(); query.Get("sp") != "r" || query.Get("sig") == "" || query.Get("rsct") != "text/csv" {
+		t.Fatal("Bad signed URL:", signed)
+	}
+
+	// the emulation honors the overrides like Azure does, without checking the signature
+	if accountName, accountKey := accountInfo(); accountName != "" && accountKey != "" {
+		return
+	}
+	resp, err := (&http.Client{Transport: testMemoryTransport}).Get(signed)
+	if err != nil {
+		t.Fatal("Could not download signed URL:", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/csv" || resp.Header.Get("Content-Disposition") != headers.ContentDisposition {
+		t.Fatal("Bad response headers:", resp.StatusCode, resp.Header)
+	}
+}
+
+func TestFileName(t *testing.T) {
+	fs := GetFs(t)
+	for _, name := range []string{"/dir1/file1", "dir1/file2"} {
+		file, err := fs.Create(name)
+		if err != nil {
+			t.Fatal("Could not create file:", err)
+		}
+		if file.Name() != name {
+			t.Fatal("Bad name of created file:", file.Name(), "for", name)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatal("Could not close file:", err)
+		}
+
+		file, err = fs.Open(name)
+		if err != nil {
+			t.Fatal("Could not open file:", err)
+		}
+		if file.Name() != name {
+			t.Fatal("Bad name of opened file:", file.Name(), "for", name)
+		}
+		if fi, err := file.Stat(); err != nil || fi.Name() != path.Base(name) {
+			t.Fatal("Bad stat of opened file:", fi, err)
+		}
+		file.Close()
+	}
+
+	// the entries are named relative to the directory, so joining gives back their path
+	dir, err := fs.Open("/dir1/")
+	if err != nil {
+		t.Fatal("Could not open dir:", err)
+	}
+	defer dir.Close()
+	fi, err := dir.Readdir(0)
+	if err != nil {
+		t.Fatal("Could not read dir:", err)
+	}
+	for _, entry := range fi {
+		if _, err := fs.Stat(path.Join(dir.Name(), entry.Name())); err != nil {
+			t.Fatal("Could not stat joined path of", entry.Name(), ":", err)
+		}
+	}
+	if len(fi) != 2 {
+		t.Fatal("Bad number of entries:", len(fi))
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	base := GetFs(t).(*Fs)
+	fs := NewFsWithOptions(base.ctx, base.serviceURL, "afero-test", false, FsOptions{NegativeCacheTTL: time.Hour})
+
+	if _, err := fs.Stat("/file1"); !hasServiceCode(err, azblob.ServiceCodeBlobNotFound) {
+		t.Fatal("Stat of a missing file didn't fail with BlobNotFound:", err)
+	}
+	// written by another Fs, the miss is still served
+	testCreateFile(t, base, "/file1", "Hello world !")
+	if _, err := fs.Stat("/file1"); !hasServiceCode(err, azblob.ServiceCodeBlobNotFound) {
+		t.Fatal("Cached miss wasn't served:", err)
+	}
+	// written through the Fs, the miss is forgotten
+	testCreateFile(t, fs, "/file1", "Hello world !")
+	if _, err := fs.Stat("/file1"); err != nil {
+		t.Fatal("Cached miss wasn't forgotten when written:", err)
+	}
+
+	// the misses expire on the clock of the Fs
+	clock := &manualClock{now: time.Now()}
+	short := NewFsWithOptions(base.ctx, base.serviceURL, "afero-test", false, FsOptions{NegativeCacheTTL: time.Minute, Clock: clock})
+	if _, err := short.Stat("/file2"); err == nil {
+		t.Fatal("Stat of a missing file didn't fail")
+	}
+	testCreateFile(t, base, "/file2", "Hello world !")
+	if _, err := short.Stat("/file2"); err == nil {
+		t.Fatal("Cached miss wasn't served before the clock moved")
+	}
+	clock.mu.Lock()
+	clock.now = clock.now.Add(2 * time.Minute)
+	clock.mu.Unlock()
+	if _, err := short.Stat("/file2"); err != nil {
+		t.Fatal("Cached miss wasn't expired:", err)
+	}
+}
+
+// concurrencyTransport - records the most requests in flight at once, each one taking a while
+type concurrencyTransport struct {
+	inFlight int32
+	max      int32
+}
+
+func (c *concurrencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	n := atomic.AddInt32(&c.inFlight, 1)
+	defer atomic.AddInt32(&c.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(&c.max)
+		if n <= max || atomic.CompareAndSwapInt32(&c.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return testMemoryTransport.RoundTrip(req)
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	GetFs(t)
+	transport := &concurrencyTransport{}
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{
+		HTTPSender: NewHTTPClientSender(&http.Client{Transport: transport}),
+	})
+	u, _ := url.Parse("https://afero.blob.core.windows.net")
+	serviceURL := azblob.NewServiceURL(*u, p)
+	ctx := context.Background()
+	fs := NewFsWithOptions(&ctx, &serviceURL, "afero-test", false, FsOptions{Parallelism: 8, MaxConcurrency: 2})
+
+	names := []string{}
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("/file%d", i)
+		testCreateFile(t, fs, name, "Hello world !")
+		names = append(names, name)
+	}
+	atomic.StoreInt32(&transport.max, 0)
+
+	// the copies of the Fs share the cap
+	done := make(chan error)
+	go func() {
+		done <- fs.WithContext(context.Background()).SetTierBatch(names[:5], azblob.AccessTierCool)
+	}()
+	if err := fs.SetTierBatch(names[5:], azblob.AccessTierCool); err != nil {
+		t.Fatal("Could not set tiers:", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal("Could not set tiers:", err)
+	}
+	if max := atomic.LoadInt32(&transport.max); max > 2 {
+		t.Fatal("Too many requests in flight:", max)
+	}
+}
+
+// failingDeleteTransport - fails the deletes of the blobs whose path contains fail as if they were leased
+type failingDeleteTransport struct {
+	fail string
+}
+
+func (f *failingDeleteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodDelete && strings.Contains(req.URL.Path, f.fail) {
+		return &http.Response{
+			StatusCode: http.StatusPreconditionFailed,
+			Header:     http.Header{"X-Ms-Error-Code": {"LeaseIdMissing"}},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	}
+	return testMemoryTransport.RoundTrip(req)
+}
+
+func TestRemoveAllResult(t *testing.T) {
+	GetFs(t)
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{
+		HTTPSender: NewHTTPClientSender(&http.Client{Transport: &failingDeleteTransport{fail: "leased"}}),
+	})
+	u, _ := url.Parse("https://afero.blob.core.windows.net")
+	serviceURL := azblob.NewServiceURL(*u, p)
+	ctx := context.Background()
+	fs := NewFsWithOptions(&ctx, &serviceURL, "afero-test", false, FsOptions{})
+	for _, name := range []string{"/dir1/file1", "/dir1/leased", "/dir1/file2", "/dir2/file3"} {
+		testCreateFile(t, fs, name, "Hello world !")
+	}
+
+	deleted, failed, err := fs.RemoveAllResult("/dir1/")
+	if err != nil {
+		t.Fatal("Could not remove dir:", err)
+	}
+	sort.Strings(deleted)
+	if len(deleted) != 2 || deleted[0] != "dir1/file1" || deleted[1] != "dir1/file2" {
+		t.Fatal("Bad deleted blobs:", deleted)
+	}
+	if len(failed) != 1 || !hasServiceCode(failed["dir1/leased"], azblob.ServiceCodeLeaseIDMissing) {
+		t.Fatal("Bad failed blobs:", failed)
+	}
+	for name, exists := range map[string]bool{"/dir1/file1": false, "/dir1/leased": true, "/dir2/file3": true} {
+		if _, err := fs.Stat(name); (err == nil) != exists {
+			t.Fatal("Bad existence of", name, ":", err)
+		}
+	}
+}
+
+func TestRemoveAllResultSiblings(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	for _, name := range []string{"/dir1/a", "/dir1/sub/b", "/dir10/b", "/dir1.txt", "/file1", "/file10"} {
+		testCreateFile(t, fs, name, "Hello world !")
+	}
+
+	deleted, failed, err := fs.RemoveAllResult("/dir1")
+	if err != nil || len(failed) > 0 {
+		t.Fatal("Could not remove dir:", failed, err)
+	}
+	sort.Strings(deleted)
+	if fmt.Sprint(deleted) != "[dir1/a dir1/sub/b]" {
+		t.Fatal("Bad deleted blobs:", deleted)
+	}
+	if deleted, _, err := fs.RemoveAllResult("/file1"); err != nil || fmt.Sprint(deleted) != "[file1]" {
+		t.Fatal("Bad deleted blobs of a single blob:", deleted, err)
+	}
+	if names, _ := fs.Glob("/*"); fmt.Sprint(names) != "[dir1.txt dir10/b file10]" {
+		t.Fatal("Siblings sharing the prefix were removed:", names)
+	}
+}
+
+func TestRemoveAllResultMaxConcurrency(t *testing.T) {
+	base := GetFs(t).(*Fs)
+	fs := NewFsWithOptions(base.ctx, base.serviceURL, base.container, false, FsOptions{MaxConcurrency: 1})
+	testCreateFile(t, fs, "/dir1/file1", "Hello world !")
+
+	done := make(chan error, 1)
+	go func() {
+		_, failed, err := fs.RemoveAllResult("/dir1/")
+		if err == nil && len(failed) > 0 {
+			err = fmt.Errorf("failed blobs: %v", failed)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("Could not remove dir:", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("RemoveAllResult hangs with MaxConcurrency 1")
+	}
+	if _, err := fs.Stat("/dir1/file1"); err == nil {
+		t.Fatal("File not removed")
+	}
+}
+
+func TestReaddirStreamMaxConcurrency(t *testing.T) {
+	GetFs(t)
+	transport := &concurrencyTransport{}
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{
+		HTTPSender: NewHTTPClientSender(&http.Client{Transport: transport}),
+	})
+	u, _ := url.Parse("https://afero.blob.core.windows.net")
+	serviceURL := azblob.NewServiceURL(*u, p)
+	ctx := context.Background()
+	fs := NewFsWithOptions(&ctx, &serviceURL, "afero-test", false, FsOptions{MaxConcurrency: 1, ListPageSize: 1})
+	for _, name := range []string{"/a-file1", "/a-file2", "/b-file3", "/b-file4", "/c-file5", "/c-file6"} {
+		testCreateFile(t, fs, name, "Hello world !")
+	}
+	atomic.StoreInt32(&transport.max, 0)
+
+	root, err := fs.Open("/")
+	if err != nil {
+		t.Fatal("Could not open root:", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		fileInfos, errs := root.(*File).ReaddirStream(context.Background(), []string{"a", "b", "c"})
+		count := 0
+		for fi := range fileInfos {
+			// the receiver can make limited requests while the stream is open
+			if err := fs.SetTierBatch([]string{fullName(fi)}, azblob.AccessTierCool); err != nil {
+				done <- err
+				return
+			}
+			count++
+		}
+		if err := <-errs; err != nil || count != 6 {
+			done <- fmt.Errorf("%d blobs streamed: %v", count, err)
+			return
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("Could not stream dir:", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("ReaddirStream hangs with MaxConcurrency 1")
+	}
+	if max := atomic.LoadInt32(&transport.max); max > 1 {
+		t.Fatal("Too many requests in flight:", max)
+	}
+}
+
+func TestOpenBlobType(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+
+	appendOptions := FileOptions{BlobType: azblob.BlobAppendBlob}
+	for _, part := range []string{"Hello", " world", " !"} {
+		file, err := fs.OpenFileWithOptions("/log1", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666, appendOptions)
+		if err != nil {
+			t.Fatal("Could not open append blob:", err)
+		}
+		if _, err := file.WriteString(part); err != nil {
+			t.Fatal("Could not append:", err)
+		}
+		if _, err := file.Seek(0, io.SeekStart); !errors.Is(err, ErrNotSupported) {
+			t.Fatal("Seeking an append blob didn't fail with ErrNotSupported:", err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatal("Could not close append blob:", err)
+		}
+	}
+	if content, err := afero.ReadFile(fs, "/log1"); err != nil || string(content) != "Hello world !" {
+		t.Fatal("Bad content of append blob:", string(content), err)
+	}
+	if fi, err := fs.Stat("/log1"); err != nil || fi.Sys().(*BlobSys).BlobType != azblob.BlobAppendBlob {
+		t.Fatal("Bad blob type of append blob:", fi, err)
+	}
+	if _, err := fs.OpenFileWithOptions("/log1", os.O_WRONLY|os.O_APPEND, 0666, FileOptions{}); !errors.Is(err, ErrNotSupported) {
+		t.Fatal("O_APPEND of a block blob didn't fail with ErrNotSupported:", err)
+	}
+
+	// without O_CREATE a missing append blob isn't created by the writes
+	file, err := fs.OpenFileWithOptions("/log2", os.O_WRONLY|os.O_APPEND, 0666, appendOptions)
+	if err != nil {
+		t.Fatal("Could not open append blob:", err)
+	}
+	if _, err := file.WriteString("Hello"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("Writing a missing append blob didn't fail with os.ErrNotExist:", err)
+	}
+	file.Close()
+	if _, err := fs.Stat("/log2"); err == nil {
+		t.Fatal("Missing append blob created by a write")
+	}
+
+	// a blob of another type is checked at open
+	testCreateFile(t, fs, "/file1", "Hello world !")
+	for _, options := range []FileOptions{appendOptions, {BlobType: azblob.BlobPageBlob}} {
+		if _, err := fs.OpenFileWithOptions("/file1", os.O_WRONLY|os.O_CREATE, 0666, options); !errors.Is(err, ErrBlobTypeMismatch) {
+			t.Fatal("Opening a block blob as", options.BlobType, "didn't fail with ErrBlobTypeMismatch:", err)
+		}
+	}
+	if content, err := afero.ReadFile(fs, "/file1"); err != nil || string(content) != "Hello world !" {
+		t.Fatal("Block blob changed by the failed opens:", string(content), err)
+	}
+
+	// an append blob deleted while open is created again with the options of the file
+	headerOptions := FileOptions{
+		BlobType:    azblob.BlobAppendBlob,
+		HTTPHeaders: azblob.BlobHTTPHeaders{ContentType: "text/plain"},
+		Metadata:    azblob.Metadata{"source": "ingest"},
+	}
+	file, err = fs.OpenFileWithOptions("/log3", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666, headerOptions)
+	if err != nil {
+		t.Fatal("Could not open append blob:", err)
+	}
+	if err := fs.Remove("/log3"); err != nil {
+		t.Fatal("Could not remove append blob:", err)
+	}
+	if _, err := file.WriteString("Hello"); err != nil {
+		t.Fatal("Could not append to the removed blob:", err)
+	}
+	file.Close()
+	props, err := fs.BlobURL("/log3").GetProperties(context.Background(), azblob.BlobAccessConditions{})
+	if err != nil {
+		t.Fatal("Could not get properties:", err)
+	}
+	if props.ContentType() != "text/plain" || props.NewMetadata()["source"] != "ingest" {
+		t.Fatal("Append blob created again without its properties:", props.ContentType(), props.NewMetadata())
+	}
+
+	pageOptions := FileOptions{BlobType: azblob.BlobPageBlob}
+	file, err = fs.OpenFileWithOptions("/disk1", os.O_WRONLY|os.O_CREATE, 0666, pageOptions)
+	if err != nil {
+		t.Fatal("Could not open page blob:", err)
+	}
+	if _, err := file.Write(bytes.Repeat([]byte{1}, 512)); err != nil {
+		t.Fatal("Could not write pages:", err)
+	}
+	if _, err := file.Seek(1024, io.SeekStart); err != nil {
+		t.Fatal("Could not seek page blob:", err)
+	}
+	if _, err := file.Write(bytes.Repeat([]byte{2}, 512)); err != nil {
+		t.Fatal("Could not write pages past the end:", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		t.Fatal("Could not seek page blob:", err)
+	}
+	if _, err := file.Write(bytes.Repeat([]byte{3}, 512)); err != nil {
+		t.Fatal("Could not overwrite pages:", err)
+	}
+	if _, err := file.Write(make([]byte, 100)); err == nil {
+		t.Fatal("Wrote pages that aren't a multiple of 512")
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal("Could not close page blob:", err)
+	}
+	content, err := afero.ReadFile(fs, "/disk1")
+	if err != nil || len(content) != 1536 {
+		t.Fatal("Bad size of page blob:", len(content), err)
+	}
+	expected := append(append(bytes.Repeat([]byte{3}, 512), make([]byte, 512)...), bytes.Repeat([]byte{2}, 512)...)
+	if !bytes.Equal(content, expected) {
+		t.Fatal("Bad content of page blob")
+	}
+
+	file, err = fs.OpenFileWithOptions("/disk1", os.O_WRONLY|os.O_TRUNC, 0666, pageOptions)
+	if err != nil {
+		t.Fatal("Could not truncate page blob:", err)
+	}
+	file.Close()
+	if fi, err := fs.Stat("/disk1"); err != nil || fi.Size() != 0 {
+		t.Fatal("Bad size of truncated page blob:", fi, err)
+	}
+
+	if _, err := fs.OpenFileWithOptions("/disk2", os.O_WRONLY|os.O_CREATE, 0666, FileOptions{BlobType: azblob.BlobPageBlob, BufferWrites: true}); !errors.Is(err, ErrNotSupported) {
+		t.Fatal("Buffering writes of a page blob didn't fail with ErrNotSupported:", err)
+	}
+}
+
+func TestUseAfterClose(t *testing.T) {
+	fs := GetFs(t)
+	testCreateFile(t, fs, "/file1", "Hello world !")
+
+	file, err := fs.Open("/file1")
+	if err != nil {
+		t.Fatal("Could not open file:", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal("Could not close file:", err)
+	}
+	if _, err := file.Read(make([]byte, 4)); err != afero.ErrFileClosed {
+		t.Fatal("Read after Close didn't fail with ErrFileClosed:", err)
+	}
+	if _, err := file.ReadAt(make([]byte, 4), 0); err != afero.ErrFileClosed {
+		t.Fatal("ReadAt after Close didn't fail with ErrFileClosed:", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != afero.ErrFileClosed {
+		t.Fatal("Seek after Close didn't fail with ErrFileClosed:", err)
+	}
+	if err := file.Close(); err != afero.ErrFileClosed {
+		t.Fatal("Second Close didn't fail with ErrFileClosed:", err)
+	}
+
+	file, err = fs.Create("/file2")
+	if err != nil {
+		t.Fatal("Could not create file:", err)
+	}
+	if _, err := file.WriteString("Hello world !"); err != nil {
+		t.Fatal("Could not write file:", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal("Could not close file:", err)
+	}
+	if _, err := file.WriteString("Goodbye"); err != afero.ErrFileClosed {
+		t.Fatal("Write after Close didn't fail with ErrFileClosed:", err)
+	}
+	if _, err := file.WriteAt([]byte("Goodbye"), 0); err != afero.ErrFileClosed {
+		t.Fatal("WriteAt after Close didn't fail with ErrFileClosed:", err)
+	}
+	if err := file.Sync(); err != afero.ErrFileClosed {
+		t.Fatal("Sync after Close didn't fail with ErrFileClosed:", err)
+	}
+	if content, err := afero.ReadFile(fs, "/file2"); err != nil || string(content) != "Hello world !" {
+		t.Fatal("Bad content after a write after Close:", string(content), err)
+	}
+}
+
+func TestTruncateBlockBlob(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	options := FileOptions{
+		HTTPHeaders: azblob.BlobHTTPHeaders{ContentType: "text/csv"},
+		Metadata:    azblob.Metadata{"source": "ingest"},
+	}
+
+	for name, buffered := range map[string]bool{"/file1": false, "/file2": true} {
+		options.BufferWrites = buffered
+		file, err := fs.OpenFileWithOptions(name, os.O_WRONLY|os.O_CREATE, 0777, options)
+		if err != nil {
+			t.Fatal("Could not create file:", err)
+		}
+		for _, part := range []string{"Hello ", "world !"} {
+			if _, err := file.WriteString(part); err != nil {
+				t.Fatal("Could not write file:", err)
+			}
+		}
+		if err := file.Close(); err != nil {
+			t.Fatal("Could not close file:", err)
+		}
+		blobURL := fs.BlobURL(name)
+		if _, err := blobURL.SetTier(context.Background(), azblob.AccessTierCool, azblob.LeaseAccessConditions{}); err != nil {
+			t.Fatal("Could not set tier:", err)
+		}
+
+		file, err = fs.OpenFileWithOptions(name, os.O_WRONLY, 0777, FileOptions{})
+		if err != nil {
+			t.Fatal("Could not open file:", err)
+		}
+		if err := file.Truncate(8); err != nil {
+			t.Fatal("Could not truncate", name, ":", err)
+		}
+		if err := file.Truncate(100); !errors.Is(err, ErrNotImplemented) {
+			t.Fatal("Growing a block blob didn't fail with ErrNotImplemented:", err)
+		}
+		file.Close()
+
+		if content, err := afero.ReadFile(fs, name); err != nil || string(content) != "Hello wo" {
+			t.Fatal("Bad content of truncated", name, ":", string(content), err)
+		}
+		props, err := blobURL.GetProperties(context.Background(), azblob.BlobAccessConditions{})
+		if err != nil {
+			t.Fatal("Could not get properties:", err)
+		}
+		if props.ContentType() != "text/csv" || props.NewMetadata()["source"] != "ingest" {
+			t.Fatal("Truncating", name, "dropped its properties:", props.ContentType(), props.NewMetadata())
+		}
+		if props.AccessTier() != string(azblob.AccessTierCool) || props.AccessTierInferred() == "true" {
+			t.Fatal("Truncating", name, "dropped its tier:", props.AccessTier())
+		}
+	}
+}
+
+func TestTruncateChecksum(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	blobURL := fs.BlobURL("/file1")
+	if _, err := blobURL.Upload(context.Background(), strings.NewReader("Hello world !"), azblob.BlobHTTPHeaders{}, nil, azblob.BlobAccessConditions{}); err != nil {
+		t.Fatal("Could not upload file:", err)
+	}
+	if sum, _, err := fs.Checksum("/file1"); err != nil || len(sum) == 0 {
+		t.Fatal("No checksum of the uploaded file:", err)
+	}
+
+	file, err := fs.OpenFile("/file1", os.O_WRONLY, 0777)
+	if err != nil {
+		t.Fatal("Could not open file:", err)
+	}
+	if err := file.Truncate(5); err != nil {
+		t.Fatal("Could not truncate file:", err)
+	}
+	file.Close()
+
+	if content, err := afero.ReadFile(fs, "/file1"); err != nil || string(content) != "Hello" {
+		t.Fatal("Bad content of truncated file:", string(content), err)
+	}
+	if sum, _, err := fs.Checksum("/file1"); !errors.Is(err, ErrNoChecksum) {
+		t.Fatal("Truncated file kept a checksum:", sum, err)
+	}
+}
+
+func TestTruncateOpenFile(t *testing.T) {
+	base := GetFs(t).(*Fs)
+	fs := NewFsWithOptions(base.ctx, base.serviceURL, base.container, false, FsOptions{BlockSize: 4, SpillThreshold: 20})
+	testCreateFile(t, fs, "/file1", "Hello world !")
+
+	// a file open for reading can't truncate
+	file, err := fs.Open("/file1")
+	if err != nil {
+		t.Fatal("Could not open file:", err)
+	}
+	if err := file.Truncate(5); !errors.Is(err, os.ErrPermission) {
+		t.Fatal("Truncating a file open for reading didn't fail with os.ErrPermission:", err)
+	}
+	file.Close()
+
+	// the written content is truncated, not the blob that Close replaces
+	for name, options := range map[string]FileOptions{"/file1": {}, "/file2": {BufferWrites: true}} {
+		file, err := fs.OpenFileWithOptions(name, os.O_WRONLY|os.O_CREATE, 0777, options)
+		if err != nil {
+			t.Fatal("Could not create file:", err)
+		}
+		for _, part := range []string{"Hello ", "world !"} {
+			if _, err := file.WriteString(part); err != nil {
+				t.Fatal("Could not write file:", err)
+			}
+		}
+		if err := file.Truncate(6); err != nil {
+			t.Fatal("Could not truncate", name, ":", err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatal("Could not close file:", err)
+		}
+		if content, err := afero.ReadFile(fs, name); err != nil || string(content) != "Hello " {
+			t.Fatal("Bad content of truncated", name, ":", string(content), err)
+		}
+	}
+
+	staged, err := fs.OpenFileWithOptions("/file3", os.O_WRONLY|os.O_CREATE, 0777, FileOptions{})
+	if err != nil {
+		t.Fatal("Could not create file:", err)
+	}
+	defer staged.Abort()
+	if _, err := staged.WriteString("Hello world !"); err != nil {
+		t.Fatal("Could not write file:", err)
+	}
+	if err := staged.Truncate(5); !errors.Is(err, ErrNotSupported) {
+		t.Fatal("Truncating within a staged block didn't fail with ErrNotSupported:", err)
+	}
+	if err := staged.Truncate(100); !errors.Is(err, ErrNotImplemented) {
+		t.Fatal("Growing staged blocks didn't fail with ErrNotImplemented:", err)
+	}
+
+	// a buffer grown over the SpillThreshold is spilled
+	buffered, err := fs.OpenFileWithOptions("/file4", os.O_WRONLY|os.O_CREATE, 0777, FileOptions{BufferWrites: true})
+	if err != nil {
+		t.Fatal("Could not create file:", err)
+	}
+	if _, err := buffered.WriteString("Hello"); err != nil {
+		t.Fatal("Could not write file:", err)
+	}
+	if err := buffered.Truncate(30); err != nil {
+		t.Fatal("Could not grow buffer:", err)
+	}
+	if buffered.spill == nil {
+		t.Fatal("Buffer grown over the SpillThreshold wasn't spilled")
+	}
+	if err := buffered.Close(); err != nil {
+		t.Fatal("Could not close file:", err)
+	}
+	if content, err := afero.ReadFile(fs, "/file4"); err != nil || string(content) != "Hello"+string(make([]byte, 25)) {
+		t.Fatal("Bad content of grown file:", content, err)
+	}
+
+	// the part of a block cut from the blob is staged again in blocks of BlockSize
+	testCreateFile(t, fs, "/file5", "Hello world !")
+	file, err = fs.OpenFile("/file5", os.O_WRONLY, 0777)
+	if err != nil {
+		t.Fatal("Could not open file:", err)
+	}
+	if err := file.Truncate(10); err != nil {
+		t.Fatal("Could not truncate file:", err)
+	}
+	file.Close()
+	if content, err := afero.ReadFile(fs, "/file5"); err != nil || string(content) != "Hello worl" {
+		t.Fatal("Bad content of truncated file:", string(content), err)
+	}
+	blockList, err := fs.BlobURL("/file5").GetBlockList(context.Background(), azblob.BlockListCommitted, azblob.LeaseAccessConditions{})
+	if err != nil {
+		t.Fatal("Could not get block list:", err)
+	}
+	if len(blockList.CommittedBlocks) != 3 {
+		t.Fatal("Bad blocks of truncated file:", len(blockList.CommittedBlocks))
+	}
+}
+
+// primaryOutageTransport - fails the reads sent to the primary endpoint, recording the hosts of the requests
+type primaryOutageTransport struct {
+	mu    sync.Mutex
+	hosts map[string][]string // method to hosts
+}
+
+func (p *primaryOutageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	p.mu.Lock()
+	p.hosts[req.Method] = append(p.hosts[req.Method], req.URL.Host)
+	p.mu.Unlock()
+	if (req.Method == http.MethodGet || req.Method == http.MethodHead) && req.URL.Host == "afero.blob.core.windows.net" {
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Status:     "503 Service Unavailable",
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	}
+	return testMemoryTransport.RoundTrip(req)
+}
+
+func TestSecondaryHost(t *testing.T) {
+	GetFs(t)
+	if host := SecondaryHost("afero"); host != "afero-secondary.blob.core.windows.net" {
+		t.Fatal("Bad secondary host:", host)
+	}
+
+	transport := &primaryOutageTransport{hosts: make(map[string][]string)}
+	po := CreateCache{HTTPClient: &http.Client{Transport: transport}, SecondaryHost: SecondaryHost("afero")}.pipelineOptions()
+	po.Retry.RetryDelay = time.Millisecond
+	po.Retry.MaxRetryDelay = time.Millisecond
+	ctx := context.Background()
+	fs := NewFsWithPipeline(&ctx, azblob.NewPipeline(azblob.NewAnonymousCredential(), po), "afero", "afero-test", false, FsOptions{})
+
+	if err := afero.WriteFile(fs, "/file1", []byte("Hello world !"), 0777); err != nil {
+		t.Fatal("Could not write file:", err)
+	}
+	if content, err := afero.ReadFile(fs, "/file1"); err != nil || string(content) != "Hello world !" {
+		t.Fatal("Could not read from the secondary:", string(content), err)
+	}
+
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	for _, host := range transport.hosts[http.MethodPut] {
+		if host != "afero.blob.core.windows.net" {
+			t.Fatal("Write sent to", host)
+		}
+	}
+	if hosts := transport.hosts[http.MethodGet]; len(hosts) < 2 || hosts[len(hosts)-1] != SecondaryHost("afero") {
+		t.Fatal("Read not retried on the secondary:", hosts)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	file, err := fs.OpenFileWithOptions("/file1", os.O_WRONLY|os.O_CREATE, 0777, FileOptions{})
+	if err != nil {
+		t.Fatal("Could not create file:", err)
+	}
+	if _, err := file.WriteString("Hello world !"); err != nil {
+		t.Fatal("Could not write file:", err)
+	}
+	if err := file.Validate(); err != nil {
+		t.Fatal("Could not validate file:", err)
+	}
+
+	// pretend enormous files were written rather than staging them
+	staged, bytesStaged := file.base64BlockIDs, file.bytesStaged
+	file.base64BlockIDs = make([]string, azblob.BlockBlobMaxBlocks+1)
+	var limitErr *BlobLimitError
+	if err := file.Validate(); !errors.Is(err, ErrTooManyBlocks) || !errors.As(err, &limitErr) || limitErr.Actual != azblob.BlockBlobMaxBlocks+1 || limitErr.Allowed != azblob.BlockBlobMaxBlocks {
+		t.Fatal("Bad error validating too many blocks:", err)
+	}
+	file.base64BlockIDs = staged
+	file.bytesStaged = int64(azblob.BlockBlobMaxBlocks)*azblob.BlockBlobMaxStageBlockBytes + 1
+	if err := file.Close(); !errors.Is(err, ErrBlobTooLarge) {
+		t.Fatal("Closing a file too large didn't fail with ErrBlobTooLarge:", err)
+	}
+	if _, err := fs.Stat("/file1"); err == nil {
+		t.Fatal("File too large was committed")
+	}
+
+	file.bytesStaged = bytesStaged
+	if err := file.Close(); err != nil {
+		t.Fatal("Could not close file:", err)
+	}
+	if content, err := afero.ReadFile(fs, "/file1"); err != nil || string(content) != "Hello world !" {
+		t.Fatal("Bad content:", string(content), err)
+	}
+}
+
+func TestListPrefixes(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	for _, name := range []string{"/logs/a", "/logs/b", "/logs/c", "/metrics/a", "/metrics/sub/b", "/other/a"} {
+		testCreateFile(t, fs, name, "Hello world !")
+	}
+
+	results, err := fs.ListPrefixes([]string{"logs/", "/metrics", "traces/"}, 0)
+	if err != nil {
+		t.Fatal("Could not list prefixes:", err)
+	}
+	names := func(prefix string) []string {
+		var names []string
+		for _, fi := range results[prefix] {
+			names = append(names, fi.Name())
+		}
+		return names
+	}
+	if got := names("logs/"); fmt.Sprint(got) != "[a b c]" {
+		t.Fatal("Bad entries of logs/:", got)
+	}
+	if got := names("/metrics"); fmt.Sprint(got) != "[a b]" {
+		t.Fatal("Bad entries of /metrics:", got)
+	}
+	if fileInfos, ok := results["traces/"]; !ok || len(fileInfos) != 0 {
+		t.Fatal("Bad entries of the empty traces/:", fileInfos, ok)
+	}
+
+	results, err = fs.ListPrefixes([]string{"logs/"}, 2)
+	if err != nil || len(results["logs/"]) != 2 {
+		t.Fatal("Bad limited listing:", results, err)
+	}
+
+	// any delimiter is appended the same way
+	colonFs := NewFsWithOptions(fs.ctx, fs.serviceURL, fs.container, false, FsOptions{Delimiter: ":"})
+	for _, name := range []string{"/tenant1:a", "/tenant1:b", "/tenant2:c"} {
+		testCreateFile(t, colonFs, name, "Hello world !")
+	}
+	results, err = colonFs.ListPrefixes([]string{"tenant1", "/tenant2:"}, 0)
+	if err != nil {
+		t.Fatal("Could not list prefixes:", err)
+	}
+	if got := names("tenant1"); fmt.Sprint(got) != "[a b]" {
+		t.Fatal("Bad entries of tenant1:", got)
+	}
+	if got := names("/tenant2:"); fmt.Sprint(got) != "[c]" {
+		t.Fatal("Bad entries of /tenant2::", got)
+	}
+}
+
+func TestStatRoot(t *testing.T) {
+	fs := GetFs(t)
+	testCreateFile(t, fs, "/dir1/file1", "Hello world !")
+
+	root, err := fs.Stat("/")
+	if err != nil {
+		t.Fatal("Could not stat root:", err)
+	}
+	if !root.IsDir() || !root.Mode().IsDir() || root.Mode().Perm() != 0755 || root.Size() != 0 {
+		t.Fatal("Bad root:", root.IsDir(), root.Mode(), root.Size())
+	}
+
+	file, err := fs.Stat("/dir1/file1")
+	if err != nil {
+		t.Fatal("Could not stat file:", err)
+	}
+	if file.IsDir() || !file.Mode().IsRegular() || file.Size() != 13 {
+		t.Fatal("Bad file:", file.IsDir(), file.Mode(), file.Size())
+	}
+}
+
+func TestRemoveIf(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	testCreateFile(t, fs, "/file1", "Hello world !")
+	stat, err := fs.Stat("/file1")
+	if err != nil {
+		t.Fatal("Could not stat file:", err)
+	}
+	etag := stat.(*FileInfo).ETag()
+
+	// the blob is written again after the cleanup job saw it
+	testCreateFile(t, fs, "/file1", "Goodbye !")
+	ifMatch := azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: etag}}
+	if err := fs.RemoveIf("/file1", ifMatch); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatal("Removing a changed blob didn't fail with ErrPreconditionFailed:", err)
+	}
+	ifUnmodified := azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfUnmodifiedSince: stat.ModTime().Add(-time.Hour)}}
+	if err := fs.RemoveIf("/file1", ifUnmodified); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatal("Removing a blob modified since didn't fail with ErrPreconditionFailed:", err)
+	}
+	if _, err := fs.Stat("/file1"); err != nil {
+		t.Fatal("Changed blob was removed:", err)
+	}
+
+	stat, err = fs.Stat("/file1")
+	if err != nil {
+		t.Fatal("Could not stat file:", err)
+	}
+	ifMatch.ModifiedAccessConditions.IfMatch = stat.(*FileInfo).ETag()
+	if err := fs.RemoveIf("/file1", ifMatch); err != nil {
+		t.Fatal("Could not remove unchanged blob:", err)
+	}
+	if _, err := fs.Stat("/file1"); err == nil {
+		t.Fatal("Unchanged blob wasn't removed")
+	}
+}
+
+// manualClock - a Clock whose Sleep waits for the test to receive the duration on sleeps, then moves the time on by it
+// manualClock - reports each sleep on sleeps, and when resume is set keeps the sleeper
+// blocked until the test sends on it
+type manualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	sleeps chan time.Duration
+	resume chan struct{}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleep advances the clock before reporting d, so that the time read once d was
+// received is the one the sleeper wakes up at
+func (c *manualClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+	c.sleeps <- d
+	if c.resume != nil {
+		<-c.resume
+	}
+}
+
+func (c *manualClock) After(d time.Duration) <-chan time.Time {
+	c.Sleep(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.Now()
+	return ch
+}
+
+// throttlingListTransport - answers the first listings with ServerBusy
+type throttlingListTransport struct {
+	throttled int32
+}
+
+func (th *throttlingListTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Query().Get("comp") == "list" && atomic.AddInt32(&th.throttled, -1) >= 0 {
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Header:     http.Header{"X-Ms-Error-Code": {"ServerBusy"}},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	}
+	return testMemoryTransport.RoundTrip(req)
+}
+
+func TestThrottleClock(t *testing.T) {
+	base := GetFs(t).(*Fs)
+	testCreateFile(t, base, "/file1", "Hello world !")
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{
+		HTTPSender: NewHTTPClientSender(&http.Client{Transport: &throttlingListTransport{throttled: 2}}),
+		Retry:      azblob.RetryOptions{MaxTries: 1},
+	})
+	u, _ := url.Parse("https://afero.blob.core.windows.net")
+	serviceURL := azblob.NewServiceURL(*u, p)
+	clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), sleeps: make(chan time.Duration)}
+	fs := NewFsWithOptions(base.ctx, &serviceURL, base.container, false, FsOptions{Clock: clock})
+
+	done := make(chan error, 1)
+	var names []string
+	go func() {
+		done <- fs.ListEach("", func(fi os.FileInfo) error {
+			names = append(names, fullName(fi))
+			return nil
+		})
+	}()
+	// the delays double with each attempt, with jitter on their second half
+	for attempt, min := range []time.Duration{time.Second / 2, time.Second} {
+		select {
+		case d := <-clock.sleeps:
+			if d < min || d >= 2*min {
+				t.Fatal("Bad backoff of attempt", attempt, ":", d)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Throttled listing didn't back off on the clock")
+		}
+	}
+	if err := <-done; err != nil || fmt.Sprint(names) != "[file1]" {
+		t.Fatal("Bad listing once throttling stopped:", names, err)
+	}
+}
+
+func TestCacheClock(t *testing.T) {
+	base := GetFs(t).(*Fs)
+	testCreateFile(t, base, "/file1", "Hello world !")
+
+	clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), sleeps: make(chan time.Duration), resume: make(chan struct{})}
+	cache := &ContainerCache{Container: base.container, Cycle: 1, inMemory: true, view: &memoryCache{},
+		ctx: base.ctx, serviceURL: base.serviceURL, clock: clock}
+	entries := func() int {
+		records, _ := cache.view.get()
+		return len(records)
+	}
+
+	// the cycling goroutine stays blocked in Sleep from each receive until the resume
+	go cache.startCycling()
+	<-clock.sleeps // the initial random delay
+	updated := clock.Now()
+	clock.resume <- struct{}{}
+	waited := <-clock.sleeps // the first cycle updated the cache, waiting for the next one
+	if entries() != 1 || !cache.lastUpdated().Equal(updated) {
+		t.Fatal("Bad first update:", entries(), cache.lastUpdated(), updated)
+	}
+
+	testCreateFile(t, base, "/file2", "Hello world !")
+	for {
+		clock.resume <- struct{}{}
+		d := <-clock.sleeps
+		if entries() == 2 {
+			break
+		}
+		waited += d
+		if waited > 2*time.Minute {
+			t.Fatal("The cache wasn't updated after", waited)
+		}
+	}
+	if waited < time.Minute || waited > time.Minute+time.Duration(cycleJitter*float64(time.Minute)) {
+		t.Fatal("The cache was updated after", waited, "rather than its cycle")
+	}
+
+	cache.stopCycling()
+	clock.resume <- struct{}{}
+}
+
+// failingReader - reads from r, then fails instead of io.EOF
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestUpload(t *testing.T) {
+	base := GetFs(t).(*Fs)
+	fs := NewFsWithOptions(base.ctx, base.serviceURL, "afero-test", false, FsOptions{BlockSize: 4})
+
+	content := "Hello world, from a reader !"
+	if err := fs.Upload("/dir1/file1.txt", strings.NewReader(content)); err != nil {
+		t.Fatal("Could not upload:", err)
+	}
+	if data, err := afero.ReadFile(fs, "/dir1/file1.txt"); err != nil || string(data) != content {
+		t.Fatal("Bad content of uploaded blob:", string(data), err)
+	}
+	blobURL := fs.BlobURL("/dir1/file1.txt")
+	props, err := blobURL.GetProperties(context.Background(), azblob.BlobAccessConditions{})
+	if err != nil || !strings.HasPrefix(props.ContentType(), "text/plain") {
+		t.Fatal("Bad content type of uploaded blob:", props, err)
+	}
+	blockList, err := blobURL.GetBlockList(context.Background(), azblob.BlockListCommitted, azblob.LeaseAccessConditions{})
+	if err != nil || len(blockList.CommittedBlocks) != (len(content)+3)/4 {
+		t.Fatal("Bad blocks of uploaded blob:", blockList, err)
+	}
+
+	if err := fs.Upload("/dir1/file1.txt", &failingReader{r: strings.NewReader("Goodbye !")}); err == nil {
+		t.Fatal("Upload from a failing reader didn't fail")
+	}
+	if data, err := afero.ReadFile(fs, "/dir1/file1.txt"); err != nil || string(data) != content {
+		t.Fatal("Failed upload changed the blob:", string(data), err)
+	}
+}
+
+func TestStatLease(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	testCreateFile(t, fs, "/file1", "Hello world !")
+	stat := func() *FileInfo {
+		fi, err := fs.Stat("/file1")
+		if err != nil {
+			t.Fatal("Could not stat file:", err)
+		}
+		return fi.(*FileInfo)
+	}
+
+	if fi := stat(); fi.Leased() || fi.LeaseState() != azblob.LeaseStateAvailable || fi.LeaseDuration() != "" {
+		t.Fatal("Bad lease of a blob never leased:", fi.LeaseStatus(), fi.LeaseState(), fi.LeaseDuration())
+	}
+
+	blobURL := fs.BlobURL("/file1").BlobURL
+	if _, err := blobURL.AcquireLease(context.Background(), "", -1, azblob.ModifiedAccessConditions{}); err != nil {
+		t.Fatal("Could not acquire lease:", err)
+	}
+	if fi := stat(); !fi.Leased() || fi.LeaseState() != azblob.LeaseStateLeased || fi.LeaseDuration() != azblob.LeaseDurationInfinite {
+		t.Fatal("Bad lease of a leased blob:", fi.LeaseStatus(), fi.LeaseState(), fi.LeaseDuration())
+	}
+	var listed os.FileInfo
+	if err := fs.ListEach("", func(fi os.FileInfo) error { listed = fi; return nil }); err != nil {
+		t.Fatal("Could not list:", err)
+	}
+	if sys, ok := listed.Sys().(*BlobSys); !ok || sys.LeaseStatus != azblob.LeaseStatusLocked || sys.LeaseDuration != azblob.LeaseDurationInfinite {
+		t.Fatal("Bad lease of a listed leased blob:", listed.Sys())
+	}
+
+	if _, err := blobURL.BreakLease(context.Background(), 0, azblob.ModifiedAccessConditions{}); err != nil {
+		t.Fatal("Could not break lease:", err)
+	}
+	if fi := stat(); fi.Leased() || fi.LeaseState() != azblob.LeaseStateBroken {
+		t.Fatal("Bad lease of a blob whose lease was broken:", fi.LeaseStatus(), fi.LeaseState(), fi.LeaseDuration())
+	}
+
+	if _, err := blobURL.AcquireLease(context.Background(), "", 15, azblob.ModifiedAccessConditions{}); err != nil {
+		t.Fatal("Could not acquire lease:", err)
+	}
+	if fi := stat(); !fi.Leased() || fi.LeaseDuration() != azblob.LeaseDurationFixed {
+		t.Fatal("Bad lease of a blob with a fixed lease:", fi.LeaseStatus(), fi.LeaseState(), fi.LeaseDuration())
+	}
+}
+
+func TestDefaultAccessTier(t *testing.T) {
+	base := GetFs(t).(*Fs)
+	fs := NewFsWithOptions(base.ctx, base.serviceURL, "afero-test", false, FsOptions{DefaultAccessTier: azblob.AccessTierCool})
+	tier := func(name string) azblob.AccessTierType {
+		fi, err := fs.Stat(name)
+		if err != nil {
+			t.Fatal("Could not stat", name, ":", err)
+		}
+		if fi.(*FileInfo).AccessTierInferred() {
+			return ""
+		}
+		return fi.(*FileInfo).AccessTier()
+	}
+
+	testCreateFile(t, fs, "/file1", "Hello world !")
+	if err := fs.Upload("/file2", strings.NewReader("Hello world !")); err != nil {
+		t.Fatal("Could not upload:", err)
+	}
+	file, err := fs.OpenFileWithOptions("/file3", os.O_WRONLY|os.O_CREATE, 0777, FileOptions{AccessTier: azblob.AccessTierHot})
+	if err != nil {
+		t.Fatal("Could not create file:", err)
+	}
+	if _, err := file.WriteString("Hello world !"); err != nil {
+		t.Fatal("Could not write file:", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal("Could not close file:", err)
+	}
+	testCreateFile(t, base, "/file4", "Hello world !")
+
+	for name, expected := range map[string]azblob.AccessTierType{
+		"/file1": azblob.AccessTierCool,
+		"/file2": azblob.AccessTierCool,
+		"/file3": azblob.AccessTierHot,
+		"/file4": "",
+	} {
+		if got := tier(name); got != expected {
+			t.Fatal("Bad tier of", name, ":", got)
+		}
+	}
+}
+
+// failingTierTransport - fails the first tier change, counting the block list commits
+type failingTierTransport struct {
+	failed  int32
+	commits int32
+}
+
+func (f *failingTierTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch req.URL.Query().Get("comp") {
+	case "tier":
+		if atomic.CompareAndSwapInt32(&f.failed, 0, 1) {
+			return &http.Response{
+				StatusCode: http.StatusInternalServerError,
+				Header:     http.Header{"X-Ms-Error-Code": {"InternalError"}},
+				Body:       ioutil.NopCloser(strings.NewReader("")),
+				Request:    req,
+			}, nil
+		}
+	case "blocklist":
+		if req.Method == http.MethodPut {
+			atomic.AddInt32(&f.commits, 1)
+		}
+	}
+	return testMemoryTransport.RoundTrip(req)
+}
+
+func TestOpenWriterTierRetry(t *testing.T) {
+	GetFs(t)
+	transport := &failingTierTransport{}
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{
+		HTTPSender: NewHTTPClientSender(&http.Client{Transport: transport}),
+		Retry:      azblob.RetryOptions{MaxTries: 1},
+	})
+	u, _ := url.Parse("https://afero.blob.core.windows.net")
+	serviceURL := azblob.NewServiceURL(*u, p)
+	ctx := context.Background()
+	fs := NewFsWithOptions(&ctx, &serviceURL, "afero-test", false, FsOptions{DefaultAccessTier: azblob.AccessTierCool})
+
+	writer, err := fs.OpenWriter("/file1")
+	if err != nil {
+		t.Fatal("Could not open writer:", err)
+	}
+	if _, err := writer.Write([]byte("Hello world !")); err != nil {
+		t.Fatal("Could not write:", err)
+	}
+	var pathErr *os.PathError
+	if err := writer.Close(); !errors.As(err, &pathErr) || pathErr.Op != "tier" {
+		t.Fatal("Failed tier change wasn't reported with Op tier:", err)
+	}
+	if _, err := writer.Write([]byte("Hello world !")); !errors.Is(err, os.ErrClosed) {
+		t.Fatal("Write after the commit didn't fail with os.ErrClosed:", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal("Could not close writer again:", err)
+	}
+
+	if n := atomic.LoadInt32(&transport.commits); n != 1 {
+		t.Fatal("Bad number of block list commits:", n)
+	}
+	fi, err := fs.Stat("/file1")
+	if err != nil {
+		t.Fatal("Could not stat file:", err)
+	}
+	if fi.(*FileInfo).AccessTier() != azblob.AccessTierCool || fi.Size() != 13 {
+		t.Fatal("Bad tier or size:", fi.(*FileInfo).AccessTier(), fi.Size())
+	}
+}
+
+func TestOpenRangeReader(t *testing.T) {
+	fs := GetFs(t).(*Fs)
+	testCreateFile(t, fs, "/file1", "Hello world !")
+
+	for _, c := range []struct {
+		offset, count int64
+		content       string
+	}{
+		{6, 5, "world"},
+		{6, azblob.CountToEnd, "world !"},
+		{6, 100, "world !"},
+		{0, azblob.CountToEnd, "Hello world !"},
+	} {
+		reader, err := fs.OpenRangeReader("/file1", c.offset, c.count)
+		if err != nil {
+			t.Fatal("Could not open range", c.offset, c.count, ":", err)
+		}
+		content, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(content) != c.content {
+			t.Fatal("Bad content of range", c.offset, c.count, ":", string(content), err)
+		}
+		if reader.Offset != c.offset || reader.Length != int64(len(c.content)) || reader.Size != 13 {
+			t.Fatal("Bad lengths of range", c.offset, c.count, ":", reader.Offset, reader.Length, reader.Size)
+		}
+	}
+
+	if _, err := fs.OpenRangeReader("/file1", 13, azblob.CountToEnd); !hasServiceCode(err, azblob.ServiceCodeInvalidRange) {
+		t.Fatal("Range past the end didn't fail with InvalidRange:", err)
+	}
+	if _, err := fs.OpenRangeReader("/file1", -1, 5); !errors.Is(err, ErrInvalidSeek) {
+		t.Fatal("Negative offset didn't fail with ErrInvalidSeek:", err)
+	}
+}
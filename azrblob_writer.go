@@ -0,0 +1,181 @@
+package azrblob
+
+import (
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// writerBlockSize is the size of the blocks staged by a blobWriter when FsOptions.BlockSize is 0
+const writerBlockSize = 4 * 1024 * 1024
+
+// blobWriter streams a block blob: the bytes written are coalesced into blocks of
+// FsOptions.BlockSize, staged in the background up to FsOptions.Parallelism at
+// a time, and committed by Close. Nothing is visible in the container until then.
+type blobWriter struct {
+	fs             *Fs
+	name           string
+	headers        azblob.BlobHTTPHeaders
+	blockSize      int64
+	buffer         []byte
+	base64BlockIDs []string
+	slots          chan struct{}
+	staging        sync.WaitGroup
+	mu             sync.Mutex
+	err            error
+	committed      bool
+	closed         bool
+}
+
+// OpenWriter returns a writer creating or replacing the blob name when it's
+// closed, see blobWriter. The content type is set from the file extension of the name.
+func (fs *Fs) OpenWriter(name string) (io.WriteCloser, error) {
+	if err := fs.checkWritable("open", name); err != nil {
+		return nil, err
+	}
+
+	blockSize := fs.options.BlockSize
+	if blockSize <= 0 {
+		blockSize = writerBlockSize
+	}
+
+	return &blobWriter{
+		fs:        fs,
+		name:      trimLeadingSlash(name),
+		headers:   azblob.BlobHTTPHeaders{ContentType: mime.TypeByExtension(filepath.Ext(name))},
+		blockSize: blockSize,
+		slots:     make(chan struct{}, fs.transferParallelism()),
+	}, nil
+}
+
+// Write buffers p, staging every block it fills. An error staging an earlier
+// block is returned by the next Write or Close.
+func (w *blobWriter) Write(p []byte) (int, error) {
+	if w.closed || w.committed {
+		return 0, os.ErrClosed
+	}
+	if err := w.stageError(); err != nil {
+		return 0, err
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		free := int(w.blockSize) - len(w.buffer)
+		if free > len(p) {
+			free = len(p)
+		}
+		w.buffer = append(w.buffer, p[:free]...)
+		p = p[free:]
+		if int64(len(w.buffer)) == w.blockSize {
+			w.stage()
+		}
+	}
+
+	return n, nil
+}
+
+// ReadFrom reads r until io.EOF straight into the blocks, staging every block it
+// fills, so that io.Copy to the writer needs no buffer of its own.
+func (w *blobWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.closed || w.committed {
+		return 0, os.ErrClosed
+	}
+
+	var total int64
+	for {
+		if err := w.stageError(); err != nil {
+			return total, err
+		}
+		if w.buffer == nil {
+			w.buffer = make([]byte, 0, w.blockSize)
+		}
+		n, err := r.Read(w.buffer[len(w.buffer):w.blockSize])
+		w.buffer = w.buffer[:len(w.buffer)+n]
+		total += int64(n)
+		if int64(len(w.buffer)) == w.blockSize {
+			w.stage()
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			LogError(err)
+			return total, err
+		}
+	}
+}
+
+// Close stages the last block and commits the block list. When the commit
+// fails the error is an *os.PathError with Op "commit", and the writer stays
+// open so that calling Close again retries it. When only the access tier
+// couldn't be set afterwards the Op is "tier", the data was committed and
+// calling Close again only retries setting the tier.
+func (w *blobWriter) Close() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+
+	if !w.committed {
+		if len(w.buffer) > 0 {
+			w.stage()
+		}
+		w.staging.Wait()
+		if err := w.stageError(); err != nil {
+			return err
+		}
+
+		if _, err := w.fs.blobCommitBlockList(w.name, &w.base64BlockIDs, w.headers, nil); err != nil {
+			err = &os.PathError{Op: "commit", Path: w.name, Err: err}
+			LogError(err)
+			return err
+		}
+		w.committed = true
+	}
+
+	if err := w.fs.setCommittedTier(w.name, ""); err != nil {
+		err = &os.PathError{Op: "tier", Path: w.name, Err: err}
+		LogError(err)
+		return err
+	}
+	w.closed = true
+
+	return nil
+}
+
+// stage stages the buffered block in the background, its ID keeps its place in the block list
+func (w *blobWriter) stage() {
+	block := w.buffer
+	w.buffer = nil
+	base64BlockID := newBase64BlockID()
+	w.base64BlockIDs = append(w.base64BlockIDs, base64BlockID)
+
+	w.slots <- struct{}{}
+	w.staging.Add(1)
+	go func() {
+		defer func() {
+			<-w.slots
+			w.staging.Done()
+		}()
+		w.fs.limiter.acquire(1)
+		_, err := w.fs.blobStageBlock(w.name, base64BlockID, &block)
+		w.fs.limiter.release(1)
+		if err != nil {
+			LogError(err)
+			w.mu.Lock()
+			if w.err == nil {
+				w.err = err
+			}
+			w.mu.Unlock()
+		}
+	}()
+}
+
+func (w *blobWriter) stageError() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}